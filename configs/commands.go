@@ -0,0 +1,34 @@
+package configs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	user_services "github.com/http-crud/api/services"
+)
+
+// The function runs the command line subcommand in `args` instead of the server:
+//   - promote-admin <email>: gives the admin role to the existing user with `email`. Users sign up as
+//     regular users and only admins can change roles through the API, so this creates the first admin
+//     of a new deployment, e.g. `go run . promote-admin alice@example.com` after Alice registered.
+//
+// It uses the same environment as the server, so it runs against the same database.
+func RunCommand(args []string) error {
+	switch args[0] {
+	case "promote-admin":
+		if len(args) != 2 {
+			return errors.New("usage: promote-admin <email>")
+		}
+
+		user, e := user_services.PromoteAdmin(context.Background(), args[1])
+		if e != nil {
+			return errors.New(e.Error)
+		}
+
+		fmt.Printf("%s (%s) is now an admin\n", user.Email, user.ID.Hex())
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q, the only command is promote-admin <email>", args[0])
+	}
+}
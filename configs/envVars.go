@@ -1,12 +1,19 @@
 package configs
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 
+	"github.com/http-crud/api/helpers"
+	user_middleware "github.com/http-crud/api/middlewares"
 	user_routes "github.com/http-crud/api/routes"
+	user_services "github.com/http-crud/api/services"
+	"github.com/http-crud/api/sms"
+	"github.com/http-crud/api/storage"
+	"github.com/http-crud/api/tracing"
 
 	"github.com/joho/godotenv"
 )
@@ -17,13 +24,80 @@ func LoadEnvVarsAndStartApp() {
 	}
 	PORT := os.Getenv("PORT")
 
+	// The JWT keys are loaded up front so a missing or unreadable key stops the app at startup instead
+	// of failing every login.
+	if _, err := helpers.JWTKeys(); err != nil {
+		log.Fatalf("Error while loading JWT keys %v", err)
+	}
+
+	if err := user_services.EnsureUserIndexes(context.Background()); err != nil {
+		log.Fatalf("Error while creating the user indexes %v", err)
+	}
+
+	if err := user_services.EnsureMagicLinkIndexes(context.Background()); err != nil {
+		log.Fatalf("Error while creating the magic link indexes %v", err)
+	}
+
+	if err := user_services.EnsureOAuthIndexes(context.Background()); err != nil {
+		log.Fatalf("Error while creating the external identity indexes %v", err)
+	}
+
+	// The blob store is set up front too, so an unreachable bucket is found before the first upload.
+	if _, err := storage.Default(); err != nil {
+		log.Fatalf("Error while setting up the blob store %v", err)
+	}
+
+	// Phone codes are only sent with a configured SMS sender. A sender that is set but not usable is a
+	// mistake, while none at all just turns phone verification and two-step login off.
+	if _, err := sms.Default(); err != nil {
+		if os.Getenv("SMS_SENDER") != "" {
+			log.Fatalf("Error while setting up the SMS sender %v", err)
+		}
+		log.Printf("Phone verification and two-step login are disabled: %v", err)
+	}
+
+	shutdown, err := tracing.InitTracer()
+	if err != nil {
+		log.Fatalf("Error while initializing tracer %v", err)
+	}
+	defer shutdown(context.Background())
+
+	// Deleted accounts are purged in the background once their grace period is over.
+	purgerCtx, stopPurger := context.WithCancel(context.Background())
+	defer stopPurger()
+	user_services.StartUserPurger(purgerCtx)
+
 	mux := http.NewServeMux()
 
 	user_routes.UserRoutes(mux)
+	user_routes.TokenRoutes(mux)
+	user_routes.SessionRoutes(mux)
+	user_routes.AdminRoutes(mux)
+	user_routes.OAuthRoutes(mux)
+	user_routes.OAuthServerRoutes(mux)
+	user_routes.WebAuthnRoutes(mux)
+	user_routes.AvatarRoutes(mux)
+	user_routes.PhoneRoutes(mux)
+	user_routes.MetricsRoutes(mux)
+	user_routes.WellKnownRoutes(mux)
 
 	fmt.Printf("Server running on Port %v \n", PORT)
 
-	if err := http.ListenAndServe(PORT, mux); err != nil {
+	corsConfig, err := user_middleware.LoadCORSConfig()
+	if err != nil {
+		log.Fatalf("Error while loading the CORS settings %v", err)
+	}
+
+	// Every request gets an ID first so a panic recovered further down can be logged with it. CORS and
+	// the security headers are handled before the route middlewares so preflight requests and error
+	// responses get them too.
+	handler := user_middleware.RequestIDMiddleware(
+		user_middleware.RecoveryMiddleware(
+			user_middleware.ClientInfoMiddleware(
+				user_middleware.CORSMiddleware(corsConfig,
+					user_middleware.SecurityHeadersMiddleware(mux)))))
+
+	if err := http.ListenAndServe(PORT, handler); err != nil {
 		log.Fatal(err)
 	}
 }
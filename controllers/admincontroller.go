@@ -0,0 +1,119 @@
+package user_controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/http-crud/api/helpers"
+	user_model "github.com/http-crud/api/models"
+	user_services "github.com/http-crud/api/services"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// This function gives the current admin a short-lived token to act as the user in the `user_id` form
+// value. The `reason` form value is required and kept in the audit log.
+func ImpersonateUserHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	res, err := user_services.StartImpersonation(r.Context(), principal.UserID, r.FormValue("user_id"), r.FormValue("reason"))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function restores the deleted user in the `id` query parameter during its grace period.
+func RestoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := user_services.RestoreUser(r.Context(), r.URL.Query().Get("id"))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function sets the role of the user in the `id` form value to the `role` form value.
+func SetUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	res, err := user_services.SetUserRole(r.Context(), r.FormValue("id"), r.FormValue("role"))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	w.Header().Set("ETag", helpers.ETag(res.Version))
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function lists audit events, newest first. The query parameters filter them:
+//   - user_id: events by or about the user
+//   - action:  events with this action, e.g. "user.login_failed"
+//   - from/to: RFC 3339 times bounding the event time
+//   - before:  the id of the last event of the previous page
+//   - limit:   the page size, 50 by default and at most 500
+func ListAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := auditQueryFromRequest(r)
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+
+	res, err := user_services.QueryAuditEvents(r.Context(), query)
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func auditQueryFromRequest(r *http.Request) (user_model.AuditQuery, *error_handler.NewError) {
+	values := r.URL.Query()
+	query := user_model.AuditQuery{Action: values.Get("action")}
+
+	invalid := func(name string) *error_handler.NewError {
+		return &error_handler.NewError{
+			Error:      "invalid " + name + " query parameter",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	for name, target := range map[string]**primitive.ObjectID{"user_id": &query.UserID, "before": &query.Before} {
+		if value := values.Get(name); value != "" {
+			id, err := primitive.ObjectIDFromHex(value)
+			if err != nil {
+				return query, invalid(name)
+			}
+			*target = &id
+		}
+	}
+
+	for name, target := range map[string]**time.Time{"from": &query.From, "to": &query.To} {
+		if value := values.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return query, invalid(name)
+			}
+			*target = &t
+		}
+	}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 1 {
+			return query, invalid("limit")
+		}
+		query.Limit = limit
+	}
+
+	return query, nil
+}
@@ -0,0 +1,85 @@
+package user_controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/http-crud/api/helpers"
+	user_services "github.com/http-crud/api/services"
+	error_handler "github.com/http-crud/api/utils"
+)
+
+// This function sets the avatar of the current user to the image in the `avatar` field of a
+// multipart form and returns the user with its avatar URLs and new `ETag`.
+func UploadAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	principal := helpers.PrincipalFromContext(r.Context())
+	maxBytes := user_services.AvatarMaxBytes()
+
+	// The form around the file gets some room on top of the limit of the file itself.
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+64<<10)
+
+	file, _, err := r.FormFile("avatar")
+
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		e := &error_handler.NewError{
+			Error:      "the avatar must be sent as the `avatar` field of a multipart form",
+			StatusCode: http.StatusBadRequest,
+		}
+		if errors.As(err, &tooLarge) {
+			e = avatarTooLarge(maxBytes)
+		}
+		error_handler.WriteError(w, e)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+
+	if err != nil {
+		error_handler.WriteError(w, &error_handler.NewError{
+			Error:      "the avatar couldn't be read",
+			StatusCode: http.StatusBadRequest,
+		})
+		return
+	}
+
+	if int64(len(data)) > maxBytes {
+		error_handler.WriteError(w, avatarTooLarge(maxBytes))
+		return
+	}
+
+	res, e := user_services.SetAvatar(r.Context(), principal.UserID, data)
+
+	if e != nil {
+		error_handler.WriteError(w, e)
+		return
+	}
+	w.Header().Set("ETag", helpers.ETag(res.Version))
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function removes the avatar of the current user.
+func DeleteAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	res, err := user_services.DeleteAvatar(r.Context(), principal.UserID)
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	w.Header().Set("ETag", helpers.ETag(res.Version))
+	json.NewEncoder(w).Encode(res)
+}
+
+func avatarTooLarge(maxBytes int64) *error_handler.NewError {
+	return &error_handler.NewError{
+		Error:      fmt.Sprintf("the avatar can't be larger than %d bytes", maxBytes),
+		StatusCode: http.StatusRequestEntityTooLarge,
+	}
+}
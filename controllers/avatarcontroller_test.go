@@ -0,0 +1,54 @@
+package user_controller
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	_ "github.com/http-crud/api/database/databasetest"
+	"github.com/http-crud/api/helpers"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func avatarUpload(t *testing.T, field string, size int) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile(field, "avatar.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(bytes.Repeat([]byte{0}, size))
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/user/me/avatar", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r.WithContext(helpers.WithPrincipal(r.Context(), &helpers.Principal{UserID: primitive.NewObjectID()}))
+}
+
+func TestUploadAvatarHandlerLimits(t *testing.T) {
+	t.Setenv("AVATAR_MAX_BYTES", "1024")
+
+	for _, tc := range []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"file over the limit", avatarUpload(t, "avatar", 2048), http.StatusRequestEntityTooLarge},
+		{"form over the limit", avatarUpload(t, "avatar", 1<<20), http.StatusRequestEntityTooLarge},
+		{"other field", avatarUpload(t, "picture", 16), http.StatusBadRequest},
+		{"not an image", avatarUpload(t, "avatar", 16), http.StatusUnsupportedMediaType},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			UploadAvatarHandler(w, tc.req)
+
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package user_controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/http-crud/api/helpers"
+	user_model "github.com/http-crud/api/models"
+	user_services "github.com/http-crud/api/services"
+	error_handler "github.com/http-crud/api/utils"
+)
+
+// This function applies the email change of the confirmation link in the `token` query parameter
+// and returns the updated user.
+func ConfirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	res, err := user_services.ConfirmEmailChange(r.Context(), r.URL.Query().Get("token"))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function cancels or reverts the email change of the revert link in the `token` query
+// parameter.
+func RevertEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := user_services.RevertEmailChange(r.Context(), r.URL.Query().Get("token")); err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(user_model.MessageResponse{
+		Message: "the email change has been reverted and you have been logged out everywhere",
+	})
+}
+
+// The function returns the pages the links of an email change open. `EMAIL_CHANGE_CONFIRM_URL` and
+// `EMAIL_CHANGE_REVERT_URL` are typically frontend pages that call the endpoints; by default the links
+// point straight at them under `PUBLIC_BASE_URL`. A link left empty because neither is set makes
+// email changes fail rather than trust the Host header.
+func emailChangeLinks() user_model.EmailChangeLinks {
+	links := user_model.EmailChangeLinks{
+		ConfirmURL: os.Getenv("EMAIL_CHANGE_CONFIRM_URL"),
+		RevertURL:  os.Getenv("EMAIL_CHANGE_REVERT_URL"),
+	}
+	if links.ConfirmURL == "" {
+		links.ConfirmURL, _ = helpers.PublicURL("/user/email/confirm")
+	}
+	if links.RevertURL == "" {
+		links.RevertURL, _ = helpers.PublicURL("/user/email/revert")
+	}
+	return links
+}
@@ -0,0 +1,56 @@
+package user_controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/http-crud/api/helpers"
+	user_model "github.com/http-crud/api/models"
+	user_services "github.com/http-crud/api/services"
+	error_handler "github.com/http-crud/api/utils"
+)
+
+// This function emails a login link to the `email` form value. The answer is the same whether or not
+// an account exists.
+func RequestMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	// `MAGIC_LINK_URL` is the page the link opens, typically a frontend page that calls the callback
+	// endpoint; by default the link points straight at the callback endpoint under `PUBLIC_BASE_URL`.
+	// Without either, no links are sent.
+	callbackURL := os.Getenv("MAGIC_LINK_URL")
+	if callbackURL == "" {
+		var err error
+		if callbackURL, err = helpers.PublicURL("/user/login/magic/callback"); err != nil {
+			error_handler.WriteError(w, &error_handler.NewError{
+				Error:      "login links are disabled: " + err.Error(),
+				StatusCode: http.StatusServiceUnavailable,
+			})
+			return
+		}
+	}
+
+	if err := user_services.RequestMagicLink(r.Context(), r.FormValue("email"), helpers.ClientIP(r), callbackURL); err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(user_model.MessageResponse{
+		Message: "if an account exists for this email, a login link has been sent",
+	})
+}
+
+// This function exchanges the login link in the `token` query parameter for the same response as
+// `/user/login`.
+func MagicLinkCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	res, err := user_services.CompleteMagicLinkLogin(r.Context(), r.URL.Query().Get("token"), helpers.ClientIP(r))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	writeLoginResponse(w, helpers.CookieModeRequested(r), res)
+}
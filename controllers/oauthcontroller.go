@@ -0,0 +1,97 @@
+package user_controller
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/http-crud/api/helpers"
+	user_services "github.com/http-crud/api/services"
+	error_handler "github.com/http-crud/api/utils"
+)
+
+// The cookie binding an OAuth login to the browser that started it, so an attacker can't complete a
+// login they started in the victim's browser.
+const oauthStateCookie = "oauth_state"
+
+// The cookie remembering that the browser asked for cookie mode, since the callback is a redirect from
+// the provider and can't carry the client's headers.
+const oauthAuthModeCookie = "oauth_auth_mode"
+
+// This function starts a login with the identity provider in the `provider` query parameter and
+// redirects the browser to it. With `auth_mode=cookie` the callback logs the browser in with cookies.
+func OAuthLoginHandler(w http.ResponseWriter, r *http.Request) {
+	authURL, state, err := user_services.StartOAuthLogin(r.Context(), r.URL.Query().Get("provider"))
+
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		error_handler.WriteError(w, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/user/oauth",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   true,
+		// Lax so the cookie is sent on the top-level redirect back from the provider.
+		SameSite: http.SameSiteLaxMode,
+	})
+	if helpers.CookieModeRequested(r) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     oauthAuthModeCookie,
+			Value:    helpers.AuthModeCookie,
+			Path:     "/user/oauth",
+			MaxAge:   600,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// This function handles the redirect back from the identity provider. It checks the state against
+// the cookie set by `OAuthLoginHandler`, exchanges the code and returns the same response as
+// `/user/login`.
+func OAuthCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+
+	if providerErr := query.Get("error"); providerErr != "" {
+		error_handler.WriteError(w, &error_handler.NewError{
+			Error:      "provider returned an error: " + providerErr,
+			StatusCode: http.StatusUnauthorized,
+		})
+		return
+	}
+
+	state := query.Get("state")
+	cookie, cookieErr := r.Cookie(oauthStateCookie)
+
+	if state == "" || cookieErr != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		error_handler.WriteError(w, &error_handler.NewError{
+			Error:      "state mismatch",
+			StatusCode: http.StatusBadRequest,
+		})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/user/oauth", MaxAge: -1, HttpOnly: true, Secure: true})
+
+	_, modeErr := r.Cookie(oauthAuthModeCookie)
+	cookieMode := modeErr == nil || helpers.CookieModeRequested(r)
+
+	if modeErr == nil {
+		http.SetCookie(w, &http.Cookie{Name: oauthAuthModeCookie, Path: "/user/oauth", MaxAge: -1, HttpOnly: true, Secure: true})
+	}
+
+	res, err := user_services.CompleteOAuthLogin(r.Context(), state, query.Get("code"))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	writeLoginResponse(w, cookieMode, res)
+}
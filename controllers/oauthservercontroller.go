@@ -0,0 +1,196 @@
+package user_controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/http-crud/api/helpers"
+	user_model "github.com/http-crud/api/models"
+	user_services "github.com/http-crud/api/services"
+	error_handler "github.com/http-crud/api/utils"
+)
+
+// This function registers an OAuth client. It reads `name`, `redirect_uris`, `grant_types` and `scopes`
+// as comma or space separated lists, and `confidential`. The client secret is only ever returned in
+// this response.
+func RegisterOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	principal := helpers.PrincipalFromContext(r.Context())
+	confidential, _ := strconv.ParseBool(r.FormValue("confidential"))
+
+	res, err := user_services.RegisterOAuthClient(r.Context(), principal.UserID, user_model.OAuthClient{
+		Name:         r.FormValue("name"),
+		RedirectURIs: splitList(r.FormValue("redirect_uris")),
+		GrantTypes:   splitList(r.FormValue("grant_types")),
+		Scopes:       splitList(r.FormValue("scopes")),
+		Confidential: confidential,
+	})
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function is the API behind the consent screen. GET validates the authorization request and
+// returns what the screen should show. POST records the user's decision (`decision=approve` or `deny`)
+// and returns the URL to send the browser to. The user is identified by their access token, so they
+// log in at `/user/login` first, with the second step when they have two-step login on.
+func OAuthAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		error_handler.WriteError(w, &error_handler.NewError{
+			Error:      fmt.Sprintf("invalid method: %v", r.Method),
+			StatusCode: http.StatusMethodNotAllowed,
+		})
+		return
+	}
+
+	if r.FormValue("response_type") != "code" {
+		error_handler.WriteError(w, &error_handler.NewError{
+			Error:      "unsupported response_type",
+			StatusCode: http.StatusBadRequest,
+		})
+		return
+	}
+
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	if principal == nil {
+		error_handler.WriteError(w, &error_handler.NewError{
+			Error:      "login required",
+			StatusCode: http.StatusUnauthorized,
+		})
+		return
+	}
+
+	if principal.Method != helpers.AuthMethodJWT {
+		error_handler.WriteError(w, &error_handler.NewError{
+			Error:      "this action can't be performed with a personal access token",
+			StatusCode: http.StatusForbidden,
+		})
+		return
+	}
+
+	// Granting an application access would outlive the impersonation.
+	if principal.Impersonated() {
+		error_handler.WriteError(w, &error_handler.NewError{
+			Error:      "this action can't be performed while impersonating a user",
+			StatusCode: http.StatusForbidden,
+		})
+		return
+	}
+
+	userID := principal.UserID
+
+	req := &user_model.OAuthAuthorizationRequest{
+		ClientID:            r.FormValue("client_id"),
+		RedirectURI:         r.FormValue("redirect_uri"),
+		Scopes:              strings.Fields(r.FormValue("scope")),
+		State:               r.FormValue("state"),
+		CodeChallenge:       r.FormValue("code_challenge"),
+		CodeChallengeMethod: r.FormValue("code_challenge_method"),
+	}
+
+	if r.Method == http.MethodGet {
+		res, err := user_services.GetOAuthConsentPrompt(r.Context(), userID, req)
+		if err != nil {
+			error_handler.WriteError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	res, err := user_services.DecideOAuthAuthorization(r.Context(), userID, req, r.PostFormValue("decision") == "approve")
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function is the RFC 6749 token endpoint.
+func OAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	clientID, clientSecret := clientCredentials(r)
+
+	res, err := user_services.ExchangeOAuthToken(r.Context(), &user_model.OAuthTokenRequest{
+		GrantType:    r.PostFormValue("grant_type"),
+		Code:         r.PostFormValue("code"),
+		RedirectURI:  r.PostFormValue("redirect_uri"),
+		CodeVerifier: r.PostFormValue("code_verifier"),
+		RefreshToken: r.PostFormValue("refresh_token"),
+		Scopes:       strings.Fields(r.PostFormValue("scope")),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	})
+
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function is the RFC 7662 token introspection endpoint.
+func OAuthIntrospectHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	clientID, clientSecret := clientCredentials(r)
+
+	res, err := user_services.IntrospectOAuthToken(r.Context(), clientID, clientSecret, r.PostFormValue("token"))
+
+	if err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function is the RFC 7009 token revocation endpoint. It answers 200 for unknown tokens too.
+func OAuthRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	clientID, clientSecret := clientCredentials(r)
+
+	if err := user_services.RevokeOAuthToken(r.Context(), clientID, clientSecret, r.PostFormValue("token")); err != nil {
+		writeOAuthError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// The function reads the client credentials from HTTP Basic authentication, where both values are
+// form-encoded (RFC 6749 section 2.3.1), or else from the form.
+func clientCredentials(r *http.Request) (string, string) {
+	if id, secret, ok := r.BasicAuth(); ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		return id, secret
+	}
+	return r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+}
+
+func writeOAuthError(w http.ResponseWriter, e *user_model.OAuthError) {
+	w.Header().Set("Content-Type", "application/json")
+	if e.Code == "invalid_client" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	w.WriteHeader(e.StatusCode)
+	json.NewEncoder(w).Encode(e)
+}
+
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
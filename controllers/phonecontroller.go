@@ -0,0 +1,94 @@
+package user_controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/http-crud/api/helpers"
+	user_model "github.com/http-crud/api/models"
+	user_services "github.com/http-crud/api/services"
+	error_handler "github.com/http-crud/api/utils"
+)
+
+// This function texts a verification code to the phone of the current user.
+func SendPhoneVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	if err := user_services.SendPhoneVerification(r.Context(), principal.UserID); err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(user_model.MessageResponse{
+		Message: "a verification code has been sent to your phone",
+	})
+}
+
+// This function verifies the phone of the current user with the `code` form value and returns the
+// user with its new `ETag`.
+func ConfirmPhoneHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	res, err := user_services.ConfirmPhone(r.Context(), principal.UserID, r.FormValue("code"))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	w.Header().Set("ETag", helpers.ETag(res.Version))
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function turns the two-step login of the current user on or off with the `enabled` form value.
+// The `password` form value confirms it; an account without a password confirms with its email in the
+// `confirm` form value.
+func SetMFAHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	enabled, parseErr := strconv.ParseBool(r.FormValue("enabled"))
+
+	if parseErr != nil {
+		error_handler.WriteError(w, &error_handler.NewError{
+			Error:      "enabled must be true or false",
+			StatusCode: http.StatusBadRequest,
+			Field:      "enabled",
+		})
+		return
+	}
+
+	res, err := user_services.SetMFA(r.Context(), principal.UserID, enabled, r.FormValue("password"), r.FormValue("confirm"))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	w.Header().Set("ETag", helpers.ETag(res.Version))
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function completes a two-step login with the `mfa_token` of the first step and the `code`
+// texted to the user, and returns the same response as `/user/login`.
+func MFALoginHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	res, err := user_services.CompleteMFALogin(r.Context(), r.FormValue("mfa_token"), r.FormValue("code"))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	writeLoginResponse(w, helpers.CookieModeRequested(r), res)
+}
+
+// The function returns who is logging in: the `email` form value or, when it is empty, the verified
+// phone in the `phone` form value.
+func loginIdentifier(r *http.Request) string {
+	if email := strings.TrimSpace(r.FormValue("email")); email != "" {
+		return email
+	}
+	return strings.TrimSpace(r.FormValue("phone"))
+}
@@ -0,0 +1,104 @@
+package user_controller
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/http-crud/api/helpers"
+	user_model "github.com/http-crud/api/models"
+	user_services "github.com/http-crud/api/services"
+	error_handler "github.com/http-crud/api/utils"
+)
+
+// This function sends the current user everything stored about them. The `format` query parameter is
+// "json" (the default) for a single JSON document or "zip" for an archive with one JSON file per kind
+// of data.
+func ExportUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+
+	if format != "" && format != "json" && format != "zip" {
+		error_handler.WriteError(w, &error_handler.NewError{
+			Error:      `format must be "json" or "zip"`,
+			StatusCode: http.StatusBadRequest,
+		})
+		return
+	}
+
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	res, err := user_services.ExportUserData(r.Context(), principal.UserID)
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+
+	filename := fmt.Sprintf("user-%s-%s", principal.UserID.Hex(), res.ExportedAt.Format("20060102T150405Z"))
+
+	if format != "zip" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".json"))
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".zip"))
+	writeExportZip(w, res)
+}
+
+// The function writes the export as a ZIP archive. The headers are already sent, so an error can only
+// cut the archive short, which the client notices when opening it.
+func writeExportZip(w http.ResponseWriter, export *user_model.UserDataExport) {
+	archive := zip.NewWriter(w)
+	defer archive.Close()
+
+	for _, file := range []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", export.Profile},
+		{"sessions.json", export.Sessions},
+		{"audit_events.json", export.AuditEvents},
+		{"personal_access_tokens.json", export.PersonalAccessTokens},
+		{"oauth_consents.json", export.OAuthConsents},
+		{"webauthn_credentials.json", export.WebAuthnCredentials},
+		{"external_identities.json", export.ExternalIdentities},
+		{"phone_codes.json", export.PhoneCodes},
+		{"email_changes.json", export.EmailChanges},
+	} {
+		f, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Deflate,
+			Modified: export.ExportedAt,
+		})
+		if err != nil {
+			return
+		}
+
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(file.data); err != nil {
+			return
+		}
+	}
+}
+
+// This function erases the account of the current user. The `password` form value confirms it; an
+// account without a password confirms with its email in the `confirm` form value. The response is the
+// deletion receipt and the auth cookies of a browser in cookie mode are removed.
+func EraseUserHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	res, err := user_services.EraseUser(r.Context(), principal.UserID, r.FormValue("password"), r.FormValue("confirm"))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	helpers.ClearAuthCookies(w)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,105 @@
+package user_controller
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/http-crud/api/helpers"
+	user_model "github.com/http-crud/api/models"
+	user_services "github.com/http-crud/api/services"
+	error_handler "github.com/http-crud/api/utils"
+)
+
+// This function lists the devices the current user is logged in on. The session of the request is
+// marked as `current`.
+func ListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	res, err := user_services.ListSessions(r.Context(), principal.UserID, principal.SessionID)
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function logs the current user out of the session given in the `session_id` query parameter,
+// which may be the session of the request itself.
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	res, err := user_services.RevokeSession(r.Context(), principal.UserID, r.URL.Query().Get("session_id"))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function exchanges a refresh token for a new access token and refresh token of the same session.
+// The refresh token is read from the `refresh_token` form value or, in cookie mode, from its cookie; a
+// cookie-authenticated refresh needs the `X-CSRF-Token` header and answers with new cookies.
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	refreshToken := r.FormValue("refresh_token")
+	var csrfToken *string
+
+	if refreshToken == "" {
+		if cookie, err := r.Cookie(helpers.RefreshTokenCookie); err == nil {
+			refreshToken = cookie.Value
+			header := r.Header.Get(helpers.CSRFHeader)
+			csrfToken = &header
+		}
+	}
+
+	res, err := user_services.RefreshSession(r.Context(), refreshToken, csrfToken)
+
+	if err != nil {
+		if csrfToken != nil && err.StatusCode == http.StatusUnauthorized {
+			helpers.ClearAuthCookies(w)
+		}
+		error_handler.WriteError(w, err)
+		return
+	}
+
+	if csrfToken != nil {
+		helpers.SetAuthCookies(w, res.Accesstoken, res.RefreshToken, "")
+		res.Accesstoken, res.RefreshToken = "", ""
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function logs the current session out and removes the auth cookies of a browser in cookie mode.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	res, err := user_services.RevokeSession(r.Context(), principal.UserID, principal.SessionID)
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	helpers.ClearAuthCookies(w)
+	json.NewEncoder(w).Encode(res)
+}
+
+// The function writes the response of a successful login. When the client asked for cookie mode the
+// tokens are set as cookies and only the CSRF token is left in the body; otherwise the tokens are
+// returned in the body and the CSRF token, which is only useful with cookies, is dropped. An MFA
+// challenge has no tokens yet and is written as it is.
+func writeLoginResponse(w http.ResponseWriter, cookieMode bool, res *user_model.UserLoginResponse) {
+	if res.MFARequired {
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	if cookieMode {
+		helpers.SetAuthCookies(w, res.Accesstoken, res.RefreshToken, res.CSRFToken)
+		res.Accesstoken, res.RefreshToken = "", ""
+	} else {
+		res.CSRFToken = ""
+	}
+	json.NewEncoder(w).Encode(res)
+}
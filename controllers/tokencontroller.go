@@ -0,0 +1,85 @@
+package user_controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/http-crud/api/helpers"
+	user_services "github.com/http-crud/api/services"
+	error_handler "github.com/http-crud/api/utils"
+)
+
+// This function creates a personal access token for the current user. The token is only ever returned
+// in this response. It reads `name`, a comma separated `scopes` list and an optional expiry given either
+// as `expires_in` (a duration such as "720h") or `expires_at` (RFC 3339).
+func CreatePersonalAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	var scopes []string
+	for _, scope := range strings.Split(r.FormValue("scopes"), ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	var expiresAt *time.Time
+
+	if v := r.FormValue("expires_in"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			error_handler.WriteError(w, &error_handler.NewError{
+				Error:      "invalid expires_in: " + err.Error(),
+				StatusCode: http.StatusBadRequest,
+			})
+			return
+		}
+		t := time.Now().Add(d).UTC()
+		expiresAt = &t
+	} else if v := r.FormValue("expires_at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			error_handler.WriteError(w, &error_handler.NewError{
+				Error:      "invalid expires_at: " + err.Error(),
+				StatusCode: http.StatusBadRequest,
+			})
+			return
+		}
+		t = t.UTC()
+		expiresAt = &t
+	}
+
+	res, err := user_services.CreatePersonalAccessToken(r.Context(), principal.UserID, r.FormValue("name"), scopes, expiresAt)
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func ListPersonalAccessTokensHandler(w http.ResponseWriter, r *http.Request) {
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	res, err := user_services.ListPersonalAccessTokens(r.Context(), principal.UserID)
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func RevokePersonalAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	res, err := user_services.RevokePersonalAccessToken(r.Context(), principal.UserID, r.URL.Query().Get("token_id"))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
@@ -2,10 +2,11 @@ package user_controller
 
 import (
 	"encoding/json"
-	"fmt"
+	"io"
+	"mime"
 	"net/http"
 
-	user_middleware "github.com/http-crud/api/middlewares"
+	"github.com/http-crud/api/helpers"
 	user_model "github.com/http-crud/api/models"
 	user_services "github.com/http-crud/api/services"
 	error_handler "github.com/http-crud/api/utils"
@@ -13,73 +14,188 @@ import (
 
 // This function handles the registration of a user and returns the result in JSON format.
 func RegisterUserHandler(w http.ResponseWriter, r *http.Request) {
-	res, err := user_services.RegisterUser(user_middleware.User)
+	res, err := user_services.RegisterUser(r.Context(), helpers.SignupFromContext(r.Context()))
 	defer r.Body.Close()
 	if err != nil {
-		json.NewEncoder(w).Encode(err)
+		error_handler.WriteError(w, err)
 		return
 	}
 	json.NewEncoder(w).Encode(res)
 }
 
 func LoginUserHandler(w http.ResponseWriter, r *http.Request) {
-	user_email := r.FormValue("email")
+	user_identifier := loginIdentifier(r)
 	user_password := r.FormValue("password")
 	defer r.Body.Close()
 
-	jwt, err := user_services.LoginUser(user_email, user_password)
+	jwt, err := user_services.LoginUser(r.Context(), user_identifier, user_password)
 
 	defer r.Body.Close()
 
 	if err != nil {
-		json.NewEncoder(w).Encode(err)
+		error_handler.WriteError(w, err)
 		return
 	}
-	json.NewEncoder(w).Encode(jwt)
+	writeLoginResponse(w, helpers.CookieModeRequested(r), jwt)
 }
 
+// This function returns the user in the `id` query parameter to an admin.
 func GetUserHandler(w http.ResponseWriter, r *http.Request) {
-	user, err := user_services.GetUserById(r.URL.Query().Get("id"))
+	getUser(w, r, r.URL.Query().Get("id"))
+}
+
+// This function returns the current user.
+func GetMeHandler(w http.ResponseWriter, r *http.Request) {
+	getUser(w, r, helpers.PrincipalFromContext(r.Context()).UserID.Hex())
+}
+
+// The function writes the user with `id` with its version as `ETag`. A request whose `If-None-Match`
+// holds the current ETag gets 304 Not Modified.
+func getUser(w http.ResponseWriter, r *http.Request, id string) {
+	user, err := user_services.GetUserById(r.Context(), id)
 	defer r.Body.Close()
 
 	if err != nil {
-		json.NewEncoder(w).Encode(err)
+		error_handler.WriteError(w, err)
+		return
+	}
+
+	etag := helpers.ETag(user.Version)
+	w.Header().Set("ETag", etag)
+
+	if helpers.IfNoneMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	json.NewEncoder(w).Encode(user)
 }
 
+// This function updates the user in the `id` query parameter for an admin.
 func UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
-	var user user_model.User
+	updateUser(w, r, r.URL.Query().Get("id"))
+}
+
+// This function updates the current user.
+func UpdateMeHandler(w http.ResponseWriter, r *http.Request) {
+	updateUser(w, r, helpers.PrincipalFromContext(r.Context()).UserID.Hex())
+}
+
+// The function applies the JSON Merge Patch or JSON Patch in the body to the user with `id` and
+// writes the updated user with its new `ETag`. The patch format is chosen by the `Content-Type` header
+// and `If-Match` must hold the ETag the client last saw. A new email is pending until confirmed.
+func updateUser(w http.ResponseWriter, r *http.Request, id string) {
 	defer r.Body.Close()
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		fmt.Println("avgws")
-		mErr, _ := json.Marshal(error_handler.NewError{
+
+	ifMatch, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	patch, readErr := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+
+	if readErr != nil || len(patch) == 0 {
+		error_handler.WriteError(w, &error_handler.NewError{
 			Error:      "no data found",
-			StatusCode: http.StatusNoContent,
+			StatusCode: http.StatusBadRequest,
 		})
-		w.Write(mErr)
 		return
 	}
-	id := r.URL.Query().Get("id")
-	res, err := user_services.UpdateUser(&user, id)
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	res, err := user_services.UpdateUser(r.Context(), id, ifMatch, contentType, patch, emailChangeLinks())
 
 	if err != nil {
-		json.NewEncoder(w).Encode(err)
+		error_handler.WriteError(w, err)
 		return
 	}
+	w.Header().Set("ETag", helpers.ETag(res.Version))
 	json.NewEncoder(w).Encode(res)
 }
 
+// This function deletes the user in the `id` query parameter for an admin.
 func DeletUserHandler(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
+	deleteUser(w, r, r.URL.Query().Get("id"))
+}
 
-	res, err := user_services.DeleteUser(id)
+// This function deletes the current user.
+func DeleteMeHandler(w http.ResponseWriter, r *http.Request) {
+	deleteUser(w, r, helpers.PrincipalFromContext(r.Context()).UserID.Hex())
+}
+
+// The function deletes the user with `id`. `If-Match` must hold the ETag the client last saw.
+func deleteUser(w http.ResponseWriter, r *http.Request, id string) {
+	ifMatch, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := user_services.DeleteUser(r.Context(), id, ifMatch)
 
 	if err != nil {
-		json.NewEncoder(w).Encode(err)
+		error_handler.WriteError(w, err)
 		return
 	}
 	json.NewEncoder(w).Encode(res)
 }
+
+// The function reads the `If-Match` header of a request that changes a user. The header is required so
+// a client can't overwrite changes it hasn't seen; the version is nil for "*". When the header is
+// missing (428) or isn't a version ETag (400) the error is written and `ok` is false; a version that
+// is no longer current fails later with 412.
+func ifMatchVersion(w http.ResponseWriter, r *http.Request) (version *int64, ok bool) {
+	header := r.Header.Get("If-Match")
+
+	if header == "" {
+		error_handler.WriteError(w, &error_handler.NewError{
+			Error:      "If-Match header with the user's ETag is required",
+			StatusCode: http.StatusPreconditionRequired,
+		})
+		return nil, false
+	}
+
+	v, wildcard, valid := helpers.ParseIfMatch(header)
+
+	if !valid {
+		error_handler.WriteError(w, &error_handler.NewError{
+			Error:      "If-Match header must be a strong ETag or *",
+			StatusCode: http.StatusBadRequest,
+		})
+		return nil, false
+	}
+
+	if wildcard {
+		return nil, true
+	}
+	return &v, true
+}
+
+// This function changes the password of the current user. It reads `current_password`, `password` and
+// `confirmpassword`; every other session of the user is logged out.
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	err := user_services.ChangePassword(r.Context(), principal.UserID, principal.SessionID, r.FormValue("current_password"), r.FormValue("password"), r.FormValue("confirmpassword"))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(user_model.MessageResponse{Message: "password changed"})
+}
+
+// This function restores the deleted account of the `email` (or `phone`) and `password` form values
+// during its grace period and logs the user in.
+func RestoreAccountHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	res, err := user_services.RestoreAccount(r.Context(), loginIdentifier(r), r.FormValue("password"))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	writeLoginResponse(w, helpers.CookieModeRequested(r), res)
+}
@@ -0,0 +1,92 @@
+package user_controller
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/http-crud/api/helpers"
+	user_model "github.com/http-crud/api/models"
+	user_services "github.com/http-crud/api/services"
+	error_handler "github.com/http-crud/api/utils"
+)
+
+// This function starts registering a passkey for the current user. The response holds the options for
+// `navigator.credentials.create()` and the `session_id` to finish the registration with.
+func BeginWebAuthnRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	res, err := user_services.BeginWebAuthnRegistration(r.Context(), principal.UserID)
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function finishes registering a passkey. The body is the credential returned by
+// `navigator.credentials.create()`; `session_id` and an optional `name` are query parameters.
+func FinishWebAuthnRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	principal := helpers.PrincipalFromContext(r.Context())
+	query := r.URL.Query()
+
+	res, err := user_services.FinishWebAuthnRegistration(r.Context(), principal.UserID, query.Get("session_id"), query.Get("name"), r.Body)
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function starts a passkey login. With the optional `email` form value only that account's
+// passkeys are offered, otherwise the authenticator chooses the account.
+func BeginWebAuthnLoginHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	res, err := user_services.BeginWebAuthnLogin(r.Context(), r.FormValue("email"))
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// This function finishes a passkey login and returns the same response as `/user/login`. The body is
+// the assertion returned by `navigator.credentials.get()` and `session_id` is a query parameter.
+func FinishWebAuthnLoginHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	res, err := user_services.FinishWebAuthnLogin(r.Context(), r.URL.Query().Get("session_id"), r.Body)
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	writeLoginResponse(w, helpers.CookieModeRequested(r), res)
+}
+
+func ListWebAuthnCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	res, err := user_services.ListWebAuthnCredentials(r.Context(), principal.UserID)
+
+	if err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func DeleteWebAuthnCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	principal := helpers.PrincipalFromContext(r.Context())
+
+	if err := user_services.DeleteWebAuthnCredential(r.Context(), principal.UserID, r.URL.Query().Get("credential_id")); err != nil {
+		error_handler.WriteError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(user_model.MessageResponse{Message: "passkey removed"})
+}
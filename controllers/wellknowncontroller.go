@@ -0,0 +1,30 @@
+package user_controller
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/http-crud/api/helpers"
+	error_handler "github.com/http-crud/api/utils"
+)
+
+// This function serves the public keys tokens are verified with as a JWKS document, so other services
+// can verify tokens without sharing a secret.
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	keys, err := helpers.JWTKeys()
+
+	if err != nil {
+		error_handler.WriteError(w, &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusInternalServerError,
+		})
+		return
+	}
+
+	// Verifiers may cache the document for a few minutes; a new key is published in the verification
+	// keys before it starts signing, so the cache never misses a key in use.
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(keys.JWKS())
+}
@@ -0,0 +1,21 @@
+// Package databasetest points the database package at a MongoDB for tests. Test files import it for
+// its side effect, before anything opens a collection:
+//
+//	import _ "github.com/http-crud/api/database/databasetest"
+//
+// It only imports "os", so Go initializes it before the database package, which also needs the .env
+// loader and the MongoDB driver, and the client is created with these settings.
+package databasetest
+
+import "os"
+
+func init() {
+	// A local MongoDB by default, the client only dials once it is used.
+	if os.Getenv("MONGO_CONNECTION_URI") == "" {
+		os.Setenv("MONGO_CONNECTION_URI", "mongodb://localhost:27017")
+	}
+	// Tests never touch the data of the app.
+	if os.Getenv("MONGO_DATABASE") == "" {
+		os.Setenv("MONGO_DATABASE", "http-crud-test")
+	}
+}
@@ -2,19 +2,23 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"time"
 
+	"github.com/http-crud/api/tracing"
 	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // This function connects to a MongoDB database using a provided connection URI and returns a client object.
+// The .env file is optional, the variables can also come from the environment of the process.
 func ConnectToDatabase() *mongo.Client {
-	if err := godotenv.Load(); err != nil {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
 		log.Fatalf("Error while loading ENV %v", err)
 	}
 	var url string
@@ -23,7 +27,9 @@ func ConnectToDatabase() *mongo.Client {
 		log.Fatal("connection url is empty")
 	}
 
-	client, err := mongo.NewClient(options.Client().ApplyURI(url))
+	// The command monitor creates a span for every command, so Mongo calls are traced as children of
+	// the request that issued them.
+	client, err := mongo.NewClient(options.Client().ApplyURI(url).SetMonitor(tracing.MongoMonitor()))
 
 	if err != nil {
 		log.Fatal(err)
@@ -46,7 +52,15 @@ func ConnectToDatabase() *mongo.Client {
 // accessed and used throughout the package to interact with the MongoDB database.
 var Client *mongo.Client = ConnectToDatabase()
 
-// The function returns a MongoDB collection given a client and collection name.
+// The function returns a MongoDB collection given a client and collection name. The database is
+// `MONGO_DATABASE`, "http-crud" by default.
 func OpenCollection(client mongo.Client, collectionName string) *mongo.Collection {
-	return client.Database("http-crud").Collection(collectionName)
+	return client.Database(databaseName()).Collection(collectionName)
+}
+
+func databaseName() string {
+	if name := os.Getenv("MONGO_DATABASE"); name != "" {
+		return name
+	}
+	return "http-crud"
 }
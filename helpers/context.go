@@ -0,0 +1,106 @@
+package helpers
+
+import (
+	"context"
+
+	user_model "github.com/http-crud/api/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type contextKey string
+
+const (
+	requestIDKey contextKey = "requestID"
+	principalKey contextKey = "principal"
+	clientKey    contextKey = "client"
+	signupKey    contextKey = "signup"
+)
+
+// Ways a principal can authenticate.
+const (
+	AuthMethodJWT = "jwt"
+	AuthMethodPAT = "pat"
+)
+
+// `Principal` is the authenticated caller of a request. `Scopes` is nil for a JWT, which grants full
+// access to the user's own account; a personal access token only grants the scopes it was created
+// with. `ActorID` is set when an admin is impersonating the user.
+type Principal struct {
+	UserID    primitive.ObjectID
+	Method    string
+	TokenID   string
+	SessionID string
+	Scopes    []string
+	ActorID   *primitive.ObjectID
+}
+
+// The function reports whether an admin is acting as the user.
+func (p *Principal) Impersonated() bool {
+	return p.ActorID != nil
+}
+
+// `ClientInfo` describes the device a request comes from. It is recorded on the session created when a
+// user logs in.
+type ClientInfo struct {
+	IP         string
+	UserAgent  string
+	DeviceName string
+}
+
+// The function reports whether the principal may perform actions that need `scope`.
+func (p *Principal) HasScope(scope string) bool {
+	if p.Scopes == nil {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// The function returns a copy of `ctx` carrying the request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// The function returns the request ID stored in `ctx`, or an empty string when there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// The function returns a copy of `ctx` carrying the authenticated principal.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// The function returns the principal stored in `ctx`, or nil for unauthenticated requests.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey).(*Principal)
+	return p
+}
+
+// The function returns a copy of `ctx` carrying the client of the request.
+func WithClientInfo(ctx context.Context, c ClientInfo) context.Context {
+	return context.WithValue(ctx, clientKey, c)
+}
+
+// The function returns the client stored in `ctx`, or an empty `ClientInfo` when there is none.
+func ClientInfoFromContext(ctx context.Context) ClientInfo {
+	c, _ := ctx.Value(clientKey).(ClientInfo)
+	return c
+}
+
+// The function returns a copy of `ctx` carrying the user read from a registration form. Each request
+// gets its own copy, so concurrent signups can't see each other's form.
+func WithSignup(ctx context.Context, user *user_model.User) context.Context {
+	return context.WithValue(ctx, signupKey, user)
+}
+
+// The function returns the user read from the registration form, or nil when there is none.
+func SignupFromContext(ctx context.Context) *user_model.User {
+	user, _ := ctx.Value(signupKey).(*user_model.User)
+	return user
+}
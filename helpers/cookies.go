@@ -0,0 +1,113 @@
+package helpers
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the cookies and headers used by browser clients in cookie mode. The access and refresh
+// tokens are HttpOnly; the CSRF token cookie is readable by the page, which echoes it back in
+// `CSRFHeader` on unsafe requests.
+const (
+	AccessTokenCookie  = "access_token"
+	RefreshTokenCookie = "refresh_token"
+	CSRFCookie         = "csrf_token"
+	CSRFHeader         = "X-CSRF-Token"
+	AuthModeHeader     = "X-Auth-Mode"
+	AuthModeCookie     = "cookie"
+)
+
+// `RefreshTokenPath` is the only path the refresh token cookie is sent to.
+const RefreshTokenPath = "/user/token/refresh"
+
+// `CookieConfig` holds the attributes of the auth cookies.
+type CookieConfig struct {
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+}
+
+// The function reads the cookie settings from the environment.
+//   - COOKIE_DOMAIN: `Domain` attribute, default none (host-only cookies)
+//   - COOKIE_SECURE: `Secure` attribute, default true; only turn it off for local development over http
+//   - COOKIE_SAMESITE: "strict", "lax" or "none", default "strict"
+func LoadCookieConfig() CookieConfig {
+	secure, err := strconv.ParseBool(os.Getenv("COOKIE_SECURE"))
+	if err != nil {
+		secure = true
+	}
+
+	sameSite := http.SameSiteStrictMode
+	switch strings.ToLower(os.Getenv("COOKIE_SAMESITE")) {
+	case "lax":
+		sameSite = http.SameSiteLaxMode
+	case "none":
+		// Browsers drop SameSite=None cookies that aren't Secure.
+		sameSite = http.SameSiteNoneMode
+		secure = true
+	}
+
+	return CookieConfig{
+		Domain:   os.Getenv("COOKIE_DOMAIN"),
+		Secure:   secure,
+		SameSite: sameSite,
+	}
+}
+
+// The function reports whether the client asked for cookie mode, with the `X-Auth-Mode: cookie` header
+// or an `auth_mode=cookie` query parameter.
+func CookieModeRequested(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get(AuthModeHeader), AuthModeCookie) ||
+		strings.EqualFold(r.URL.Query().Get("auth_mode"), AuthModeCookie)
+}
+
+// The function sets the auth cookies. Empty values are left untouched, so a refresh that doesn't rotate
+// the CSRF token keeps the existing cookie.
+func SetAuthCookies(w http.ResponseWriter, accessToken, refreshToken, csrfToken string) {
+	config := LoadCookieConfig()
+	sessionTTL := EnvDuration("SESSION_TTL", 720*time.Hour)
+
+	set := func(name, value, path string, maxAge time.Duration, httpOnly bool) {
+		if value == "" {
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     path,
+			Domain:   config.Domain,
+			MaxAge:   int(maxAge.Seconds()),
+			Secure:   config.Secure,
+			HttpOnly: httpOnly,
+			SameSite: config.SameSite,
+		})
+	}
+
+	set(AccessTokenCookie, accessToken, "/", LoadTokenConfig().AccessTTL, true)
+	set(RefreshTokenCookie, refreshToken, RefreshTokenPath, sessionTTL, true)
+	set(CSRFCookie, csrfToken, "/", sessionTTL, false)
+}
+
+// The function removes the auth cookies, logging the browser out.
+func ClearAuthCookies(w http.ResponseWriter) {
+	config := LoadCookieConfig()
+
+	for _, c := range []struct{ name, path string }{
+		{AccessTokenCookie, "/"},
+		{RefreshTokenCookie, RefreshTokenPath},
+		{CSRFCookie, "/"},
+	} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     c.name,
+			Path:     c.path,
+			Domain:   config.Domain,
+			MaxAge:   -1,
+			Secure:   config.Secure,
+			HttpOnly: c.name != CSRFCookie,
+			SameSite: config.SameSite,
+		})
+	}
+}
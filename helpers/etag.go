@@ -0,0 +1,44 @@
+package helpers
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The function returns the strong ETag of a document at `version`.
+func ETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// The function reads the version an `If-Match` header asks for. `wildcard` is true for "*", which
+// matches every version. Weak tags are refused since `If-Match` uses strong comparison.
+func ParseIfMatch(header string) (version int64, wildcard bool, ok bool) {
+	header = strings.TrimSpace(header)
+
+	if header == "*" {
+		return 0, true, true
+	}
+
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return 0, false, false
+	}
+
+	version, err := strconv.ParseInt(header[1:len(header)-1], 10, 64)
+	if err != nil || version < 0 {
+		return 0, false, false
+	}
+
+	return version, false, true
+}
+
+// The function reports whether an `If-None-Match` header lists `etag` or is "*". Weak tags match too,
+// as `If-None-Match` uses weak comparison.
+func IfNoneMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
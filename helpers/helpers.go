@@ -4,12 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"time"
+	"unicode"
 
-	"github.com/golang-jwt/jwt/v4"
 	user_model "github.com/http-crud/api/models"
 	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -24,18 +24,49 @@ func HashPassword(password string) (string, error) {
 	return string(res), nil
 }
 
-// The function generates a JWT token for a user with a specified expiration time and secret key.
-func GenerateJWT(user *user_model.User) (string, *error_handler.NewError) {
-	userSigningStruct := user_model.UserJWTSigningStruct{
-		ID: user.ID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			Issuer:    user.ID.Hex(),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute * 30)),
-		},
+// The function generates a JWT token for a user with the standard `iss`, `sub`, `aud`, `iat`, `nbf`,
+// `exp` and `jti` claims and the `sid` of the login session. Its lifetime is `JWT_ACCESS_TOKEN_TTL`. It
+// is signed with the signing key of `JWTKeys` and carries its `kid` header.
+func GenerateJWT(user *user_model.User, sessionID string) (string, *error_handler.NewError) {
+	keys, err := JWTKeys()
+
+	if err != nil {
+		return "", &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	userSigningStruct := NewUserClaims(user, LoadTokenConfig().AccessTTL)
+	userSigningStruct.SessionID = sessionID
+	jwt, err := keys.Sign(userSigningStruct)
+
+	if err != nil {
+		return "", &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	return jwt, nil
+}
+
+// The function generates a JWT that lets the admin `actorID` act as `user` for `ttl`. It has the claims
+// of `GenerateJWT` plus the admin in the `act` claim.
+func GenerateImpersonationJWT(user *user_model.User, sessionID string, actorID primitive.ObjectID, ttl time.Duration) (string, *error_handler.NewError) {
+	keys, err := JWTKeys()
+
+	if err != nil {
+		return "", &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusInternalServerError,
+		}
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, userSigningStruct)
-	fmt.Println(os.Getenv("JWT_SECRET_KEY"))
-	jwt, err := token.SignedString([]byte(os.Getenv("JWT_SECRET_KEY")))
+
+	userSigningStruct := NewUserClaims(user, ttl)
+	userSigningStruct.SessionID = sessionID
+	userSigningStruct.Actor = &user_model.ActorClaim{Subject: actorID.Hex()}
+	jwt, err := keys.Sign(userSigningStruct)
 
 	if err != nil {
 		return "", &error_handler.NewError{
@@ -47,6 +78,22 @@ func GenerateJWT(user *user_model.User) (string, *error_handler.NewError) {
 	return jwt, nil
 }
 
+// The function reports which of the required character classes a password contains: a number, an
+// upper case letter and a symbol or punctuation mark.
+func VerifyPassword(s string) (hasNum, hasHupper, hasSpecial bool) {
+	for _, c := range s {
+		switch {
+		case unicode.IsNumber(c):
+			hasNum = true
+		case unicode.IsUpper(c):
+			hasHupper = true
+		case unicode.IsSymbol(c) || unicode.IsPunct(c):
+			hasSpecial = true
+		}
+	}
+	return hasNum, hasHupper, hasSpecial
+}
+
 // The function Marshal takes an interface and returns a JSON-encoded byte slice and an error.
 func Marshal(a interface{}) ([]byte, error) {
 	marshalledResponse, err := json.Marshal(a)
@@ -0,0 +1,118 @@
+package helpers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	user_model "github.com/http-crud/api/models"
+)
+
+// `TokenConfig` holds the claims this service puts in the tokens it issues and checks in the tokens it
+// receives.
+type TokenConfig struct {
+	Issuer    string
+	Audience  []string
+	AccessTTL time.Duration
+	ClockSkew time.Duration
+}
+
+// The function reads the token settings from the environment.
+//   - JWT_ISSUER: `iss` claim, default "http-crud-api"
+//   - JWT_AUDIENCE: comma separated `aud` claim, default the issuer
+//   - JWT_ACCESS_TOKEN_TTL: lifetime of access tokens, default 30m
+//   - JWT_CLOCK_SKEW: leeway applied to `exp`, `nbf` and `iat`, default 30s
+func LoadTokenConfig() TokenConfig {
+	config := TokenConfig{
+		Issuer:    os.Getenv("JWT_ISSUER"),
+		Audience:  EnvList("JWT_AUDIENCE"),
+		AccessTTL: EnvDuration("JWT_ACCESS_TOKEN_TTL", 30*time.Minute),
+		ClockSkew: EnvDuration("JWT_CLOCK_SKEW", 30*time.Second),
+	}
+	if config.Issuer == "" {
+		config.Issuer = "http-crud-api"
+	}
+	if len(config.Audience) == 0 {
+		config.Audience = []string{config.Issuer}
+	}
+	return config
+}
+
+// The function returns the registered claims of a token issued now for the user, valid for `ttl`.
+func NewUserClaims(user *user_model.User, ttl time.Duration) user_model.UserJWTSigningStruct {
+	config := LoadTokenConfig()
+	now := time.Now()
+
+	return user_model.UserJWTSigningStruct{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    config.Issuer,
+			Subject:   user.ID.Hex(),
+			Audience:  config.Audience,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			ID:        NewTokenID(),
+		},
+	}
+}
+
+// The function returns a random `jti`.
+func NewTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// The function verifies the signature of a token and validates its claims: the issuer must be this
+// service, the audience must contain one of ours, and `exp`, `nbf` and `iat` are checked with the
+// configured clock skew. `exp` and `sub` are required.
+func ParseJWT(tokenString string) (*user_model.UserJWTSigningStruct, error) {
+	keys, err := JWTKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	// The time based claims are validated below with leeway, which the v4 parser doesn't support.
+	parser := jwt.NewParser(jwt.WithoutClaimsValidation())
+	claims := &user_model.UserJWTSigningStruct{}
+
+	if _, err := parser.ParseWithClaims(tokenString, claims, keys.Keyfunc); err != nil {
+		return nil, err
+	}
+
+	config := LoadTokenConfig()
+	now := time.Now()
+
+	switch {
+	case claims.ExpiresAt == nil:
+		return nil, errors.New("jwt has no expiry")
+	case now.After(claims.ExpiresAt.Add(config.ClockSkew)):
+		return nil, errors.New("jwt expired")
+	case claims.NotBefore != nil && now.Add(config.ClockSkew).Before(claims.NotBefore.Time):
+		return nil, errors.New("jwt not valid yet")
+	case claims.IssuedAt != nil && now.Add(config.ClockSkew).Before(claims.IssuedAt.Time):
+		return nil, errors.New("jwt issued in the future")
+	case claims.Issuer != config.Issuer:
+		return nil, errors.New("jwt issuer not accepted")
+	case !audienceAccepted(claims.Audience, config.Audience):
+		return nil, errors.New("jwt audience not accepted")
+	case claims.Subject == "":
+		return nil, errors.New("jwt has no subject")
+	}
+
+	return claims, nil
+}
+
+func audienceAccepted(audience jwt.ClaimStrings, accepted []string) bool {
+	for _, a := range audience {
+		for _, b := range accepted {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
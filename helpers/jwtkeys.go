@@ -0,0 +1,338 @@
+package helpers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// `VerificationKey` is a public key that tokens may be signed with, identified by the `kid` header.
+type VerificationKey struct {
+	KID    string
+	Method jwt.SigningMethod
+	Public crypto.PublicKey
+}
+
+// `KeySet` holds the key new tokens are signed with and every key tokens are still verified with.
+// Keeping the previous and the next key in `verification` lets keys rotate without invalidating tokens
+// that are already issued.
+type KeySet struct {
+	signingKID    string
+	signingMethod jwt.SigningMethod
+	signingKey    interface{}
+	verification  map[string]VerificationKey
+	secret        []byte
+}
+
+var (
+	jwtKeysOnce sync.Once
+	jwtKeys     *KeySet
+	jwtKeysErr  error
+)
+
+// The function returns the key set loaded from the environment. It is loaded once, the first time it
+// is needed; call it at startup to fail fast on a bad configuration.
+func JWTKeys() (*KeySet, error) {
+	jwtKeysOnce.Do(func() {
+		jwtKeys, jwtKeysErr = LoadKeySet()
+	})
+	return jwtKeys, jwtKeysErr
+}
+
+// The function builds the key set from the environment.
+//   - JWT_SIGNING_KEY_FILE: PEM private key used to sign tokens (RSA, ECDSA P-256/384/521 or Ed25519).
+//     The algorithm is RS256, ES256/384/512 or EdDSA depending on the key.
+//   - JWT_SIGNING_KEY_ID: `kid` of the signing key, defaults to its RFC 7638 thumbprint.
+//   - JWT_VERIFICATION_KEYS: comma separated `kid=path` list of PEM public keys or certificates that
+//     are still accepted, for example the key being retired.
+//   - JWT_SECRET_KEY: HS256 secret. It is only used when no signing key file is configured, or for
+//     verification when JWT_ACCEPT_HS256 is true while clients migrate.
+func LoadKeySet() (*KeySet, error) {
+	ks := &KeySet{verification: map[string]VerificationKey{}}
+
+	path := os.Getenv("JWT_SIGNING_KEY_FILE")
+	if path == "" {
+		secret := os.Getenv("JWT_SECRET_KEY")
+		if secret == "" {
+			return nil, errors.New("neither JWT_SIGNING_KEY_FILE nor JWT_SECRET_KEY is set")
+		}
+		ks.secret = []byte(secret)
+		ks.signingMethod = jwt.SigningMethodHS256
+		ks.signingKey = ks.secret
+		return ks, nil
+	}
+
+	private, err := readPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	public := private.Public()
+	method, err := signingMethodFor(public)
+	if err != nil {
+		return nil, err
+	}
+	kid := os.Getenv("JWT_SIGNING_KEY_ID")
+	if kid == "" {
+		if kid, err = thumbprint(public); err != nil {
+			return nil, err
+		}
+	}
+	ks.signingKID = kid
+	ks.signingMethod = method
+	ks.signingKey = private
+	ks.verification[kid] = VerificationKey{KID: kid, Method: method, Public: public}
+
+	for _, entry := range strings.Split(os.Getenv("JWT_VERIFICATION_KEYS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		kid, path, ok := strings.Cut(entry, "=")
+		if !ok || kid == "" || path == "" {
+			return nil, fmt.Errorf("invalid JWT_VERIFICATION_KEYS entry %q, expected kid=path", entry)
+		}
+		public, err := readPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		method, err := signingMethodFor(public)
+		if err != nil {
+			return nil, err
+		}
+		ks.verification[kid] = VerificationKey{KID: kid, Method: method, Public: public}
+	}
+
+	if accept, _ := strconv.ParseBool(os.Getenv("JWT_ACCEPT_HS256")); accept {
+		ks.secret = []byte(os.Getenv("JWT_SECRET_KEY"))
+	}
+
+	return ks, nil
+}
+
+// The function signs `claims` with the signing key and sets the `kid` header.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signingMethod, claims)
+	if ks.signingKID != "" {
+		token.Header["kid"] = ks.signingKID
+	}
+	return token.SignedString(ks.signingKey)
+}
+
+// The function reports whether tokens are signed with an asymmetric key, whose public key is in the
+// JWKS document so anyone can verify them. An HS256 secret can only be checked by this server.
+func (ks *KeySet) PublicKeySigning() bool {
+	return ks.signingKID != ""
+}
+
+// The function is a `jwt.Keyfunc`. It picks the verification key from the `kid` header and rejects
+// tokens whose `alg` doesn't match that key, so a public key can never be used as an HMAC secret.
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	if kid == "" {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok && len(ks.secret) != 0 {
+			return ks.secret, nil
+		}
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	key, ok := ks.verification[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %v", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.Public, nil
+}
+
+// `JWK` is a public JSON Web Key as published in the JWKS document.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// `JWKS` is the document served at `/.well-known/jwks.json`.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// The function returns every verification key as a JWKS document. HMAC secrets are never published.
+func (ks *KeySet) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range ks.verification {
+		jwk, err := toJWK(key)
+		if err == nil {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+func toJWK(key VerificationKey) (JWK, error) {
+	enc := base64.RawURLEncoding
+	jwk := JWK{Kid: key.KID, Use: "sig", Alg: key.Method.Alg()}
+
+	switch pub := key.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = enc.EncodeToString(pub.N.Bytes())
+		jwk.E = enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = enc.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = enc.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = enc.EncodeToString(pub)
+	default:
+		return JWK{}, fmt.Errorf("unsupported key type %T", key.Public)
+	}
+	return jwk, nil
+}
+
+// The function computes the RFC 7638 thumbprint of a public key, used as the default `kid`.
+func thumbprint(public crypto.PublicKey) (string, error) {
+	jwk, err := toJWK(VerificationKey{Public: public, Method: jwt.SigningMethodNone})
+	if err != nil {
+		return "", err
+	}
+
+	// The thumbprint covers only the required members, in lexicographic order.
+	var members interface{}
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+
+	b, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func signingMethodFor(public crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, fmt.Errorf("unsupported ECDSA curve %v", pub.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", public)
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error occured while reading key %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %v", path)
+	}
+	return block, nil
+}
+
+func readPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error occured while parsing private key %v: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error occured while parsing certificate %v: %w", path, err)
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error occured while parsing public key %v: %w", path, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,45 @@
+package helpers
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// `ErrNoPublicBaseURL` is returned by `PublicURL` when `PUBLIC_BASE_URL` isn't a valid http(s) URL.
+var ErrNoPublicBaseURL = errors.New("PUBLIC_BASE_URL is not set to an http or https URL")
+
+// The function returns the absolute URL of `path` on this app under `PUBLIC_BASE_URL`, for example
+// "https://api.example.com". Links sent by email are built with it. The Host header of a request is
+// set by the client, so it is never used for them: anyone could have a genuine email point at their
+// own host.
+func PublicURL(path string) (string, error) {
+	base := strings.TrimSuffix(strings.TrimSpace(os.Getenv("PUBLIC_BASE_URL")), "/")
+
+	u, err := url.Parse(base)
+	if base == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", ErrNoPublicBaseURL
+	}
+	return base + path, nil
+}
+
+// The function returns the IP address of the client. `X-Forwarded-For` is only honoured when
+// `TRUST_PROXY_HEADERS` is true, since any client can set it.
+func ClientIP(r *http.Request) string {
+	if trust, _ := strconv.ParseBool(os.Getenv("TRUST_PROXY_HEADERS")); trust {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,150 @@
+package helpers
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	user_model "github.com/http-crud/api/models"
+	error_handler "github.com/http-crud/api/utils"
+	"golang.org/x/text/language"
+)
+
+// `DefaultGenders` are the values accepted for `User.Gender` when `USER_GENDER_OPTIONS` isn't set.
+var DefaultGenders = []string{"Male", "Female", "Transgender", "Prefer not to say"}
+
+// Limits of the optional profile fields.
+const (
+	MaxDisplayNameLength = 64
+	MaxBioLength         = 500
+	MaxUserAge           = 150
+)
+
+var (
+	usernamePattern = regexp.MustCompile(`^[a-z0-9_]{3,30}$`)
+	phonePattern    = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+)
+
+// The function returns the values accepted for `User.Gender`, the comma separated
+// `USER_GENDER_OPTIONS` or `DefaultGenders`.
+func Genders() []string {
+	if genders := EnvList("USER_GENDER_OPTIONS"); len(genders) > 0 {
+		return genders
+	}
+	return DefaultGenders
+}
+
+// The function returns the canonical form of a username: trimmed, without a leading "@" and in lower
+// case, so handles are unique regardless of case.
+func NormalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(username), "@"))
+}
+
+// The function checks the profile fields of a user with the registration rules and returns every
+// problem found, each naming the field it is about. The password is only checked when `withPassword`
+// is true, since it isn't part of a profile update.
+func ValidateUser(user *user_model.User, withPassword bool) []error_handler.NewError {
+	var capturedErrors []error_handler.NewError
+
+	if strings.TrimSpace(user.Name) == "" {
+		capturedErrors = append(capturedErrors, error_handler.NewError{Error: "name can't be empty", StatusCode: http.StatusPartialContent, Field: "name"})
+	}
+	if strings.TrimSpace(user.Email) == "" {
+		capturedErrors = append(capturedErrors, error_handler.NewError{Error: "email can't be empty", StatusCode: http.StatusPartialContent, Field: "email"})
+	}
+
+	if _, err := mail.ParseAddress(user.Email); err != nil {
+		capturedErrors = append(capturedErrors, error_handler.NewError{Error: err.Error(), StatusCode: http.StatusBadRequest, Field: "email"})
+	}
+
+	if !validGender(strings.TrimSpace(user.Gender)) {
+		capturedErrors = append(capturedErrors, error_handler.NewError{Error: fmt.Sprintf("gender must be one of %s", strings.Join(Genders(), ", ")), StatusCode: http.StatusPartialContent, Field: "gender"})
+	}
+
+	capturedErrors = append(capturedErrors, validateProfile(user)...)
+
+	if !withPassword {
+		return capturedErrors
+	}
+
+	hasNum, hasHupper, hasSpecial := VerifyPassword(user.Password)
+
+	if !hasNum || !hasHupper || !hasSpecial {
+		capturedErrors = append(capturedErrors, error_handler.NewError{Error: fmt.Sprintf("Password missing field. hasNum: %v, hasUpper: %v, hasSpecial: %v", hasNum, hasHupper, hasSpecial), Field: "password"})
+	}
+
+	if strings.TrimSpace(user.Password) != strings.TrimSpace(user.ConfirmPassword) {
+		capturedErrors = append(capturedErrors, error_handler.NewError{Error: "password & conform password is not matched", StatusCode: http.StatusPartialContent, Field: "confirmpassword"})
+	}
+	if strings.TrimSpace(user.Password) == "" {
+		capturedErrors = append(capturedErrors, error_handler.NewError{Error: "password can't be empty", StatusCode: http.StatusPartialContent, Field: "password"})
+	}
+
+	return capturedErrors
+}
+
+// The function checks the optional profile fields that are set. Each problem names its field.
+func validateProfile(user *user_model.User) []error_handler.NewError {
+	var capturedErrors []error_handler.NewError
+
+	invalid := func(field, message string) {
+		capturedErrors = append(capturedErrors, error_handler.NewError{Error: message, StatusCode: http.StatusBadRequest, Field: field})
+	}
+
+	if utf8.RuneCountInString(user.DisplayName) > MaxDisplayNameLength {
+		invalid("displayName", fmt.Sprintf("display name can't be longer than %d characters", MaxDisplayNameLength))
+	}
+
+	if user.Username != "" && !usernamePattern.MatchString(user.Username) {
+		invalid("username", "username must be 3 to 30 lower case letters, digits or underscores")
+	}
+
+	if user.Phone != "" && !phonePattern.MatchString(user.Phone) {
+		invalid("phone", "phone must be in E.164 format, e.g. +14155552671")
+	}
+
+	if user.Locale != "" {
+		if _, err := language.Parse(user.Locale); err != nil {
+			invalid("locale", "locale must be a BCP 47 language tag, e.g. en-US")
+		}
+	}
+
+	if user.Timezone != "" {
+		if _, err := time.LoadLocation(user.Timezone); err != nil || user.Timezone == "Local" {
+			invalid("timezone", "timezone must be an IANA time zone, e.g. Europe/Paris")
+		}
+	}
+
+	if user.DateOfBirth != "" {
+		dob, err := time.Parse("2006-01-02", user.DateOfBirth)
+		now := time.Now().UTC()
+
+		switch {
+		case err != nil:
+			invalid("dateOfBirth", "date of birth must be a YYYY-MM-DD date")
+		case dob.After(now):
+			invalid("dateOfBirth", "date of birth can't be in the future")
+		case dob.Before(now.AddDate(-MaxUserAge, 0, 0)):
+			invalid("dateOfBirth", fmt.Sprintf("date of birth can't be more than %d years ago", MaxUserAge))
+		}
+	}
+
+	if utf8.RuneCountInString(user.Bio) > MaxBioLength {
+		invalid("bio", fmt.Sprintf("bio can't be longer than %d characters", MaxBioLength))
+	}
+
+	return capturedErrors
+}
+
+func validGender(gender string) bool {
+	for _, g := range Genders() {
+		if g == gender {
+			return true
+		}
+	}
+	return false
+}
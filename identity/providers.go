@@ -0,0 +1,278 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// Kinds of identity providers.
+const (
+	ProviderTypeOIDC   = "oidc"
+	ProviderTypeGitHub = "github"
+)
+
+var ErrUnknownProvider = errors.New("unknown identity provider")
+
+// `Identity` is the account a user authenticated with at an external provider.
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// `Provider` is a configured external identity provider. OpenID Connect providers are discovered from
+// their issuer; GitHub isn't an OpenID Connect provider, so its user and verified emails are read from
+// its REST API.
+type Provider struct {
+	Name     string
+	Type     string
+	config   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	apiURL   string
+}
+
+var (
+	providersMu sync.Mutex
+	providers   = map[string]*Provider{}
+)
+
+// The function returns the provider configured under `name`. Providers are listed in `OAUTH_PROVIDERS`
+// (for example "google,github,corp") and each one is configured with:
+//   - OAUTH_<NAME>_CLIENT_ID and OAUTH_<NAME>_CLIENT_SECRET
+//   - OAUTH_<NAME>_TYPE: "oidc" or "github", defaults to "github" for the provider named github
+//   - OAUTH_<NAME>_ISSUER: issuer URL used for discovery, defaults to Google's for the provider named google
+//   - OAUTH_<NAME>_SCOPES: comma separated scopes, defaults to "openid,email,profile" (or "read:user,user:email")
+//   - OAUTH_<NAME>_BASE_URL and OAUTH_<NAME>_API_URL: for GitHub, the web and REST API URLs, default
+//     "https://github.com" and "https://api.github.com"; GitHub Enterprise uses "https://<host>" and
+//     "https://<host>/api/v3"
+//
+// `OAUTH_REDIRECT_URL` is the callback URL registered at every provider. OpenID Connect discovery runs
+// the first time a provider is used and is retried on the next use if it fails.
+func Lookup(ctx context.Context, name string) (*Provider, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	if !configured(name) {
+		return nil, ErrUnknownProvider
+	}
+
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if p, ok := providers[name]; ok {
+		return p, nil
+	}
+
+	p, err := newProvider(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	providers[name] = p
+	return p, nil
+}
+
+// The function returns the URL the user is redirected to. The PKCE challenge is derived from
+// `verifier` and the nonce is echoed back in the ID token.
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) string {
+	opts := []oauth2.AuthCodeOption{oauth2.S256ChallengeOption(verifier)}
+	if p.Type == ProviderTypeOIDC {
+		opts = append(opts, oidc.Nonce(nonce))
+	}
+	return p.config.AuthCodeURL(state, opts...)
+}
+
+// The function exchanges the authorization code for tokens and returns the identity they belong to.
+// For OpenID Connect the ID token signature, audience, expiry and nonce are verified.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Identity, error) {
+	token, err := p.config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("error occured while exchanging code %w", err)
+	}
+
+	if p.Type == ProviderTypeGitHub {
+		return p.githubIdentity(ctx, token)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("provider returned no id_token")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("error occured while verifying id_token %w", err)
+	}
+
+	if idToken.Nonce != nonce {
+		return nil, errors.New("id_token nonce mismatch")
+	}
+
+	var claims struct {
+		Email         string      `json:"email"`
+		EmailVerified interface{} `json:"email_verified"`
+		Name          string      `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	// Some providers send `email_verified` as a string.
+	verified := claims.EmailVerified == true || claims.EmailVerified == "true"
+
+	return &Identity{
+		Provider:      p.Name,
+		Subject:       idToken.Subject,
+		Email:         normalizeEmail(claims.Email),
+		EmailVerified: verified,
+		Name:          claims.Name,
+	}, nil
+}
+
+func (p *Provider) githubIdentity(ctx context.Context, token *oauth2.Token) (*Identity, error) {
+	client := p.config.Client(ctx, token)
+
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if err := getJSON(client, p.apiURL+"/user", &user); err != nil {
+		return nil, err
+	}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(client, p.apiURL+"/user/emails", &emails); err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		Provider: p.Name,
+		Subject:  fmt.Sprint(user.ID),
+		Name:     user.Name,
+	}
+	if identity.Name == "" {
+		identity.Name = user.Login
+	}
+	for _, e := range emails {
+		if e.Primary {
+			identity.Email = normalizeEmail(e.Email)
+			identity.EmailVerified = e.Verified
+		}
+	}
+	return identity, nil
+}
+
+// Providers don't agree on the case of an email, so it is compared in lower case.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func getJSON(client *http.Client, url string, v interface{}) error {
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v returned %v", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func configured(name string) bool {
+	for _, p := range strings.Split(os.Getenv("OAUTH_PROVIDERS"), ",") {
+		if strings.ToLower(strings.TrimSpace(p)) == name && name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func newProvider(ctx context.Context, name string) (*Provider, error) {
+	env := func(key string) string {
+		return strings.TrimSpace(os.Getenv("OAUTH_" + strings.ToUpper(name) + "_" + key))
+	}
+
+	p := &Provider{Name: name, Type: env("TYPE")}
+	if p.Type == "" {
+		p.Type = ProviderTypeOIDC
+		if name == "github" {
+			p.Type = ProviderTypeGitHub
+		}
+	}
+
+	p.config = &oauth2.Config{
+		ClientID:     env("CLIENT_ID"),
+		ClientSecret: env("CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OAUTH_REDIRECT_URL"),
+	}
+	if p.config.ClientID == "" {
+		return nil, fmt.Errorf("OAUTH_%v_CLIENT_ID is not set", strings.ToUpper(name))
+	}
+
+	var scopes []string
+	for _, s := range strings.Split(env("SCOPES"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			scopes = append(scopes, s)
+		}
+	}
+
+	switch p.Type {
+	case ProviderTypeGitHub:
+		p.config.Endpoint = github.Endpoint
+		if base := strings.TrimSuffix(env("BASE_URL"), "/"); base != "" {
+			p.config.Endpoint = oauth2.Endpoint{
+				AuthURL:  base + "/login/oauth/authorize",
+				TokenURL: base + "/login/oauth/access_token",
+			}
+		}
+		p.apiURL = strings.TrimSuffix(env("API_URL"), "/")
+		if p.apiURL == "" {
+			p.apiURL = "https://api.github.com"
+		}
+		if len(scopes) == 0 {
+			scopes = []string{"read:user", "user:email"}
+		}
+	case ProviderTypeOIDC:
+		issuer := env("ISSUER")
+		if issuer == "" && name == "google" {
+			issuer = "https://accounts.google.com"
+		}
+		if issuer == "" {
+			return nil, fmt.Errorf("OAUTH_%v_ISSUER is not set", strings.ToUpper(name))
+		}
+
+		// The provider keeps the context to refresh its signing keys later, so it must outlive the
+		// request that triggered discovery.
+		discovered, err := oidc.NewProvider(context.WithoutCancel(ctx), issuer)
+		if err != nil {
+			return nil, fmt.Errorf("error occured while discovering %v %w", issuer, err)
+		}
+		p.config.Endpoint = discovered.Endpoint()
+		p.verifier = discovered.Verifier(&oidc.Config{ClientID: p.config.ClientID})
+		if len(scopes) == 0 {
+			scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported provider type %v", p.Type)
+	}
+
+	p.config.Scopes = scopes
+	return p, nil
+}
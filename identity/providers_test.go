@@ -0,0 +1,343 @@
+package identity
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/oauth2"
+)
+
+const (
+	testClientID     = "test-client"
+	testClientSecret = "test-secret"
+	testRedirectURL  = "http://localhost/user/login/oauth/callback"
+)
+
+// `mockOIDC` is an OpenID Connect provider serving discovery, JWKS, authorize and token endpoints. The
+// authorize endpoint logs the user in right away and the token endpoint checks the PKCE verifier
+// against the challenge of the code, like a real provider.
+type mockOIDC struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]mockGrant
+
+	// `email` and `nonce` override what goes into the next ID tokens when set.
+	email string
+	nonce string
+}
+
+type mockGrant struct {
+	challenge string
+	nonce     string
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockOIDC{key: key, grants: map[string]mockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/jwks", m.jwks)
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockOIDC) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                m.URL,
+		"authorization_endpoint":                m.URL + "/authorize",
+		"token_endpoint":                        m.URL + "/token",
+		"jwks_uri":                              m.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (m *mockOIDC) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (m *mockOIDC) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != testClientID || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	code := randomCode()
+	m.mu.Lock()
+	m.grants[code] = mockGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	m.mu.Unlock()
+
+	redirect, _ := url.Parse(q.Get("redirect_uri"))
+	redirect.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (m *mockOIDC) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if id != testClientID || secret != testClientSecret {
+		tokenError(w, "invalid_client")
+		return
+	}
+
+	m.mu.Lock()
+	grant, ok := m.grants[r.PostFormValue("code")]
+	delete(m.grants, r.PostFormValue("code"))
+	email, nonce := m.email, m.nonce
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+	if email == "" {
+		email = "jane@example.com"
+	}
+	if nonce == "" {
+		nonce = grant.nonce
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            m.URL,
+		"aud":            testClientID,
+		"sub":            "subject-1",
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"nonce":          nonce,
+		"email":          email,
+		"email_verified": true,
+		"name":           "Jane",
+	})
+	idToken.Header["kid"] = "test"
+	signed, err := idToken.SignedString(m.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     signed,
+	})
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func randomCode() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// The function configures the provider `name` with the given settings and forgets the providers
+// looked up by earlier tests.
+func configureProvider(t *testing.T, name string, settings map[string]string) {
+	t.Helper()
+
+	t.Setenv("OAUTH_PROVIDERS", name)
+	t.Setenv("OAUTH_REDIRECT_URL", testRedirectURL)
+	prefix := "OAUTH_" + strings.ToUpper(name) + "_"
+	t.Setenv(prefix+"CLIENT_ID", testClientID)
+	t.Setenv(prefix+"CLIENT_SECRET", testClientSecret)
+	for key, value := range settings {
+		t.Setenv(prefix+key, value)
+	}
+
+	reset := func() {
+		providersMu.Lock()
+		providers = map[string]*Provider{}
+		providersMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// The function follows the authorization URL like a browser would and returns the query of the
+// callback the provider redirects to.
+func authorize(t *testing.T, authURL string) url.Values {
+	t.Helper()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %v", res.Status)
+	}
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), testRedirectURL) {
+		t.Fatalf("redirected to %v, want %v", location, testRedirectURL)
+	}
+	return location.Query()
+}
+
+func TestOIDCLogin(t *testing.T) {
+	mock := newMockOIDC(t)
+	mock.email = " Jane@Example.COM "
+	configureProvider(t, "mock", map[string]string{"ISSUER": mock.URL})
+	ctx := context.Background()
+
+	p, err := Lookup(ctx, "Mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, nonce, verifier := "state-1", "nonce-1", oauth2.GenerateVerifier()
+	callback := authorize(t, p.AuthCodeURL(state, nonce, verifier))
+
+	if got := callback.Get("state"); got != state {
+		t.Fatalf("state = %q, want %q", got, state)
+	}
+
+	ident, err := p.Exchange(ctx, callback.Get("code"), verifier, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Identity{Provider: "mock", Subject: "subject-1", Email: "jane@example.com", EmailVerified: true, Name: "Jane"}
+	if *ident != want {
+		t.Fatalf("identity = %+v, want %+v", *ident, want)
+	}
+}
+
+func TestOIDCLoginRejectsWrongVerifier(t *testing.T) {
+	mock := newMockOIDC(t)
+	configureProvider(t, "mock", map[string]string{"ISSUER": mock.URL})
+	ctx := context.Background()
+
+	p, err := Lookup(ctx, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callback := authorize(t, p.AuthCodeURL("state", "nonce", oauth2.GenerateVerifier()))
+
+	if _, err := p.Exchange(ctx, callback.Get("code"), oauth2.GenerateVerifier(), "nonce"); err == nil {
+		t.Fatal("exchange with another PKCE verifier succeeded")
+	}
+}
+
+func TestOIDCLoginRejectsNonceMismatch(t *testing.T) {
+	mock := newMockOIDC(t)
+	mock.nonce = "replayed-nonce"
+	configureProvider(t, "mock", map[string]string{"ISSUER": mock.URL})
+	ctx := context.Background()
+
+	p, err := Lookup(ctx, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := oauth2.GenerateVerifier()
+	callback := authorize(t, p.AuthCodeURL("state", "nonce", verifier))
+
+	_, err = p.Exchange(ctx, callback.Get("code"), verifier, "nonce")
+	if err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Fatalf("err = %v, want a nonce mismatch", err)
+	}
+}
+
+func TestGitHubEnterpriseLogin(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "gh-token", "token_type": "bearer"})
+	})
+	api := func(body interface{}) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer gh-token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(body)
+		}
+	}
+	mux.HandleFunc("/api/v3/user", api(map[string]interface{}{"id": 42, "login": "jane"}))
+	mux.HandleFunc("/api/v3/user/emails", api([]map[string]interface{}{
+		{"email": "old@example.com", "primary": false, "verified": true},
+		{"email": "Jane@Example.com", "primary": true, "verified": true},
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	configureProvider(t, "github", map[string]string{"BASE_URL": server.URL, "API_URL": server.URL + "/api/v3/"})
+	ctx := context.Background()
+
+	p, err := Lookup(ctx, "github")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if authURL := p.AuthCodeURL("state", "nonce", oauth2.GenerateVerifier()); !strings.HasPrefix(authURL, server.URL+"/login/oauth/authorize?") {
+		t.Fatalf("auth URL = %v, want the configured host", authURL)
+	}
+
+	ident, err := p.Exchange(ctx, "code", oauth2.GenerateVerifier(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Identity{Provider: "github", Subject: "42", Email: "jane@example.com", EmailVerified: true, Name: "jane"}
+	if *ident != want {
+		t.Fatalf("identity = %+v, want %+v", *ident, want)
+	}
+}
+
+func TestLookupUnknownProvider(t *testing.T) {
+	configureProvider(t, "mock", nil)
+
+	if _, err := Lookup(context.Background(), "other"); err != ErrUnknownProvider {
+		t.Fatalf("err = %v, want ErrUnknownProvider", err)
+	}
+}
@@ -0,0 +1,40 @@
+package identity
+
+import (
+	"os"
+	"sync"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/http-crud/api/helpers"
+)
+
+var (
+	webAuthnOnce sync.Once
+	webAuthn     *webauthn.WebAuthn
+	webAuthnErr  error
+)
+
+// The function returns the WebAuthn relying party configured with `WEBAUTHN_RP_ID` (the domain
+// passkeys are bound to), `WEBAUTHN_RP_NAME` and the comma separated `WEBAUTHN_RP_ORIGINS` the browser
+// ceremonies may come from.
+func WebAuthn() (*webauthn.WebAuthn, error) {
+	webAuthnOnce.Do(func() {
+		name := os.Getenv("WEBAUTHN_RP_NAME")
+		if name == "" {
+			name = "http-crud-api"
+		}
+
+		webAuthn, webAuthnErr = webauthn.New(&webauthn.Config{
+			RPID:          os.Getenv("WEBAUTHN_RP_ID"),
+			RPDisplayName: name,
+			RPOrigins:     helpers.EnvList("WEBAUTHN_RP_ORIGINS"),
+			// Passkeys are discoverable credentials, so logging in doesn't need the email first.
+			AuthenticatorSelection: protocol.AuthenticatorSelection{
+				ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+				UserVerification: protocol.VerificationPreferred,
+			},
+		})
+	})
+	return webAuthn, webAuthnErr
+}
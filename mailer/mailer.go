@@ -0,0 +1,114 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// `Message` is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// `Mailer` sends emails. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// `ErrNotConfigured` is returned by `Default` when no mailer is configured, or only one meant for
+// development outside of development mode.
+var ErrNotConfigured = errors.New("no mailer is configured")
+
+var (
+	defaultOnce   sync.Once
+	defaultMailer Mailer
+	defaultErr    error
+)
+
+// The function returns the mailer configured with `MAILER`:
+//   - "smtp" sends through `SMTP_ADDR` (host:port) with `SMTP_USERNAME`, `SMTP_PASSWORD` and
+//     `SMTP_FROM`.
+//   - "log" logs the emails. The login and email change links sent would end up in the logs, so it is
+//     only accepted when `MAILER_DEV_MODE` is true.
+//
+// Anything else fails with `ErrNotConfigured`, so no link is sent by accident where anyone who reads
+// the logs would get it. Another mailer is plugged in with `SetDefault`.
+func Default() (Mailer, error) {
+	defaultOnce.Do(func() {
+		devMode, _ := strconv.ParseBool(os.Getenv("MAILER_DEV_MODE"))
+
+		switch m := os.Getenv("MAILER"); {
+		case m == "smtp":
+			if os.Getenv("SMTP_ADDR") == "" {
+				defaultErr = fmt.Errorf("%w: SMTP_ADDR is not set", ErrNotConfigured)
+				return
+			}
+			defaultMailer = &SMTPMailer{
+				Addr:     os.Getenv("SMTP_ADDR"),
+				Username: os.Getenv("SMTP_USERNAME"),
+				Password: os.Getenv("SMTP_PASSWORD"),
+				From:     os.Getenv("SMTP_FROM"),
+			}
+		case m == "log" && !devMode:
+			defaultErr = fmt.Errorf("%w: MAILER=log needs MAILER_DEV_MODE=true", ErrNotConfigured)
+		case m == "log":
+			defaultMailer = LogMailer{}
+		default:
+			defaultErr = ErrNotConfigured
+		}
+	})
+	return defaultMailer, defaultErr
+}
+
+// The function replaces the mailer returned by `Default`.
+func SetDefault(m Mailer) {
+	defaultOnce.Do(func() {})
+	defaultMailer, defaultErr = m, nil
+}
+
+// `LogMailer` writes emails to the log instead of sending them.
+type LogMailer struct{}
+
+func (LogMailer) Send(_ context.Context, m Message) error {
+	log.Printf("mail to=%s subject=%q\n%s", m.To, m.Subject, m.Body)
+	return nil
+}
+
+// `SMTPMailer` sends emails through an SMTP server, authenticating with PLAIN auth when a username is
+// set.
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTPMailer) Send(_ context.Context, m Message) error {
+	if strings.ContainsAny(m.To, "\r\n") || strings.ContainsAny(m.Subject, "\r\n") {
+		return fmt.Errorf("invalid header value")
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		s.From, m.To, m.Subject, m.Body)
+
+	if err := smtp.SendMail(s.Addr, auth, s.From, []string{m.To}, []byte(body)); err != nil {
+		return fmt.Errorf("error occured while sending mail %w", err)
+	}
+	return nil
+}
@@ -1,10 +1,22 @@
 package main
 
 import (
+	"log"
+	"os"
+
 	configs "github.com/http-crud/api/configs"
 )
 
 func main() {
+	// A subcommand such as `promote-admin <email>`, which creates the first admin of a deployment, is run
+	// instead of the server. See `configs.RunCommand`.
+	if len(os.Args) > 1 {
+		if err := configs.RunCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// `configs.LoadEnvVarsAndStartApp()` is a function call that loads environment variables and starts
 	// the application. It is likely defined in the `configs` package and contains code to read
 	// environment variables from a configuration file or the system environment, and then initializes and
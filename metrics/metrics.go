@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// `Registry` is the Prometheus registry every collector of this service is registered on. It also
+// carries the Go runtime and process collectors so `/metrics` exposes GC, goroutine and memory stats.
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Total number of HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	loginAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_login_attempts_total",
+		Help: "Total number of login attempts by result.",
+	}, []string{"result"})
+
+	registrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_registrations_total",
+		Help: "Total number of user registrations by result.",
+	}, []string{"result"})
+
+	mongoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongo_operation_duration_seconds",
+		Help:    "MongoDB operation latency by collection, method and result.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"collection", "method", "result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		loginAttempts,
+		registrations,
+		mongoDuration,
+	)
+}
+
+// The function records the outcome of a login attempt. `success` is true when a token was issued.
+func ObserveLogin(success bool) {
+	loginAttempts.WithLabelValues(result(success)).Inc()
+}
+
+// The function records the outcome of a registration attempt. `success` is true when the user was
+// inserted.
+func ObserveRegistration(success bool) {
+	registrations.WithLabelValues(result(success)).Inc()
+}
+
+// The function starts timing a MongoDB operation and returns a function that records the latency once
+// the operation has finished. The returned function takes the error returned by the driver so failed
+// operations are labelled separately.
+//
+//	done := metrics.ObserveMongo("users", "FindOne")
+//	err := users.FindOne(ctx, filter).Decode(&user)
+//	done(err)
+func ObserveMongo(collection, method string) func(err error) {
+	start := time.Now()
+	return func(err error) {
+		mongoDuration.WithLabelValues(collection, method, result(err == nil)).Observe(time.Since(start).Seconds())
+	}
+}
+
+// The function wraps a handler and records the request count and latency for `route`. The route is
+// passed explicitly instead of using `r.URL.Path` so ids and other path values don't blow up the label
+// cardinality.
+func InstrumentHandler(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		status := strconv.Itoa(rec.status)
+		httpRequests.WithLabelValues(route, r.Method, status).Inc()
+		httpDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// `statusRecorder` captures the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func result(success bool) string {
+	if success {
+		return "success"
+	}
+	return "failure"
+}
@@ -0,0 +1,292 @@
+package user_middleware
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/http-crud/api/helpers"
+	user_model "github.com/http-crud/api/models"
+	user_services "github.com/http-crud/api/services"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// This middleware authenticates the request with the JWT or personal access token in the
+// `Authorization` header, or the access token cookie of a browser in cookie mode, and stores the
+// principal in the request context. Handlers act on the principal's own account unless an admin
+// route names another one.
+func AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		principal, e := authenticate(r)
+
+		if e != nil {
+			if e.StatusCode == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			writeError(w, *e)
+			return
+		}
+
+		serveAs(w, r, principal, next)
+	})
+}
+
+// This middleware only lets administrators through. The role is read from the database rather than
+// the token, so demoting an admin takes effect immediately. An admin acting as another user never has
+// admin rights. It must run after `AuthMiddleware`. The first admin of a deployment is created with
+// the `promote-admin` command.
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := helpers.PrincipalFromContext(r.Context())
+
+		if principal == nil {
+			writeError(w, error_handler.NewError{
+				Error:      "token not found",
+				StatusCode: http.StatusUnauthorized,
+			})
+			return
+		}
+
+		if principal.Impersonated() {
+			writeError(w, error_handler.NewError{
+				Error:      "admin role required",
+				StatusCode: http.StatusForbidden,
+			})
+			return
+		}
+
+		user, e := user_services.GetUserById(r.Context(), principal.UserID.Hex())
+
+		if e != nil {
+			writeError(w, *e)
+			return
+		}
+
+		if user.Role != user_model.RoleAdmin {
+			writeError(w, error_handler.NewError{
+				Error:      "admin role required",
+				StatusCode: http.StatusForbidden,
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// This middleware rejects principals that weren't granted `scope`. It must run after `AuthMiddleware`.
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := helpers.PrincipalFromContext(r.Context())
+
+		if principal == nil || !principal.HasScope(scope) {
+			writeError(w, error_handler.NewError{
+				Error:      fmt.Sprintf("token is missing the %v scope", scope),
+				StatusCode: http.StatusForbidden,
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// This middleware only lets principals authenticated with a JWT through. It protects the routes that
+// manage personal access tokens, so a token can't be used to mint more tokens.
+func DenyPersonalAccessTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := helpers.PrincipalFromContext(r.Context())
+
+		if principal == nil || principal.Method != helpers.AuthMethodJWT {
+			writeError(w, error_handler.NewError{
+				Error:      "this action can't be performed with a personal access token",
+				StatusCode: http.StatusForbidden,
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// This middleware passes each request to the handler of its method and rejects the other methods,
+// listing the allowed ones in the `Allow` header.
+func MethodHandlers(handlers map[string]http.Handler) http.Handler {
+	allowed := make([]string, 0, len(handlers))
+	for method := range handlers {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	allow := strings.Join(allowed, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next, ok := handlers[r.Method]
+
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Allow", allow)
+			writeError(w, error_handler.NewError{
+				Error:      fmt.Sprintf("invalid method: %v", r.Method),
+				StatusCode: http.StatusMethodNotAllowed,
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// This middleware rejects requests whose method isn't `method`.
+func MethodMiddleware(method string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Allow", method)
+			writeError(w, error_handler.NewError{
+				Error:      fmt.Sprintf("invalid method: %v", r.Method),
+				StatusCode: http.StatusMethodNotAllowed,
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The function authenticates the request from its `Authorization` header, falling back to the access
+// token cookie. Tokens starting with `user_services.PersonalAccessTokenPrefix` are looked up as personal
+// access tokens, anything else is verified as a JWT. Browsers send cookies with cross-site requests too,
+// so unsafe requests authenticated by cookie must also carry the session's CSRF token in the
+// `X-CSRF-Token` header.
+func authenticate(r *http.Request) (*helpers.Principal, *error_handler.NewError) {
+	authorization := r.Header.Get("Authorization")
+	fromCookie := false
+
+	var tokenString string
+
+	if strings.TrimSpace(authorization) != "" {
+		var ok bool
+		tokenString, ok = bearerToken(authorization)
+
+		if !ok {
+			return nil, &error_handler.NewError{
+				Error:      "malformed authorization header",
+				StatusCode: http.StatusUnauthorized,
+			}
+		}
+	} else if cookie, err := r.Cookie(helpers.AccessTokenCookie); err == nil && cookie.Value != "" {
+		tokenString = cookie.Value
+		fromCookie = true
+	} else {
+		return nil, &error_handler.NewError{
+			Error:      "token not found",
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	// Personal access tokens are for machine clients and are never set as cookies.
+	if !fromCookie && strings.HasPrefix(tokenString, user_services.PersonalAccessTokenPrefix) {
+		pat, e := user_services.AuthenticatePersonalAccessToken(r.Context(), tokenString, helpers.ClientIP(r))
+
+		if e != nil {
+			return nil, e
+		}
+
+		return &helpers.Principal{
+			UserID:  pat.UserID,
+			Method:  helpers.AuthMethodPAT,
+			TokenID: pat.ID.Hex(),
+			Scopes:  pat.Scopes,
+		}, nil
+	}
+
+	// This code is verifying the signature of the JWT token and validating its issuer, audience and
+	// lifetime.
+	claims, err := helpers.ParseJWT(tokenString)
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      "jwt not valid",
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	// Every access token belongs to a login session; revoking the session invalidates its tokens before
+	// they expire.
+	if claims.SessionID == "" {
+		return nil, &error_handler.NewError{
+			Error:      "jwt has no session",
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	session, e := user_services.AuthenticateSession(r.Context(), userID, claims.SessionID, helpers.ClientIP(r))
+
+	if e != nil {
+		return nil, e
+	}
+
+	// An impersonation token must belong to the session the admin opened, and only such tokens may
+	// use it.
+	var actorID *primitive.ObjectID
+
+	if claims.Actor != nil {
+		id, err := primitive.ObjectIDFromHex(claims.Actor.Subject)
+
+		if err != nil || session.ImpersonatorID == nil || *session.ImpersonatorID != id {
+			return nil, &error_handler.NewError{
+				Error:      "jwt not valid",
+				StatusCode: http.StatusUnauthorized,
+			}
+		}
+		actorID = &id
+	} else if session.ImpersonatorID != nil {
+		return nil, &error_handler.NewError{
+			Error:      "jwt not valid",
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	if fromCookie && !safeMethod(r.Method) && !user_services.SessionCSRFValid(session, r.Header.Get(helpers.CSRFHeader)) {
+		return nil, &error_handler.NewError{
+			Error:      "missing or invalid csrf token",
+			StatusCode: http.StatusForbidden,
+		}
+	}
+
+	return &helpers.Principal{
+		UserID:    userID,
+		Method:    helpers.AuthMethodJWT,
+		TokenID:   claims.ID,
+		SessionID: claims.SessionID,
+		ActorID:   actorID,
+	}, nil
+}
+
+// The function reports whether `method` is safe, i.e. doesn't change state and needs no CSRF token.
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// The function writes `e` with its status code as the HTTP status, e.g. 401 for a missing or malformed
+// `Authorization` header.
+func writeError(w http.ResponseWriter, e error_handler.NewError) {
+	error_handler.WriteError(w, &e)
+}
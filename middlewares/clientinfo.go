@@ -0,0 +1,30 @@
+package user_middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/http-crud/api/helpers"
+)
+
+// `DeviceNameHeader` lets clients name the device they log in from, e.g. "Alice's laptop".
+const DeviceNameHeader = "X-Device-Name"
+
+// This middleware stores the IP address, user agent and device name of the client in the request
+// context so the services can record them on the session created at login.
+func ClientInfoMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deviceName := strings.TrimSpace(r.Header.Get(DeviceNameHeader))
+		if len(deviceName) > 100 {
+			deviceName = deviceName[:100]
+		}
+
+		ctx := helpers.WithClientInfo(r.Context(), helpers.ClientInfo{
+			IP:         helpers.ClientIP(r),
+			UserAgent:  r.UserAgent(),
+			DeviceName: deviceName,
+		})
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
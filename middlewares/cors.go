@@ -0,0 +1,121 @@
+package user_middleware
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/http-crud/api/helpers"
+)
+
+// `CORSConfig` holds the cross-origin settings read from the environment by `LoadCORSConfig`.
+type CORSConfig struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           int
+}
+
+// The function reads the CORS settings from the environment. Lists are comma separated and an origin
+// of "*" allows every origin. It fails when "*" is combined with credentials, which would let any site
+// make requests with the user's cookies and read the responses.
+//   - CORS_ALLOWED_ORIGINS   (no default, CORS is disabled when empty)
+//   - CORS_ALLOWED_METHODS   (default GET, POST, PATCH, DELETE)
+//   - CORS_ALLOWED_HEADERS   (default Authorization, Content-Type, If-Match, If-None-Match,
+//     X-Request-ID, X-CSRF-Token, X-Auth-Mode, X-Device-Name)
+//   - CORS_EXPOSED_HEADERS   (default ETag, X-Request-ID, X-Impersonated-By)
+//   - CORS_ALLOW_CREDENTIALS (default false)
+//   - CORS_MAX_AGE           (preflight cache in seconds, default 600)
+func LoadCORSConfig() (CORSConfig, error) {
+	maxAge, err := strconv.Atoi(os.Getenv("CORS_MAX_AGE"))
+	if err != nil {
+		maxAge = 600
+	}
+	credentials, _ := strconv.ParseBool(os.Getenv("CORS_ALLOW_CREDENTIALS"))
+
+	config := CORSConfig{
+		AllowedOrigins:   envList("CORS_ALLOWED_ORIGINS", nil),
+		AllowedMethods:   envList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PATCH", "DELETE"}),
+		AllowedHeaders:   envList("CORS_ALLOWED_HEADERS", []string{"Authorization", "Content-Type", "If-Match", "If-None-Match", RequestIDHeader, helpers.CSRFHeader, helpers.AuthModeHeader, DeviceNameHeader}),
+		ExposedHeaders:   envList("CORS_EXPOSED_HEADERS", []string{"ETag", RequestIDHeader, ImpersonatedByHeader}),
+		AllowCredentials: credentials,
+		MaxAge:           maxAge,
+	}
+
+	if config.AllowCredentials && config.allowsAnyOrigin() {
+		return config, errors.New(`CORS_ALLOW_CREDENTIALS can't be true when CORS_ALLOWED_ORIGINS is "*", list the origins instead`)
+	}
+	return config, nil
+}
+
+func (c CORSConfig) allowsAnyOrigin() bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// This middleware answers CORS preflight requests and adds the CORS headers to actual requests from
+// allowed origins. It runs before the route middlewares, so preflight requests never reach them.
+// Requests from origins that are not allowed are passed on without CORS headers and the browser
+// blocks the response. Credentials are never allowed together with "*".
+func CORSMiddleware(config CORSConfig, next http.Handler) http.Handler {
+	allowAll := config.allowsAnyOrigin()
+	allowCredentials := config.AllowCredentials && !allowAll
+	origins := map[string]bool{}
+	for _, o := range config.AllowedOrigins {
+		origins[strings.ToLower(o)] = true
+	}
+	methods := strings.Join(config.AllowedMethods, ", ")
+	headers := strings.Join(config.AllowedHeaders, ", ")
+	exposed := strings.Join(config.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(config.MaxAge)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+
+		if origin == "" || !(allowAll || origins[strings.ToLower(origin)]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if allowAll {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if allowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			w.Header().Set("Access-Control-Max-Age", maxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if exposed != "" {
+			w.Header().Set("Access-Control-Expose-Headers", exposed)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The function returns the comma separated list in `key`, or `fallback` when it is empty.
+func envList(key string, fallback []string) []string {
+	if list := helpers.EnvList(key); len(list) > 0 {
+		return list
+	}
+	return fallback
+}
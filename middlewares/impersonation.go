@@ -0,0 +1,86 @@
+package user_middleware
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/http-crud/api/helpers"
+	user_model "github.com/http-crud/api/models"
+	user_services "github.com/http-crud/api/services"
+	error_handler "github.com/http-crud/api/utils"
+)
+
+// `ImpersonatedByHeader` is set on every response to a request made by an admin acting as a user. It
+// holds the admin's id.
+const ImpersonatedByHeader = "X-Impersonated-By"
+
+// The function passes the request on to `next` with the principal in its context. Requests of an admin
+// acting as a user are marked with `X-Impersonated-By` and recorded in the audit log with their
+// outcome.
+func serveAs(w http.ResponseWriter, r *http.Request, principal *helpers.Principal, next http.Handler) {
+	r = r.WithContext(helpers.WithPrincipal(r.Context(), principal))
+
+	if !principal.Impersonated() {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set(ImpersonatedByHeader, principal.ActorID.Hex())
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(rec, r)
+
+	recordImpersonation(r, principal, user_model.AuditImpersonatedRequest, rec.status)
+}
+
+// This middleware refuses sensitive operations, such as changing the password or deleting the account,
+// to an admin acting as the user. Refusals are recorded in the audit log. It must run after
+// `AuthMiddleware`.
+func DenyImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := helpers.PrincipalFromContext(r.Context())
+
+		if principal != nil && principal.Impersonated() {
+			recordImpersonation(r, principal, user_model.AuditImpersonationDenied, http.StatusForbidden)
+			writeError(w, error_handler.NewError{
+				Error:      "this action can't be performed while impersonating a user",
+				StatusCode: http.StatusForbidden,
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func recordImpersonation(r *http.Request, principal *helpers.Principal, action string, status int) {
+	e := user_services.RecordAuditEvent(r.Context(), user_model.AuditEvent{
+		Action:         action,
+		ActorID:        principal.ActorID,
+		UserID:         &principal.UserID,
+		ImpersonatorID: principal.ActorID,
+		SessionID:      principal.SessionID,
+		Method:         r.Method,
+		Path:           r.URL.Path,
+		Status:         status,
+	})
+
+	if e != nil {
+		log.Printf("request_id=%s failed to record impersonated request: %s", helpers.RequestIDFromContext(r.Context()), e.Error)
+	}
+}
+
+// `statusRecorder` remembers the status code written by the handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
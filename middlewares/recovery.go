@@ -0,0 +1,66 @@
+package user_middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+
+	"github.com/http-crud/api/helpers"
+	error_handler "github.com/http-crud/api/utils"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// Incoming request IDs are only reused when they are short and free of characters that could break
+// log lines.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// This middleware gives every request an ID. The ID from the `X-Request-ID` header is reused when it
+// is well formed, otherwise a random one is generated. It is stored in the request context and echoed
+// back in the response header.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+
+		if !validRequestID.MatchString(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(helpers.WithRequestID(r.Context(), id)))
+	})
+}
+
+// This middleware recovers from panics raised further down the chain. The panic value and the stack
+// trace are logged with the request ID, and the client only gets a generic 500 problem response.
+func RecoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			// `http.ErrAbortHandler` is used to abort a response on purpose and must reach the server.
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			requestID := helpers.RequestIDFromContext(r.Context())
+			log.Printf("request_id=%s panic: %v\n%s", requestID, rec, debug.Stack())
+
+			error_handler.WriteProblem(w, error_handler.Problem{
+				Status:    http.StatusInternalServerError,
+				Detail:    "an unexpected error occurred",
+				Instance:  r.URL.Path,
+				RequestID: requestID,
+			})
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
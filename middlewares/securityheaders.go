@@ -0,0 +1,40 @@
+package user_middleware
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// This middleware sets the security headers sent with every response. The HSTS max age is read from
+// `HSTS_MAX_AGE` in seconds (default two years) and the referrer policy from `REFERRER_POLICY`
+// (default "no-referrer").
+func SecurityHeadersMiddleware(next http.Handler) http.Handler {
+	maxAge, err := strconv.Atoi(os.Getenv("HSTS_MAX_AGE"))
+	if err != nil {
+		maxAge = 63072000
+	}
+	referrerPolicy := os.Getenv("REFERRER_POLICY")
+	if referrerPolicy == "" {
+		referrerPolicy = "no-referrer"
+	}
+	hsts := fmt.Sprintf("max-age=%d; includeSubDomains", maxAge)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", hsts)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", referrerPolicy)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// This middleware stops clients and proxies from caching responses of auth routes, which carry tokens
+// and credentials.
+func NoStoreMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+		next.ServeHTTP(w, r)
+	})
+}
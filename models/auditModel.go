@@ -0,0 +1,81 @@
+package user_model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditImpersonationStart  = "impersonation.start"
+	AuditImpersonatedRequest = "impersonation.request"
+	AuditImpersonationDenied = "impersonation.denied"
+	AuditUserRegistered      = "user.registered"
+	AuditUserLogin           = "user.login"
+	AuditUserLoginFailed     = "user.login_failed"
+	AuditUserUpdated         = "user.updated"
+	AuditUserPasswordChanged = "user.password_changed"
+	AuditEmailChangeStarted  = "user.email_change_started"
+	AuditEmailChanged        = "user.email_changed"
+	AuditEmailChangeReverted = "user.email_change_reverted"
+	AuditPhoneVerified       = "user.phone_verified"
+	AuditMFAEnabled          = "user.mfa_enabled"
+	AuditMFADisabled         = "user.mfa_disabled"
+	AuditUserRoleChanged     = "user.role_changed"
+	AuditUserDeleted         = "user.deleted"
+	AuditUserRestored        = "user.restored"
+	AuditUserPurged          = "user.purged"
+	AuditUserErased          = "user.erased"
+	AuditTokenRevoked        = "token.revoked"
+	AuditSessionRevoked      = "session.revoked"
+)
+
+// `AuditChange` is the value of a field before and after an update.
+type AuditChange struct {
+	Before interface{} `json:"before" bson:"before"`
+	After  interface{} `json:"after" bson:"after"`
+}
+
+// `AuditEvent` is an entry of the audit log. `ActorID` is who performed the action and `UserID` the
+// account it was performed on; `ImpersonatorID` is set when an admin acted as the user. `Email` names
+// the target when there is no user, e.g. a failed login for an unknown email, and `ResourceID` is the
+// token or session an action was about. Updates carry the changed fields in `Changes`.
+type AuditEvent struct {
+	ID             primitive.ObjectID     `json:"_id" bson:"_id"`
+	Action         string                 `json:"action" bson:"action"`
+	ActorID        *primitive.ObjectID    `json:"actorId,omitempty" bson:"actorId,omitempty"`
+	UserID         *primitive.ObjectID    `json:"userId,omitempty" bson:"userId,omitempty"`
+	ImpersonatorID *primitive.ObjectID    `json:"impersonatorId,omitempty" bson:"impersonatorId,omitempty"`
+	SessionID      string                 `json:"sessionId,omitempty" bson:"sessionId,omitempty"`
+	Method         string                 `json:"method,omitempty" bson:"method,omitempty"`
+	Path           string                 `json:"path,omitempty" bson:"path,omitempty"`
+	Status         int                    `json:"status,omitempty" bson:"status,omitempty"`
+	IP             string                 `json:"ip,omitempty" bson:"ip,omitempty"`
+	UserAgent      string                 `json:"userAgent,omitempty" bson:"userAgent,omitempty"`
+	RequestID      string                 `json:"requestId,omitempty" bson:"requestId,omitempty"`
+	Reason         string                 `json:"reason,omitempty" bson:"reason,omitempty"`
+	Email          string                 `json:"email,omitempty" bson:"email,omitempty"`
+	ResourceID     string                 `json:"resourceId,omitempty" bson:"resourceId,omitempty"`
+	Changes        map[string]AuditChange `json:"changes,omitempty" bson:"changes,omitempty"`
+	CreatedAt      time.Time              `json:"createdAt" bson:"createdAt"`
+}
+
+// `AuditQuery` selects audit events. `UserID` matches events where the user is the actor or the
+// target; `Before` is the id of the last event of the previous page.
+type AuditQuery struct {
+	UserID *primitive.ObjectID
+	Action string
+	From   *time.Time
+	To     *time.Time
+	Before *primitive.ObjectID
+	Limit  int64
+}
+
+// `ImpersonationResponse` carries the token an admin uses to act as another user.
+type ImpersonationResponse struct {
+	Accesstoken string             `json:"accesstoken"`
+	UserID      primitive.ObjectID `json:"userId"`
+	SessionID   string             `json:"session_id"`
+	ExpiresAt   time.Time          `json:"expiresAt"`
+}
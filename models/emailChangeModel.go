@@ -0,0 +1,31 @@
+package user_model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// `EmailChange` is a requested change of a user's email. It is applied once the link sent to the new
+// address is opened, and the link sent to the old address cancels or reverts it. Both tokens are only
+// stored as hashes; the confirmation token's hash is the document id.
+type EmailChange struct {
+	ID              string             `json:"-" bson:"_id"`
+	RevertTokenHash string             `json:"-" bson:"revertTokenHash"`
+	UserID          primitive.ObjectID `json:"-" bson:"userId"`
+	OldEmail        string             `json:"oldEmail" bson:"oldEmail"`
+	NewEmail        string             `json:"newEmail" bson:"newEmail"`
+	IP              string             `json:"ip" bson:"ip"`
+	ExpiresAt       time.Time          `json:"expiresAt" bson:"expiresAt"`
+	RevertExpiresAt time.Time          `json:"revertExpiresAt" bson:"revertExpiresAt"`
+	ConfirmedAt     *time.Time         `json:"confirmedAt,omitempty" bson:"confirmedAt,omitempty"`
+	RevertedAt      *time.Time         `json:"revertedAt,omitempty" bson:"revertedAt,omitempty"`
+	CreatedAt       time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// `EmailChangeLinks` are the pages the confirmation and revert links of an email change open. The
+// token is added to them as the `token` query parameter.
+type EmailChangeLinks struct {
+	ConfirmURL string
+	RevertURL  string
+}
@@ -0,0 +1,28 @@
+package user_model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// `ExternalIdentity` links an account at an external identity provider to a user.
+type ExternalIdentity struct {
+	ID          primitive.ObjectID `json:"_id" bson:"_id"`
+	UserID      primitive.ObjectID `json:"userId" bson:"userId"`
+	Provider    string             `json:"provider" bson:"provider"`
+	Subject     string             `json:"subject" bson:"subject"`
+	Email       string             `json:"email" bson:"email"`
+	LinkedAt    time.Time          `json:"linkedAt" bson:"linkedAt"`
+	LastLoginAt time.Time          `json:"lastLoginAt" bson:"lastLoginAt"`
+}
+
+// `OAuthLoginState` is stored between the redirect to the provider and the callback. The state value
+// itself is only stored as a hash, used as the document id.
+type OAuthLoginState struct {
+	ID        string    `bson:"_id"`
+	Provider  string    `bson:"provider"`
+	Nonce     string    `bson:"nonce"`
+	Verifier  string    `bson:"verifier"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
@@ -0,0 +1,33 @@
+package user_model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// `MagicLink` is a single-use login link sent by email. The token is only stored as a hash, used as the
+// document id.
+type MagicLink struct {
+	ID        string             `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	Email     string             `bson:"email"`
+	IP        string             `bson:"ip"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+	UsedAt    *time.Time         `bson:"usedAt,omitempty"`
+	CreatedAt time.Time          `bson:"createdAt"`
+}
+
+// `MagicLinkRequest` records that a login link was asked for, whether or not the email belongs to an
+// account, so the rate limits look the same for every email. It is deleted at `ExpiresAt`.
+type MagicLinkRequest struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Email     string             `bson:"email"`
+	IP        string             `bson:"ip"`
+	CreatedAt time.Time          `bson:"createdAt"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+}
+
+type MessageResponse struct {
+	Message string `json:"message"`
+}
@@ -0,0 +1,141 @@
+package user_model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Grant types supported by the authorization server.
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeRefreshToken      = "refresh_token"
+)
+
+// `OAuthClient` is an application registered to obtain tokens from this service. Public clients (such
+// as single page apps) have no secret and must use PKCE; only confidential clients may use the client
+// credentials grant.
+type OAuthClient struct {
+	ID           string             `json:"client_id" bson:"_id"`
+	SecretHash   string             `json:"-" bson:"secretHash,omitempty"`
+	Name         string             `json:"name" bson:"name"`
+	RedirectURIs []string           `json:"redirect_uris" bson:"redirectUris"`
+	GrantTypes   []string           `json:"grant_types" bson:"grantTypes"`
+	Scopes       []string           `json:"scopes" bson:"scopes"`
+	Confidential bool               `json:"confidential" bson:"confidential"`
+	CreatedBy    primitive.ObjectID `json:"created_by" bson:"createdBy"`
+	CreatedAt    time.Time          `json:"created_at" bson:"createdAt"`
+}
+
+type OAuthClientRegistrationResponse struct {
+	ClientSecret string `json:"client_secret,omitempty"`
+	OAuthClient
+}
+
+// `OAuthAuthorizationCode` is issued when a user approves a client. It is stored by hash and can be
+// exchanged once.
+type OAuthAuthorizationCode struct {
+	ID            string             `bson:"_id"`
+	ClientID      string             `bson:"clientId"`
+	UserID        primitive.ObjectID `bson:"userId"`
+	RedirectURI   string             `bson:"redirectUri"`
+	Scopes        []string           `bson:"scopes"`
+	CodeChallenge string             `bson:"codeChallenge"`
+	ExpiresAt     time.Time          `bson:"expiresAt"`
+}
+
+// Kinds of tokens issued by the authorization server.
+const (
+	OAuthTokenAccess  = "access_token"
+	OAuthTokenRefresh = "refresh_token"
+)
+
+// `OAuthToken` is an opaque access or refresh token, stored by hash. Tokens issued from the same
+// authorization share a `GrantID` so revoking a refresh token also revokes its access tokens.
+type OAuthToken struct {
+	ID        string              `bson:"_id"`
+	Kind      string              `bson:"kind"`
+	GrantID   string              `bson:"grantId"`
+	ClientID  string              `bson:"clientId"`
+	UserID    *primitive.ObjectID `bson:"userId,omitempty"`
+	Scopes    []string            `bson:"scopes"`
+	ExpiresAt time.Time           `bson:"expiresAt"`
+	RevokedAt *time.Time          `bson:"revokedAt,omitempty"`
+	CreatedAt time.Time           `bson:"createdAt"`
+}
+
+// `OAuthConsent` records the scopes a user approved for a client, so they aren't asked again.
+type OAuthConsent struct {
+	ID        string             `json:"-" bson:"_id"`
+	UserID    primitive.ObjectID `json:"user_id" bson:"userId"`
+	ClientID  string             `json:"client_id" bson:"clientId"`
+	Scopes    []string           `json:"scopes" bson:"scopes"`
+	GrantedAt time.Time          `json:"granted_at" bson:"grantedAt"`
+}
+
+// `OAuthAuthorizationRequest` is the validated `/oauth/authorize` request.
+type OAuthAuthorizationRequest struct {
+	ClientID            string
+	RedirectURI         string
+	Scopes              []string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// `OAuthConsentPrompt` is returned to the consent screen so it can ask the user to approve the client.
+type OAuthConsentPrompt struct {
+	ClientID        string   `json:"client_id"`
+	ClientName      string   `json:"client_name"`
+	RedirectURI     string   `json:"redirect_uri"`
+	Scopes          []string `json:"scopes"`
+	ConsentRequired bool     `json:"consent_required"`
+}
+
+// `OAuthAuthorizationResponse` tells the consent screen where to send the browser once the user made a
+// decision.
+type OAuthAuthorizationResponse struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+// `OAuthTokenResponse` is the RFC 6749 token endpoint response.
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// `OAuthIntrospectionResponse` is the RFC 7662 introspection response.
+type OAuthIntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+}
+
+// `OAuthError` is the RFC 6749 error response.
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	StatusCode  int    `json:"-"`
+}
+
+// `OAuthTokenRequest` is the RFC 6749 token endpoint request. The client credentials come from HTTP
+// Basic authentication or the form.
+type OAuthTokenRequest struct {
+	GrantType    string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	RefreshToken string
+	Scopes       []string
+	ClientID     string
+	ClientSecret string
+}
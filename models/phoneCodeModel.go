@@ -0,0 +1,29 @@
+package user_model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// What a phone code is sent for.
+const (
+	PhoneCodeVerify = "verify"
+	PhoneCodeMFA    = "mfa"
+)
+
+// `PhoneCode` is a one-time code sent by text message, either to verify the phone of a user or as the
+// second step of a login. The code is only stored as a hash, salted with the document id. A login
+// code also belongs to the MFA token given to the client, stored as a hash in `ChallengeHash`.
+type PhoneCode struct {
+	ID            primitive.ObjectID `json:"_id" bson:"_id"`
+	UserID        primitive.ObjectID `json:"-" bson:"userId"`
+	Purpose       string             `json:"purpose" bson:"purpose"`
+	Phone         string             `json:"phone" bson:"phone"`
+	CodeHash      string             `json:"-" bson:"codeHash"`
+	ChallengeHash string             `json:"-" bson:"challengeHash,omitempty"`
+	Attempts      int64              `json:"attempts" bson:"attempts"`
+	ExpiresAt     time.Time          `json:"expiresAt" bson:"expiresAt"`
+	UsedAt        *time.Time         `json:"usedAt,omitempty" bson:"usedAt,omitempty"`
+	CreatedAt     time.Time          `json:"createdAt" bson:"createdAt"`
+}
@@ -0,0 +1,43 @@
+package user_model
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// `UserDataExport` is everything stored about a user, as returned by "/user/me/export". Secrets such
+// as password, token and code hashes are left out.
+type UserDataExport struct {
+	ExportedAt           time.Time             `json:"exportedAt"`
+	Profile              *User                 `json:"profile"`
+	Sessions             []Session             `json:"sessions"`
+	AuditEvents          []AuditEvent          `json:"auditEvents"`
+	PersonalAccessTokens []PersonalAccessToken `json:"personalAccessTokens"`
+	OAuthConsents        []OAuthConsent        `json:"oauthConsents"`
+	WebAuthnCredentials  []WebAuthnCredential  `json:"webauthnCredentials"`
+	ExternalIdentities   []ExternalIdentity    `json:"externalIdentities"`
+	PhoneCodes           []PhoneCode           `json:"phoneCodes"`
+	EmailChanges         []EmailChange         `json:"emailChanges"`
+}
+
+// `DeletionReceiptClaims` are the claims of a signed deletion receipt. It has no expiry, so it is never
+// accepted as an access token, and can be verified with the keys at "/.well-known/jwks.json". It is
+// only issued when tokens are signed with an asymmetric key, since an HS256 receipt could only be
+// checked by the server that signed it.
+type DeletionReceiptClaims struct {
+	Erased map[string]int64 `json:"erased"`
+	jwt.RegisteredClaims
+}
+
+// `DeletionReceipt` is returned when a user erases their account. `Erased` counts the removed records
+// per collection and `Receipt` is the same information as a signed JWT the user can keep as proof. It
+// is left out when tokens are signed with `JWT_SECRET_KEY`.
+type DeletionReceipt struct {
+	ReceiptID string             `json:"receiptId"`
+	UserID    primitive.ObjectID `json:"userId"`
+	ErasedAt  time.Time          `json:"erasedAt"`
+	Erased    map[string]int64   `json:"erased"`
+	Receipt   string             `json:"receipt,omitempty"`
+}
@@ -0,0 +1,32 @@
+package user_model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// `Session` records a login on a device. Every access token carries the id of its session in the
+// `sid` claim, so revoking the session logs the device out. The session also holds the hash of its
+// refresh token, rotated on every refresh, and of the CSRF token checked in cookie mode.
+type Session struct {
+	ID         primitive.ObjectID `json:"_id" bson:"_id"`
+	UserID     primitive.ObjectID `json:"-" bson:"userId"`
+	DeviceName string             `json:"deviceName" bson:"deviceName"`
+	UserAgent  string             `json:"userAgent" bson:"userAgent"`
+	IP         string             `json:"ip" bson:"ip"`
+	LastSeenIP string             `json:"lastSeenIp,omitempty" bson:"lastSeenIp,omitempty"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	LastSeenAt time.Time          `json:"lastSeenAt" bson:"lastSeenAt"`
+	ExpiresAt  time.Time          `json:"expiresAt" bson:"expiresAt"`
+	RevokedAt  *time.Time         `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+
+	// `ImpersonatorID` is the admin who opened the session to act as the user.
+	ImpersonatorID *primitive.ObjectID `json:"impersonatorId,omitempty" bson:"impersonatorId,omitempty"`
+
+	RefreshTokenHash         string `json:"-" bson:"refreshTokenHash"`
+	PreviousRefreshTokenHash string `json:"-" bson:"previousRefreshTokenHash,omitempty"`
+	CSRFTokenHash            string `json:"-" bson:"csrfTokenHash"`
+
+	Current bool `json:"current" bson:"-"`
+}
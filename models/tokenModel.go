@@ -0,0 +1,37 @@
+package user_model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Scopes a personal access token can be granted.
+const (
+	ScopeUserRead   = "user:read"
+	ScopeUserWrite  = "user:write"
+	ScopeUserDelete = "user:delete"
+)
+
+var PersonalAccessTokenScopes = []string{ScopeUserRead, ScopeUserWrite, ScopeUserDelete}
+
+// `PersonalAccessToken` is a named token a user creates for scripts and other machine clients. Only the
+// SHA-256 hash of the token is stored; the token itself is returned once, when it is created.
+type PersonalAccessToken struct {
+	ID         primitive.ObjectID `json:"_id" bson:"_id"`
+	UserID     primitive.ObjectID `json:"userId" bson:"userId"`
+	Name       string             `json:"name" bson:"name"`
+	Scopes     []string           `json:"scopes" bson:"scopes"`
+	Prefix     string             `json:"prefix" bson:"prefix"`
+	Hash       string             `json:"-" bson:"hash"`
+	ExpiresAt  *time.Time         `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	LastUsedAt *time.Time         `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+	LastUsedIP string             `json:"lastUsedIp,omitempty" bson:"lastUsedIp,omitempty"`
+	RevokedAt  *time.Time         `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+type PersonalAccessTokenResponse struct {
+	Token string `json:"token"`
+	PersonalAccessToken
+}
@@ -7,23 +7,80 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// Roles a user can have. Users without a role are regular users.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type User struct {
 	ID              primitive.ObjectID `json:"_id" bson:"_id"`
 	Name            string             `json:"name"`
 	Email           string             `json:"email"`
 	Gender          string             `json:"gender"`
+	Role            string             `json:"role"`
 	Password        string             `json:"-"`
 	ConfirmPassword string             `json:"-"`
 	CreatedAt       time.Time
 	UpdatedAt       time.Time
+
+	// The profile fields below are optional and left out when empty. `Username` is a unique handle,
+	// stored in lower case. `DateOfBirth` is a "YYYY-MM-DD" date.
+	DisplayName string `json:"displayName,omitempty" bson:",omitempty"`
+	Username    string `json:"username,omitempty" bson:",omitempty"`
+	Phone       string `json:"phone,omitempty" bson:",omitempty"`
+	Locale      string `json:"locale,omitempty" bson:",omitempty"`
+	Timezone    string `json:"timezone,omitempty" bson:",omitempty"`
+	DateOfBirth string `json:"dateOfBirth,omitempty" bson:",omitempty"`
+	Bio         string `json:"bio,omitempty" bson:",omitempty"`
+
+	// `PendingEmail` is the new email the user asked for until they confirm it; `Email` is unchanged
+	// until then.
+	PendingEmail string `json:"pendingEmail,omitempty" bson:",omitempty"`
+
+	// `PhoneVerifiedAt` is set once the user proved they own `Phone` with a code sent to it. Only a
+	// verified phone can be used to log in or as the second step of a login, which `MFAEnabled` turns
+	// on. Changing the phone clears its verification.
+	PhoneVerifiedAt *time.Time `json:"phoneVerifiedAt,omitempty" bson:",omitempty"`
+	MFAEnabled      bool       `json:"mfaEnabled,omitempty" bson:",omitempty"`
+
+	// `AvatarURLs` maps each avatar size in pixels to the URL of the square JPEG image. The images of
+	// the avatar `AvatarID` are stored under "avatars/<user id>/<avatar id>/".
+	AvatarID   string            `json:"-" bson:",omitempty"`
+	AvatarURLs map[string]string `json:"avatarUrls,omitempty" bson:",omitempty"`
+
+	// `Version` is incremented by every change and is the user's ETag. Users stored before it was
+	// added are at version 0.
+	Version int64 `json:"version"`
+	// `DeletedAt` is set when the user deletes their account. The account can be restored until the
+	// grace period is over, then it is purged.
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:",omitempty"`
 }
 
+// `UserJWTSigningStruct` holds the claims of an access token. The user id is the `sub` claim and the
+// login session the token belongs to is the `sid` claim. Tokens an admin uses to act as the user carry
+// the admin in the `act` claim (RFC 8693).
 type UserJWTSigningStruct struct {
-	ID primitive.ObjectID
+	SessionID string      `json:"sid,omitempty"`
+	Actor     *ActorClaim `json:"act,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// `ActorClaim` identifies who is acting on behalf of the subject of a token.
+type ActorClaim struct {
+	Subject string `json:"sub"`
+}
+
+// `UserLoginResponse` is returned by every login. In cookie mode the tokens are sent as cookies
+// instead and left out of the body; `CSRFToken` is only set in cookie mode. When the user has
+// two-step verification on, the first step only returns `MFARequired` and the `MFAToken` to send
+// with the code texted to them.
 type UserLoginResponse struct {
-	Accesstoken string             `json:"accesstoken"`
-	ID          primitive.ObjectID `json:"_id" bson:"_id"`
+	Accesstoken  string             `json:"accesstoken,omitempty"`
+	RefreshToken string             `json:"refresh_token,omitempty"`
+	CSRFToken    string             `json:"csrf_token,omitempty"`
+	ID           primitive.ObjectID `json:"_id" bson:"_id"`
+	SessionID    string             `json:"session_id"`
+	MFARequired  bool               `json:"mfa_required,omitempty"`
+	MFAToken     string             `json:"mfa_token,omitempty"`
 }
@@ -0,0 +1,45 @@
+package user_model
+
+import (
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// `WebAuthnCredential` is a passkey or security key registered by a user. The sign count in
+// `Credential.Authenticator` is updated after every login to detect cloned authenticators; a credential
+// whose counter went backwards is listed with `CloneWarning` and can't log in any more.
+type WebAuthnCredential struct {
+	ID           primitive.ObjectID  `json:"_id" bson:"_id"`
+	UserID       primitive.ObjectID  `json:"userId" bson:"userId"`
+	Name         string              `json:"name" bson:"name"`
+	CredentialID []byte              `json:"credentialId" bson:"credentialId"`
+	Credential   webauthn.Credential `json:"-" bson:"credential"`
+	CreatedAt    time.Time           `json:"createdAt" bson:"createdAt"`
+	LastUsedAt   *time.Time          `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+	CloneWarning bool                `json:"cloneWarning" bson:"-"`
+}
+
+// Kinds of WebAuthn ceremonies.
+const (
+	WebAuthnRegistration   = "registration"
+	WebAuthnAuthentication = "authentication"
+)
+
+// `WebAuthnSession` holds the challenge of a ceremony between its begin and finish requests. It is
+// stored by the hash of the session id handed to the client and can be finished once.
+type WebAuthnSession struct {
+	ID        string               `bson:"_id"`
+	Ceremony  string               `bson:"ceremony"`
+	UserID    *primitive.ObjectID  `bson:"userId,omitempty"`
+	Data      webauthn.SessionData `bson:"data"`
+	ExpiresAt time.Time            `bson:"expiresAt"`
+}
+
+// `WebAuthnBeginResponse` carries the options passed to `navigator.credentials.create()` or `.get()`
+// and the session id to send back with the result.
+type WebAuthnBeginResponse struct {
+	SessionID string      `json:"session_id"`
+	Options   interface{} `json:"options"`
+}
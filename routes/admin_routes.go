@@ -0,0 +1,33 @@
+package user_routes
+
+import (
+	"net/http"
+
+	usercontroller "github.com/http-crud/api/controllers"
+	user_middleware "github.com/http-crud/api/middlewares"
+)
+
+func AdminRoutes(mux *http.ServeMux) {
+	// This line of code is registering a route for the "/admin/impersonate" endpoint on the provided
+	// `mux` ServeMux. Support admins get a short-lived token to act as a user and reproduce their issue.
+	// Every request made with it is recorded in the audit log.
+	// POST
+	mux.Handle("/admin/impersonate", instrument("/admin/impersonate", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.NoStoreMiddleware(user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(user_middleware.RequireAdmin(http.HandlerFunc(usercontroller.ImpersonateUserHandler)))))))))
+
+	// This line of code is registering a route for the "/admin/users/restore" endpoint on the provided
+	// `mux` ServeMux. It restores the deleted user in the `id` query parameter before it is purged.
+	// POST
+	mux.Handle("/admin/users/restore", instrument("/admin/users/restore", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(user_middleware.RequireAdmin(http.HandlerFunc(usercontroller.RestoreUserHandler))))))))
+
+	// This line of code is registering a route for the "/admin/users/role" endpoint on the provided
+	// `mux` ServeMux. It makes the user in the `id` form value a "user" or an "admin"; admins can't
+	// change their own role.
+	// POST
+	mux.Handle("/admin/users/role", instrument("/admin/users/role", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(user_middleware.RequireAdmin(http.HandlerFunc(usercontroller.SetUserRoleHandler))))))))
+
+	// This line of code is registering a route for the "/admin/audit" endpoint on the provided `mux`
+	// ServeMux. It lists the audit log of registrations, logins, profile and role changes, deletions and
+	// revocations, filtered by user, action and time range.
+	// GET
+	mux.Handle("/admin/audit", instrument("/admin/audit", user_middleware.MethodMiddleware(http.MethodGet, user_middleware.NoStoreMiddleware(user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(user_middleware.RequireAdmin(http.HandlerFunc(usercontroller.ListAuditEventsHandler)))))))))
+}
@@ -0,0 +1,33 @@
+package user_routes
+
+import (
+	"net/http"
+	"strings"
+
+	usercontroller "github.com/http-crud/api/controllers"
+	user_middleware "github.com/http-crud/api/middlewares"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/storage"
+)
+
+func AvatarRoutes(mux *http.ServeMux) {
+	// This line of code is registering a route for the "/user/me/avatar" endpoint on the provided `mux`
+	// ServeMux. POST uploads a JPEG, PNG, GIF or WebP image in the `avatar` field of a multipart form,
+	// which is re-encoded and resized to the avatar sizes; DELETE removes the avatar.
+	// POST, DELETE
+	mux.Handle("/user/me/avatar", instrument("/user/me/avatar", user_middleware.AuthMiddleware(user_middleware.RequireScope(user_model.ScopeUserWrite, user_middleware.MethodHandlers(map[string]http.Handler{
+		http.MethodPost:   http.HandlerFunc(usercontroller.UploadAvatarHandler),
+		http.MethodDelete: http.HandlerFunc(usercontroller.DeleteAvatarHandler),
+	})))))
+
+	// These lines of code are registering the route serving the blobs kept on the local disk, such as
+	// the avatar images, when the blob store is local and its URLs are paths of this app. Blobs in S3
+	// are downloaded from the bucket.
+	// GET
+	if store, err := storage.Default(); err == nil {
+		if local, ok := store.(*storage.LocalStore); ok && strings.HasPrefix(local.PublicURL, "/") {
+			route := local.PublicURL + "/"
+			mux.Handle(route, instrument(route, user_middleware.MethodMiddleware(http.MethodGet, local.Handler())))
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package user_routes
+
+import (
+	"net/http"
+
+	"github.com/http-crud/api/metrics"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func MetricsRoutes(mux *http.ServeMux) {
+	// This line of code is registering a route for the "/metrics" endpoint on the provided `mux`
+	// ServeMux. It exposes every collector registered on `metrics.Registry` in the Prometheus text
+	// format so the service can be scraped.
+	// GET
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,22 @@
+package user_routes
+
+import (
+	"net/http"
+
+	usercontroller "github.com/http-crud/api/controllers"
+	user_middleware "github.com/http-crud/api/middlewares"
+)
+
+func OAuthRoutes(mux *http.ServeMux) {
+	// This line of code is registering a route for the "/user/oauth/login" endpoint on the provided
+	// `mux` ServeMux. It redirects the browser to the identity provider named in the `provider` query
+	// parameter.
+	// GET
+	mux.Handle("/user/oauth/login", instrument("/user/oauth/login", user_middleware.MethodMiddleware(http.MethodGet, http.HandlerFunc(usercontroller.OAuthLoginHandler))))
+
+	// This line of code is registering a route for the "/user/oauth/callback" endpoint on the provided
+	// `mux` ServeMux. The identity provider redirects back to it; it logs the user in and returns the
+	// access token. `NoStoreMiddleware` keeps the token in the response out of caches.
+	// GET
+	mux.Handle("/user/oauth/callback", instrument("/user/oauth/callback", user_middleware.MethodMiddleware(http.MethodGet, user_middleware.NoStoreMiddleware(http.HandlerFunc(usercontroller.OAuthCallbackHandler)))))
+}
@@ -0,0 +1,38 @@
+package user_routes
+
+import (
+	"net/http"
+
+	usercontroller "github.com/http-crud/api/controllers"
+	user_middleware "github.com/http-crud/api/middlewares"
+)
+
+func OAuthServerRoutes(mux *http.ServeMux) {
+	// This line of code is registering a route for the "/oauth/clients" endpoint on the provided `mux`
+	// ServeMux. Administrators register the applications allowed to obtain tokens from this service.
+	// POST
+	mux.Handle("/oauth/clients", instrument("/oauth/clients", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.NoStoreMiddleware(user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.RequireAdmin(http.HandlerFunc(usercontroller.RegisterOAuthClientHandler))))))))
+
+	// This line of code is registering a route for the "/oauth/authorize" endpoint on the provided `mux`
+	// ServeMux. It is the API of the consent screen: GET describes the authorization request and POST
+	// records the user's decision. The user must be logged in, so a password alone can't grant an
+	// application access to an account with two-step login on.
+	// GET, POST
+	mux.Handle("/oauth/authorize", instrument("/oauth/authorize", user_middleware.NoStoreMiddleware(user_middleware.AuthMiddleware(http.HandlerFunc(usercontroller.OAuthAuthorizeHandler)))))
+
+	// This line of code is registering a route for the "/oauth/token" endpoint on the provided `mux`
+	// ServeMux. Clients exchange authorization codes, refresh tokens and their own credentials for
+	// access tokens.
+	// POST
+	mux.Handle("/oauth/token", instrument("/oauth/token", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.NoStoreMiddleware(http.HandlerFunc(usercontroller.OAuthTokenHandler)))))
+
+	// This line of code is registering a route for the "/oauth/introspect" endpoint on the provided
+	// `mux` ServeMux. Resource servers check whether a token is active and what it grants.
+	// POST
+	mux.Handle("/oauth/introspect", instrument("/oauth/introspect", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.NoStoreMiddleware(http.HandlerFunc(usercontroller.OAuthIntrospectHandler)))))
+
+	// This line of code is registering a route for the "/oauth/revoke" endpoint on the provided `mux`
+	// ServeMux. Clients revoke access and refresh tokens they no longer need.
+	// POST
+	mux.Handle("/oauth/revoke", instrument("/oauth/revoke", user_middleware.MethodMiddleware(http.MethodPost, http.HandlerFunc(usercontroller.OAuthRevokeHandler))))
+}
@@ -0,0 +1,33 @@
+package user_routes
+
+import (
+	"net/http"
+
+	usercontroller "github.com/http-crud/api/controllers"
+	user_middleware "github.com/http-crud/api/middlewares"
+	user_model "github.com/http-crud/api/models"
+)
+
+func PhoneRoutes(mux *http.ServeMux) {
+	// These lines of code are registering the routes verifying the phone of the logged in user, which is
+	// set with the profile fields at "/user/me". "/user/me/phone/verify" texts a code to the phone and
+	// "/user/me/phone/confirm" checks the `code` form value. A verified phone can be used instead of the
+	// email to log in.
+	// POST
+	mux.Handle("/user/me/phone/verify", instrument("/user/me/phone/verify", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.AuthMiddleware(user_middleware.RequireScope(user_model.ScopeUserWrite, http.HandlerFunc(usercontroller.SendPhoneVerificationHandler))))))
+	// POST
+	mux.Handle("/user/me/phone/confirm", instrument("/user/me/phone/confirm", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.AuthMiddleware(user_middleware.RequireScope(user_model.ScopeUserWrite, http.HandlerFunc(usercontroller.ConfirmPhoneHandler))))))
+
+	// This line of code is registering a route for the "/user/me/mfa" endpoint on the provided `mux`
+	// ServeMux. It turns the two-step login of the logged in user on or off; once on, logins other than
+	// passkeys text a code to the verified phone. Neither a personal access token nor an admin acting as
+	// the user can change it.
+	// POST
+	mux.Handle("/user/me/mfa", instrument("/user/me/mfa", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(http.HandlerFunc(usercontroller.SetMFAHandler)))))))
+
+	// This line of code is registering a route for the "/user/login/mfa" endpoint on the provided `mux`
+	// ServeMux. It completes a login that answered with `mfa_required`, exchanging the `mfa_token` and
+	// the texted `code` for the tokens. `NoStoreMiddleware` keeps the tokens out of caches.
+	// POST
+	mux.Handle("/user/login/mfa", instrument("/user/login/mfa", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.NoStoreMiddleware(http.HandlerFunc(usercontroller.MFALoginHandler)))))
+}
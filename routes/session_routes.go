@@ -0,0 +1,32 @@
+package user_routes
+
+import (
+	"net/http"
+
+	usercontroller "github.com/http-crud/api/controllers"
+	user_middleware "github.com/http-crud/api/middlewares"
+)
+
+func SessionRoutes(mux *http.ServeMux) {
+	// This line of code is registering a route for the "/user/sessions" endpoint on the provided `mux`
+	// ServeMux. It lists the devices the logged in user is logged in on. Sessions belong to logins, so
+	// personal access tokens can't see or revoke them.
+	// GET
+	mux.Handle("/user/sessions", instrument("/user/sessions", user_middleware.MethodMiddleware(http.MethodGet, user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(http.HandlerFunc(usercontroller.ListSessionsHandler))))))
+
+	// This line of code is registering a route for the "/user/sessions/revoke" endpoint on the provided
+	// `mux` ServeMux. It revokes the session given in the `session_id` query parameter.
+	// DELETE
+	mux.Handle("/user/sessions/revoke", instrument("/user/sessions/revoke", user_middleware.MethodMiddleware(http.MethodDelete, user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(http.HandlerFunc(usercontroller.RevokeSessionHandler)))))))
+
+	// This line of code is registering a route for the "/user/token/refresh" endpoint on the provided
+	// `mux` ServeMux. It exchanges the refresh token of a session for a new access token. The refresh
+	// token is rotated every time, so `NoStoreMiddleware` keeps the response out of caches.
+	// POST
+	mux.Handle("/user/token/refresh", instrument("/user/token/refresh", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.NoStoreMiddleware(http.HandlerFunc(usercontroller.RefreshTokenHandler)))))
+
+	// This line of code is registering a route for the "/user/logout" endpoint on the provided `mux`
+	// ServeMux. It revokes the session of the request and clears the auth cookies.
+	// POST
+	mux.Handle("/user/logout", instrument("/user/logout", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(http.HandlerFunc(usercontroller.LogoutHandler))))))
+}
@@ -0,0 +1,28 @@
+package user_routes
+
+import (
+	"net/http"
+
+	usercontroller "github.com/http-crud/api/controllers"
+	user_middleware "github.com/http-crud/api/middlewares"
+)
+
+func TokenRoutes(mux *http.ServeMux) {
+	// This line of code is registering a route for the "/user/tokens" endpoint on the provided `mux`
+	// ServeMux. It lists the personal access tokens of the logged in user. `DenyPersonalAccessTokens`
+	// makes sure tokens are only managed by a user who logged in, never by another token.
+	// GET
+	mux.Handle("/user/tokens", instrument("/user/tokens", user_middleware.MethodMiddleware(http.MethodGet, user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(http.HandlerFunc(usercontroller.ListPersonalAccessTokensHandler))))))
+
+	// This line of code is registering a route for the "/user/tokens/create" endpoint on the provided
+	// `mux` ServeMux. It creates a personal access token and returns it once; only its hash is stored.
+	// `NoStoreMiddleware` keeps the token in the response out of caches, and `DenyImpersonation` stops
+	// an admin acting as the user from minting tokens that outlive the impersonation.
+	// POST
+	mux.Handle("/user/tokens/create", instrument("/user/tokens/create", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.NoStoreMiddleware(user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(http.HandlerFunc(usercontroller.CreatePersonalAccessTokenHandler))))))))
+
+	// This line of code is registering a route for the "/user/tokens/revoke" endpoint on the provided
+	// `mux` ServeMux. It revokes the personal access token given in the `token_id` query parameter.
+	// DELETE
+	mux.Handle("/user/tokens/revoke", instrument("/user/tokens/revoke", user_middleware.MethodMiddleware(http.MethodDelete, user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(http.HandlerFunc(usercontroller.RevokePersonalAccessTokenHandler)))))))
+}
@@ -4,17 +4,24 @@ import (
 	"net/http"
 
 	usercontroller "github.com/http-crud/api/controllers"
+	"github.com/http-crud/api/metrics"
 	user_middleware "github.com/http-crud/api/middlewares"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/tracing"
 )
 
 func UserRoutes(mux *http.ServeMux) {
+	// Every route is wrapped in `instrument` so each request gets a server span and its count and
+	// latency are recorded per route and status. The routes that act on an existing user accept a JWT
+	// or a personal access token; `RequireScope` checks the token was granted the scope of the route.
 	// This line of code is registering a route for the "/user/register" endpoint on the provided `mux`
 	// ServeMux. It is also adding middleware to the route using `user_middleware.RegisterUserMiddleware`
 	// and specifying the handler function for the route as `usercontroller.RegisterUserHandler`. This
 	// means that when a request is made to the "/user/register" endpoint, it will first go through the
-	// middleware before being handled by the `RegisterUserHandler` function.
+	// middleware before being handled by the `RegisterUserHandler` function. `NoStoreMiddleware` keeps
+	// the response out of caches.
 	// POST
-	mux.Handle("/user/register", user_middleware.RegisterUserMiddleware(http.HandlerFunc(usercontroller.RegisterUserHandler)))
+	mux.Handle("/user/register", instrument("/user/register", user_middleware.NoStoreMiddleware(user_middleware.RegisterUserMiddleware(http.HandlerFunc(usercontroller.RegisterUserHandler)))))
 
 	// This line of code is registering a route for the "/user/login" endpoint on the provided `mux`
 	// ServeMux. It is also adding middleware to the route using `user_middleware.LoginUserMiddleware` and
@@ -22,34 +29,78 @@ func UserRoutes(mux *http.ServeMux) {
 	// when a request is made to the "/user/login" endpoint, it will first go through the middleware before
 	// being handled by the `LoginUserHandler` function. The middleware is responsible for performing any
 	// necessary checks or operations before the request is handled by the handler function.
+	// `NoStoreMiddleware` keeps the token in the response out of caches. A verified `phone` can be sent
+	// instead of the `email`, and a user with two-step login on finishes at "/user/login/mfa".
 	// POST
-	mux.Handle("/user/login", user_middleware.LoginUserMiddleware(http.HandlerFunc(usercontroller.LoginUserHandler)))
-
-	// This line of code is registering a route for the "/user/" endpoint on the provided `mux` ServeMux.
-	// It is also adding middleware to the route using `user_middleware.GetUserMiddleware` and specifying
-	// the handler function for the route as `usercontroller.GetUserHandler`. This means that when a
-	// request is made to the "/user/" endpoint, it will first go through the middleware before being
-	// handled by the `GetUserHandler` function. The middleware is responsible for performing any necessary
-	// checks or operations before the request is handled by the handler function.
+	mux.Handle("/user/login", instrument("/user/login", user_middleware.NoStoreMiddleware(user_middleware.LoginUserMiddleware(http.HandlerFunc(usercontroller.LoginUserHandler)))))
+
+	// These lines of code are registering the routes for passwordless login. "/user/login/magic" emails
+	// a single-use login link and "/user/login/magic/callback" exchanges it for an access token.
+	// `NoStoreMiddleware` keeps the token in the callback response out of caches.
+	// POST
+	mux.Handle("/user/login/magic", instrument("/user/login/magic", user_middleware.MethodMiddleware(http.MethodPost, http.HandlerFunc(usercontroller.RequestMagicLinkHandler))))
+	// GET
+	mux.Handle("/user/login/magic/callback", instrument("/user/login/magic/callback", user_middleware.MethodMiddleware(http.MethodGet, user_middleware.NoStoreMiddleware(http.HandlerFunc(usercontroller.MagicLinkCallbackHandler)))))
+
+	// These lines of code are registering the routes opened from the emails of an email change.
+	// "/user/email/confirm" applies the new email with the link sent to it and "/user/email/revert"
+	// cancels or reverts the change with the link sent to the old address, logging the user out
+	// everywhere.
+	// GET
+	mux.Handle("/user/email/confirm", instrument("/user/email/confirm", user_middleware.MethodMiddleware(http.MethodGet, user_middleware.NoStoreMiddleware(http.HandlerFunc(usercontroller.ConfirmEmailChangeHandler)))))
 	// GET
-	mux.Handle("/user/", user_middleware.GetUserMiddleware(http.HandlerFunc(usercontroller.GetUserHandler)))
-
-	// This line of code is registering a route for the "/user/update" endpoint on the provided `mux`
-	// ServeMux. It is also adding middleware to the route using `user_middleware.GetUserMiddleware` and
-	// specifying the handler function for the route as `usercontroller.UpdateUserHandler`. This means
-	// that when a request is made to the "/user/update" endpoint, it will first go through the middleware
-	// before being handled by the `UpdateUserHandler` function. The middleware is responsible for
-	// performing any necessary checks or operations before the request is handled by the handler
-	// function.
+	mux.Handle("/user/email/revert", instrument("/user/email/revert", user_middleware.MethodMiddleware(http.MethodGet, user_middleware.NoStoreMiddleware(http.HandlerFunc(usercontroller.RevertEmailChangeHandler)))))
+
+	// This line of code is registering a route for the "/user/restore" endpoint on the provided `mux`
+	// ServeMux. A user whose account was deleted can restore it with their email and password until it
+	// is purged; they are logged in like at "/user/login".
+	// POST
+	mux.Handle("/user/restore", instrument("/user/restore", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.NoStoreMiddleware(user_middleware.LoginUserMiddleware(http.HandlerFunc(usercontroller.RestoreAccountHandler))))))
+
+	// This line of code is registering a route for the "/user/password" endpoint on the provided `mux`
+	// ServeMux. It changes the password of the logged in user, who must give the current one. Neither a
+	// personal access token nor an admin acting as the user can change it.
+	// POST
+	mux.Handle("/user/password", instrument("/user/password", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.NoStoreMiddleware(user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(http.HandlerFunc(usercontroller.ChangePasswordHandler))))))))
+
+	// These lines of code are registering the data protection routes. "/user/me/export" downloads
+	// everything stored about the logged in user as JSON or, with `format=zip`, as a ZIP archive.
+	// "/user/me/erase" erases the account right away and returns a deletion receipt, signed when tokens
+	// are signed with an asymmetric key. Neither a personal access token nor an admin acting as the user
+	// can use them.
+	// GET
+	mux.Handle("/user/me/export", instrument("/user/me/export", user_middleware.MethodMiddleware(http.MethodGet, user_middleware.NoStoreMiddleware(user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(http.HandlerFunc(usercontroller.ExportUserDataHandler))))))))
+	// POST
+	mux.Handle("/user/me/erase", instrument("/user/me/erase", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.NoStoreMiddleware(user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(http.HandlerFunc(usercontroller.EraseUserHandler))))))))
+
+	// This line of code is registering a route for the "/user/me" endpoint on the provided `mux`
+	// ServeMux. The account is the one of the token, so clients don't send their id. GET returns the
+	// user, PATCH applies a JSON Merge Patch (`application/merge-patch+json`) or a JSON Patch
+	// (`application/json-patch+json`), where a new email is pending until confirmed, and DELETE marks
+	// the account as deleted; it can be restored until it is purged. PATCH and DELETE need the
+	// `If-Match` header, and an admin acting as the user can't delete the account.
+	// GET, PATCH, DELETE
+	mux.Handle("/user/me", instrument("/user/me", user_middleware.AuthMiddleware(user_middleware.MethodHandlers(map[string]http.Handler{
+		http.MethodGet:    user_middleware.RequireScope(user_model.ScopeUserRead, http.HandlerFunc(usercontroller.GetMeHandler)),
+		http.MethodPatch:  user_middleware.RequireScope(user_model.ScopeUserWrite, http.HandlerFunc(usercontroller.UpdateMeHandler)),
+		http.MethodDelete: user_middleware.RequireScope(user_model.ScopeUserDelete, user_middleware.DenyImpersonation(http.HandlerFunc(usercontroller.DeleteMeHandler))),
+	}))))
+
+	// These lines of code are registering the routes that act on the user in the `id` query parameter.
+	// They are for admins only; users manage their own account at "/user/me". "/user/" returns the user,
+	// "/user/update" applies a patch like PATCH "/user/me" and "/user/delete" deletes the user.
+	// Like the "/admin/" routes, they can't be used with a personal access token or by an admin acting
+	// as a user.
+	// GET
+	mux.Handle("/user/", instrument("/user/", user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(user_middleware.RequireAdmin(http.HandlerFunc(usercontroller.GetUserHandler)))))))
 	// PATCH
-	mux.Handle("/user/update", user_middleware.GetUserMiddleware(http.HandlerFunc(usercontroller.UpdateUserHandler)))
-
-	// This line of code is registering a route for the "/user/delete" endpoint on the provided `mux`
-	// ServeMux. It is also adding middleware to the route using `user_middleware.GetUserMiddleware` and
-	// specifying the handler function for the route as `usercontroller.DeletUserHandler`. This means that
-	// when a request is made to the "/user/delete" endpoint, it will first go through the middleware
-	// before being handled by the `DeletUserHandler` function. The middleware is responsible for
-	// performing any necessary checks or operations before the request is handled by the handler function.
+	mux.Handle("/user/update", instrument("/user/update", user_middleware.MethodMiddleware(http.MethodPatch, user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(user_middleware.RequireAdmin(http.HandlerFunc(usercontroller.UpdateUserHandler))))))))
 	// DELETE
-	mux.Handle("/user/delete", user_middleware.GetUserMiddleware(http.HandlerFunc(usercontroller.DeletUserHandler)))
+	mux.Handle("/user/delete", instrument("/user/delete", user_middleware.MethodMiddleware(http.MethodDelete, user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(user_middleware.RequireAdmin(http.HandlerFunc(usercontroller.DeletUserHandler))))))))
+}
+
+// The function wraps a route handler with the tracing and metrics middlewares. Tracing is the outer
+// one so the server span also covers the time spent recording metrics.
+func instrument(route string, next http.Handler) http.Handler {
+	return tracing.Middleware(route, metrics.InstrumentHandler(route, next))
 }
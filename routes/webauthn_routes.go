@@ -0,0 +1,42 @@
+package user_routes
+
+import (
+	"net/http"
+
+	usercontroller "github.com/http-crud/api/controllers"
+	user_middleware "github.com/http-crud/api/middlewares"
+)
+
+func WebAuthnRoutes(mux *http.ServeMux) {
+	// This line of code is registering a route for the "/user/webauthn/register/begin" endpoint on the
+	// provided `mux` ServeMux. It starts registering a passkey for the logged in user. Like personal
+	// access tokens, passkeys can only be managed by a user who logged in, never by a token.
+	// POST
+	mux.Handle("/user/webauthn/register/begin", instrument("/user/webauthn/register/begin", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(http.HandlerFunc(usercontroller.BeginWebAuthnRegistrationHandler)))))))
+
+	// This line of code is registering a route for the "/user/webauthn/register/finish" endpoint on the
+	// provided `mux` ServeMux. It verifies the attestation from the authenticator and stores the passkey.
+	// POST
+	mux.Handle("/user/webauthn/register/finish", instrument("/user/webauthn/register/finish", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(http.HandlerFunc(usercontroller.FinishWebAuthnRegistrationHandler)))))))
+
+	// This line of code is registering a route for the "/user/webauthn/login/begin" endpoint on the
+	// provided `mux` ServeMux. It returns the challenge for a passkey login.
+	// POST
+	mux.Handle("/user/webauthn/login/begin", instrument("/user/webauthn/login/begin", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.NoStoreMiddleware(http.HandlerFunc(usercontroller.BeginWebAuthnLoginHandler)))))
+
+	// This line of code is registering a route for the "/user/webauthn/login/finish" endpoint on the
+	// provided `mux` ServeMux. It verifies the assertion and logs the user in. `NoStoreMiddleware` keeps
+	// the token in the response out of caches.
+	// POST
+	mux.Handle("/user/webauthn/login/finish", instrument("/user/webauthn/login/finish", user_middleware.MethodMiddleware(http.MethodPost, user_middleware.NoStoreMiddleware(http.HandlerFunc(usercontroller.FinishWebAuthnLoginHandler)))))
+
+	// This line of code is registering a route for the "/user/webauthn/credentials" endpoint on the
+	// provided `mux` ServeMux. It lists the passkeys of the logged in user.
+	// GET
+	mux.Handle("/user/webauthn/credentials", instrument("/user/webauthn/credentials", user_middleware.MethodMiddleware(http.MethodGet, user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(http.HandlerFunc(usercontroller.ListWebAuthnCredentialsHandler))))))
+
+	// This line of code is registering a route for the "/user/webauthn/credentials/delete" endpoint on
+	// the provided `mux` ServeMux. It removes the passkey given in the `credential_id` query parameter.
+	// DELETE
+	mux.Handle("/user/webauthn/credentials/delete", instrument("/user/webauthn/credentials/delete", user_middleware.MethodMiddleware(http.MethodDelete, user_middleware.AuthMiddleware(user_middleware.DenyPersonalAccessTokens(user_middleware.DenyImpersonation(http.HandlerFunc(usercontroller.DeleteWebAuthnCredentialHandler)))))))
+}
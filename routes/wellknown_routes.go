@@ -0,0 +1,15 @@
+package user_routes
+
+import (
+	"net/http"
+
+	usercontroller "github.com/http-crud/api/controllers"
+)
+
+func WellKnownRoutes(mux *http.ServeMux) {
+	// This line of code is registering a route for the "/.well-known/jwks.json" endpoint on the provided
+	// `mux` ServeMux. It publishes the public keys tokens are signed with so other services can verify
+	// them without the signing secret.
+	// GET
+	mux.Handle("/.well-known/jwks.json", instrument("/.well-known/jwks.json", http.HandlerFunc(usercontroller.JWKSHandler)))
+}
@@ -0,0 +1,144 @@
+package user_services
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/http-crud/api/database"
+	"github.com/http-crud/api/helpers"
+	"github.com/http-crud/api/metrics"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/tracing"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// This is a set of functions to record who changed what in the audit log and to query it. The log is
+// append-only: events are never updated or deleted by the API.
+var auditEvents *mongo.Collection = database.OpenCollection(*database.Client, "audit_events")
+
+// The function stores `event` in the audit log. The id, time, request ID, client IP and user agent are
+// filled in when the caller left them empty, and so is the actor from the principal of the request.
+func RecordAuditEvent(ctx context.Context, event user_model.AuditEvent) (e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.RecordAuditEvent")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "audit")
+	defer cancel()
+
+	client := helpers.ClientInfoFromContext(ctx)
+
+	if event.ID.IsZero() {
+		event.ID = primitive.NewObjectID()
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now().UTC()
+	}
+	if event.RequestID == "" {
+		event.RequestID = helpers.RequestIDFromContext(ctx)
+	}
+	if event.IP == "" {
+		event.IP = client.IP
+	}
+	if event.UserAgent == "" {
+		event.UserAgent = client.UserAgent
+	}
+
+	// An admin acting as a user is the actor of whatever the user's token does.
+	if principal := helpers.PrincipalFromContext(ctx); principal != nil {
+		if principal.Impersonated() {
+			event.ImpersonatorID = principal.ActorID
+		}
+		if event.ActorID == nil {
+			event.ActorID = &principal.UserID
+			if principal.Impersonated() {
+				event.ActorID = principal.ActorID
+			}
+		}
+	}
+
+	done := metrics.ObserveMongo("audit_events", "InsertOne")
+	_, err := auditEvents.InsertOne(ctx, event)
+	done(err)
+
+	if err != nil {
+		return dbError(ctx, "RecordAuditEvent", err, http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+// The function records an event of a change that has already been made. The change can't be undone
+// any more, so a failure to record it is logged instead of being returned to the client.
+func recordAudit(ctx context.Context, event user_model.AuditEvent) {
+	if e := RecordAuditEvent(ctx, event); e != nil {
+		log.Printf("request_id=%s failed to record audit event %s: %s", helpers.RequestIDFromContext(ctx), event.Action, e.Error)
+	}
+}
+
+// The function returns the audit events matching `query`, newest first. At most `query.Limit` events
+// are returned (default 50, at most 500).
+func QueryAuditEvents(ctx context.Context, query user_model.AuditQuery) (res []user_model.AuditEvent, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.QueryAuditEvents")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "audit")
+	defer cancel()
+
+	filter := bson.M{}
+
+	if query.UserID != nil {
+		filter["$or"] = bson.A{
+			bson.M{"userId": *query.UserID},
+			bson.M{"actorId": *query.UserID},
+		}
+	}
+	if query.Action != "" {
+		filter["action"] = query.Action
+	}
+
+	createdAt := bson.M{}
+	if query.From != nil {
+		createdAt["$gte"] = *query.From
+	}
+	if query.To != nil {
+		createdAt["$lt"] = *query.To
+	}
+	if len(createdAt) > 0 {
+		filter["createdAt"] = createdAt
+	}
+
+	if query.Before != nil {
+		filter["_id"] = bson.M{"$lt": *query.Before}
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = 50
+	}
+	if query.Limit > 500 {
+		query.Limit = 500
+	}
+
+	// Ids are created with the event, so sorting by id is sorting by time and works with `Before`.
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(query.Limit)
+
+	done := metrics.ObserveMongo("audit_events", "Find")
+	cursor, err := auditEvents.Find(ctx, filter, opts)
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "QueryAuditEvents", err, http.StatusInternalServerError)
+	}
+
+	res = []user_model.AuditEvent{}
+	if err = cursor.All(ctx, &res); err != nil {
+		return nil, dbError(ctx, "QueryAuditEvents", err, http.StatusInternalServerError)
+	}
+
+	return res, nil
+}
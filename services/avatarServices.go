@@ -0,0 +1,304 @@
+package user_services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	// The decoders register the formats accepted for avatars with `image.Decode`.
+	_ "image/gif"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+
+	"github.com/http-crud/api/helpers"
+	"github.com/http-crud/api/metrics"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/storage"
+	"github.com/http-crud/api/tracing"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/image/draw"
+)
+
+// This is a set of functions to set and remove the profile picture of a user. Uploads are decoded and
+// re-encoded, which drops any metadata such as the EXIF location of a photo, and resized to square
+// JPEG images of every configured size.
+
+// The image types accepted for avatars, as sniffed from their content.
+var AvatarContentTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// `MaxAvatarDimension` is the largest width or height of an uploaded image, checked before it is
+// decoded so a small file can't expand into a huge image.
+const MaxAvatarDimension = 4096
+
+// The function returns the largest avatar upload in bytes, `AVATAR_MAX_BYTES` (default 5 MiB).
+func AvatarMaxBytes() int64 {
+	return helpers.EnvInt("AVATAR_MAX_BYTES", 5<<20)
+}
+
+// The function returns the sizes in pixels of the avatar images, the comma separated `AVATAR_SIZES`
+// (default 64, 128, 256 and 512). Invalid sizes are ignored.
+func avatarSizes() []int {
+	var sizes []int
+	for _, s := range helpers.EnvList("AVATAR_SIZES") {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= MaxAvatarDimension {
+			sizes = append(sizes, n)
+		}
+	}
+	if len(sizes) == 0 {
+		sizes = []int{64, 128, 256, 512}
+	}
+	sort.Ints(sizes)
+	return sizes
+}
+
+// The function replaces the avatar of the user with `userID` by the image in `data`. The images of
+// the previous avatar are deleted once the user points to the new one.
+func SetAvatar(ctx context.Context, userID primitive.ObjectID, data []byte) (res *user_model.User, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.SetAvatar")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "avatar")
+	defer cancel()
+
+	img, e := decodeAvatar(data)
+
+	if e != nil {
+		return nil, e
+	}
+
+	images, err := avatarImages(img)
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	store, err := storage.Default()
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	avatarID := helpers.NewTokenID()
+	prefix := avatarPrefix(userID, avatarID)
+	urls := map[string]string{}
+
+	for _, size := range avatarSizes() {
+		key := fmt.Sprintf("%s%d.jpg", prefix, size)
+		jpg := images[size]
+
+		if err := store.Put(ctx, key, bytes.NewReader(jpg), int64(len(jpg)), "image/jpeg"); err != nil {
+			deleteAvatarImages(ctx, store, prefix)
+			return nil, storageError(ctx, "SetAvatar", err)
+		}
+		urls[strconv.Itoa(size)] = store.URL(key)
+	}
+
+	update := bson.M{
+		"$set": bson.M{"avatarid": avatarID, "avatarurls": urls, "updatedat": time.Now().UTC()},
+		"$inc": bson.M{"version": 1},
+	}
+
+	user, e := updateAvatar(ctx, bson.M{"_id": userID}, update, userNotFound())
+
+	if e != nil {
+		deleteAvatarImages(ctx, store, prefix)
+		return nil, e
+	}
+
+	previous := user.AvatarID
+	if previous != "" {
+		deleteAvatarImages(ctx, store, avatarPrefix(userID, previous))
+	}
+
+	user.AvatarID, user.AvatarURLs = avatarID, urls
+	recordAudit(ctx, user_model.AuditEvent{
+		Action:  user_model.AuditUserUpdated,
+		UserID:  &userID,
+		Changes: map[string]user_model.AuditChange{"avatar": {Before: previous, After: avatarID}},
+	})
+
+	return user, nil
+}
+
+// The function removes the avatar of the user with `userID` and deletes its images.
+func DeleteAvatar(ctx context.Context, userID primitive.ObjectID) (res *user_model.User, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.DeleteAvatar")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "avatar")
+	defer cancel()
+
+	store, err := storage.Default()
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	update := bson.M{
+		"$unset": bson.M{"avatarid": "", "avatarurls": ""},
+		"$set":   bson.M{"updatedat": time.Now().UTC()},
+		"$inc":   bson.M{"version": 1},
+	}
+
+	noAvatar := &error_handler.NewError{
+		Error:      "the user has no avatar",
+		StatusCode: http.StatusNotFound,
+	}
+
+	user, e := updateAvatar(ctx, bson.M{"_id": userID, "avatarid": bson.M{"$exists": true}}, update, noAvatar)
+
+	if e != nil {
+		return nil, e
+	}
+
+	previous := user.AvatarID
+	deleteAvatarImages(ctx, store, avatarPrefix(userID, previous))
+
+	user.AvatarID, user.AvatarURLs = "", nil
+	recordAudit(ctx, user_model.AuditEvent{
+		Action:  user_model.AuditUserUpdated,
+		UserID:  &userID,
+		Changes: map[string]user_model.AuditChange{"avatar": {Before: previous, After: ""}},
+	})
+
+	return user, nil
+}
+
+// The function applies `update` to the active user matching `filter` and returns the user as it was
+// before, with the version it has now. `notFound` is returned when no user matches.
+func updateAvatar(ctx context.Context, filter, update bson.M, notFound *error_handler.NewError) (*user_model.User, *error_handler.NewError) {
+	var user user_model.User
+
+	done := metrics.ObserveMongo("users", "FindOneAndUpdate")
+	err := users.FindOneAndUpdate(ctx, activeUser(filter), update).Decode(&user)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, notFound
+	}
+	if err != nil {
+		return nil, dbError(ctx, "updateAvatar", err, http.StatusInternalServerError)
+	}
+
+	user.Version++
+	return &user, nil
+}
+
+// The function returns the key prefix of the images of an avatar, or of every avatar of the user
+// when `avatarID` is empty.
+func avatarPrefix(userID primitive.ObjectID, avatarID string) string {
+	if avatarID == "" {
+		return fmt.Sprintf("avatars/%s/", userID.Hex())
+	}
+	return fmt.Sprintf("avatars/%s/%s/", userID.Hex(), avatarID)
+}
+
+// The function deletes the images under `prefix`. The user no longer points to them, so a failure
+// only leaves unused files behind and is logged.
+func deleteAvatarImages(ctx context.Context, store storage.BlobStore, prefix string) {
+	if err := store.DeletePrefix(ctx, prefix); err != nil {
+		log.Printf("request_id=%s failed to delete avatar images %s: %v", helpers.RequestIDFromContext(ctx), prefix, err)
+	}
+}
+
+// The function converts an error of the blob store into the service error.
+func storageError(ctx context.Context, op string, err error) *error_handler.NewError {
+	log.Printf("request_id=%s %s: blob store error: %v", helpers.RequestIDFromContext(ctx), op, err)
+	return &error_handler.NewError{
+		Error:      "the image couldn't be stored",
+		StatusCode: http.StatusBadGateway,
+	}
+}
+
+// The function decodes the uploaded image in `data`. Only the accepted types are decoded, and only once
+// their header shows the image is within `MaxAvatarDimension`, so a small file can't expand into a
+// huge image in memory.
+func decodeAvatar(data []byte) (image.Image, *error_handler.NewError) {
+	if contentType := http.DetectContentType(data); !contains(AvatarContentTypes, contentType) {
+		return nil, &error_handler.NewError{
+			Error:      fmt.Sprintf("unsupported image type %q, use JPEG, PNG, GIF or WebP", contentType),
+			StatusCode: http.StatusUnsupportedMediaType,
+		}
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      "the image can't be read",
+			StatusCode: http.StatusUnprocessableEntity,
+		}
+	}
+
+	if config.Width > MaxAvatarDimension || config.Height > MaxAvatarDimension {
+		return nil, &error_handler.NewError{
+			Error:      fmt.Sprintf("the image can't be larger than %dx%d pixels", MaxAvatarDimension, MaxAvatarDimension),
+			StatusCode: http.StatusUnprocessableEntity,
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      "the image can't be read",
+			StatusCode: http.StatusUnprocessableEntity,
+		}
+	}
+	return img, nil
+}
+
+// The function re-encodes `img` as a square JPEG of every avatar size, keyed by the size. Nothing of
+// the upload but its pixels is kept.
+func avatarImages(img image.Image) (map[int][]byte, error) {
+	images := map[int][]byte{}
+
+	for _, size := range avatarSizes() {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, squareThumbnail(img, size), &jpeg.Options{Quality: 85}); err != nil {
+			return nil, err
+		}
+		images[size] = buf.Bytes()
+	}
+	return images, nil
+}
+
+// The function crops the center square of `img` and scales it to `size` pixels. Transparent areas
+// become white, since JPEG has no transparency.
+func squareThumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x := bounds.Min.X + (bounds.Dx()-side)/2
+	y := bounds.Min.Y + (bounds.Dy()-side)/2
+	crop := image.Rect(x, y, x+side, y+side)
+
+	thumb := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(thumb, thumb.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, crop, draw.Over, nil)
+
+	return thumb
+}
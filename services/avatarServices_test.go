@@ -0,0 +1,179 @@
+package user_services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The function returns a PNG of `width` x `height` pixels, red on the left half and transparent on
+// the right half.
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width/2; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// The function rewrites the size in the header of the PNG `data`, like a decompression bomb whose
+// few bytes claim a huge image.
+func withPNGSize(data []byte, width, height uint32) []byte {
+	bomb := append([]byte(nil), data...)
+	// The IHDR chunk follows the 8 byte signature: length, type, width, height, ..., CRC.
+	ihdr := bomb[8+4 : 8+4+4+13]
+	binary.BigEndian.PutUint32(ihdr[4:8], width)
+	binary.BigEndian.PutUint32(ihdr[8:12], height)
+	binary.BigEndian.PutUint32(bomb[8+4+4+13:], crc32.ChecksumIEEE(ihdr))
+	return bomb
+}
+
+func TestDecodeAvatarLimits(t *testing.T) {
+	small := testPNG(t, 8, 4)
+
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		status  int
+		message string
+	}{
+		{"not an image", []byte("just some text"), http.StatusUnsupportedMediaType, "unsupported"},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), http.StatusUnsupportedMediaType, "unsupported"},
+		{"truncated", small[:40], http.StatusUnprocessableEntity, "can't be read"},
+		{"too wide", testPNG(t, MaxAvatarDimension+1, 1), http.StatusUnprocessableEntity, "larger than"},
+		// Refused from the header alone, before anything is decoded.
+		{"decompression bomb", withPNGSize(small, 100000, 100000), http.StatusUnprocessableEntity, "larger than"},
+		// Within the limit, so it is decoded, which fails on the missing pixels.
+		{"largest header without pixels", withPNGSize(small, MaxAvatarDimension, MaxAvatarDimension), http.StatusUnprocessableEntity, "can't be read"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, e := decodeAvatar(tc.data)
+			if e == nil || e.StatusCode != tc.status || !strings.Contains(e.Error, tc.message) {
+				t.Fatalf("err = %+v, want %d %q", e, tc.status, tc.message)
+			}
+		})
+	}
+
+	img, e := decodeAvatar(small)
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+	if img.Bounds().Dx() != 8 || img.Bounds().Dy() != 4 {
+		t.Fatalf("decoded %v", img.Bounds())
+	}
+}
+
+func TestAvatarImages(t *testing.T) {
+	t.Setenv("AVATAR_SIZES", "32,16,abc,0")
+
+	img, e := decodeAvatar(testPNG(t, 40, 20))
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+
+	images, err := avatarImages(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("%d sizes, want 16 and 32", len(images))
+	}
+
+	for size, data := range images {
+		thumb, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("size %d isn't a JPEG: %v", size, err)
+		}
+		if thumb.Bounds().Dx() != size || thumb.Bounds().Dy() != size {
+			t.Fatalf("size %d is %v", size, thumb.Bounds())
+		}
+
+		// The center square is kept: red on the left, the transparent half turned white on the right.
+		if r, g, _, _ := thumb.At(size/8, size/2).RGBA(); r>>8 < 200 || g>>8 > 60 {
+			t.Fatalf("size %d: left pixel = %v, want red", size, thumb.At(size/8, size/2))
+		}
+		if r, g, b, _ := thumb.At(size-1-size/8, size/2).RGBA(); r>>8 < 200 || g>>8 < 200 || b>>8 < 200 {
+			t.Fatalf("size %d: right pixel = %v, want white", size, thumb.At(size-1-size/8, size/2))
+		}
+	}
+}
+
+func TestSetAvatar(t *testing.T) {
+	requireMongo(t)
+	t.Setenv("AVATAR_SIZES", "16,32")
+	ctx := context.Background()
+
+	store, err := storage.NewLocalStore(t.TempDir(), "/blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.SetDefault(store)
+
+	user := user_model.User{
+		ID:        primitive.NewObjectID(),
+		Name:      "Jane",
+		Email:     "jane." + primitive.NewObjectID().Hex() + "@example.com",
+		Role:      user_model.RoleUser,
+		CreatedAt: time.Now().UTC(),
+		UpdatedAt: time.Now().UTC(),
+		Version:   1,
+	}
+	if _, err := users.InsertOne(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { users.DeleteOne(ctx, bson.M{"_id": user.ID}) })
+
+	first, e := SetAvatar(ctx, user.ID, testPNG(t, 40, 40))
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+	if first.Version != 2 || len(first.AvatarURLs) != 2 {
+		t.Fatalf("user = version %d with avatars %v", first.Version, first.AvatarURLs)
+	}
+	firstDir := filepath.Join(store.Dir, filepath.FromSlash(avatarPrefix(user.ID, first.AvatarID)))
+	if _, err := os.Stat(filepath.Join(firstDir, "32.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rejected upload leaves the avatar as it was.
+	if _, e := SetAvatar(ctx, user.ID, withPNGSize(testPNG(t, 4, 4), 100000, 100000)); e == nil {
+		t.Fatal("a decompression bomb was accepted")
+	}
+
+	// The images of the replaced avatar are deleted.
+	second, e := SetAvatar(ctx, user.ID, testPNG(t, 20, 20))
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+	if second.AvatarID == first.AvatarID || second.Version != 3 {
+		t.Fatalf("second avatar = %v at version %d", second.AvatarID, second.Version)
+	}
+	if _, err := os.Stat(firstDir); !os.IsNotExist(err) {
+		t.Fatalf("the images of the replaced avatar are still there: %v", err)
+	}
+}
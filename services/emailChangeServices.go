@@ -0,0 +1,300 @@
+package user_services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/http-crud/api/database"
+	"github.com/http-crud/api/helpers"
+	"github.com/http-crud/api/mailer"
+	"github.com/http-crud/api/metrics"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/tracing"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// This is a set of functions to change the email of a user. A new email is only applied once the
+// link sent to it is opened, so a stolen token can't move the account to another mailbox; the old
+// address is told about the change and gets a link to cancel or revert it.
+var emailChanges *mongo.Collection = database.OpenCollection(*database.Client, "email_changes")
+
+// The function records that `user` asked to change their email to `newEmail` and emails the
+// confirmation link to the new address and the revert link to the old one. The confirmation link is
+// valid for `EMAIL_CHANGE_TTL` (default 24h) and the revert link for `EMAIL_CHANGE_REVERT_TTL`
+// (default 168h). Only the latest request of a user can be confirmed. It returns the id of the change;
+// when an email can't be sent the change is cancelled.
+func requestEmailChange(ctx context.Context, user *user_model.User, newEmail string, links user_model.EmailChangeLinks) (string, *error_handler.NewError) {
+	if links.ConfirmURL == "" || links.RevertURL == "" {
+		return "", &error_handler.NewError{
+			Error:      "email changes are disabled: " + helpers.ErrNoPublicBaseURL.Error(),
+			StatusCode: http.StatusServiceUnavailable,
+			Field:      "email",
+		}
+	}
+
+	sender, e := emailSender()
+
+	if e != nil {
+		return "", e
+	}
+
+	now := time.Now().UTC()
+	confirmToken := randomString()
+	revertToken := randomString()
+	ttl := helpers.EnvDuration("EMAIL_CHANGE_TTL", 24*time.Hour)
+	revertTTL := helpers.EnvDuration("EMAIL_CHANGE_REVERT_TTL", 7*24*time.Hour)
+
+	change := user_model.EmailChange{
+		ID:              hashToken(confirmToken),
+		RevertTokenHash: hashToken(revertToken),
+		UserID:          user.ID,
+		OldEmail:        user.Email,
+		NewEmail:        newEmail,
+		IP:              helpers.ClientInfoFromContext(ctx).IP,
+		ExpiresAt:       now.Add(ttl),
+		RevertExpiresAt: now.Add(revertTTL),
+		CreatedAt:       now,
+	}
+
+	done := metrics.ObserveMongo("email_changes", "InsertOne")
+	_, err := emailChanges.InsertOne(ctx, change)
+	done(err)
+
+	if err != nil {
+		return "", dbError(ctx, "requestEmailChange", err, http.StatusInternalServerError)
+	}
+
+	messages := []mailer.Message{
+		{
+			To:      newEmail,
+			Subject: "Confirm your new email",
+			Body: fmt.Sprintf("Hi %s,\n\nUse the link below to confirm this is your new email. It expires in %v.\n\n%s\n\nIf you didn't ask for it, you can ignore this email.\n",
+				user.Name, ttl, withQuery(links.ConfirmURL, url.Values{"token": {confirmToken}})),
+		},
+		{
+			To:      user.Email,
+			Subject: "Your email is being changed",
+			Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to change the email of your account to %s. It is changed once the new address is confirmed.\n\nIf it wasn't you, use the link below within %v to cancel the change, or to revert it if it was already confirmed. You will be logged out everywhere.\n\n%s\n",
+				user.Name, newEmail, revertTTL, withQuery(links.RevertURL, url.Values{"token": {revertToken}})),
+		},
+	}
+
+	for _, m := range messages {
+		if err := sender.Send(ctx, m); err != nil {
+			cancelEmailChange(ctx, change.ID)
+			return "", &error_handler.NewError{
+				Error:      err.Error(),
+				StatusCode: http.StatusBadGateway,
+			}
+		}
+	}
+
+	return change.ID, nil
+}
+
+// The function cancels the email change with `id` that was never applied, so its links stop working.
+// The caller is already failing, so an error is only logged.
+func cancelEmailChange(ctx context.Context, id string) {
+	done := metrics.ObserveMongo("email_changes", "DeleteOne")
+	_, err := emailChanges.DeleteOne(ctx, bson.M{"_id": id})
+	done(err)
+
+	if err != nil {
+		log.Printf("request_id=%s failed to cancel email change: %v", helpers.RequestIDFromContext(ctx), err)
+	}
+}
+
+// The function applies the email change of the confirmation link `token`. The link can be used once,
+// and only while the change is still the user's pending one. It is only used up once the email has
+// changed, so a link that fails because the address is taken can be tried again.
+func ConfirmEmailChange(ctx context.Context, token string) (res *user_model.User, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.ConfirmEmailChange")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "email_change")
+	defer cancel()
+
+	now := time.Now().UTC()
+	filter := bson.M{
+		"_id":         hashToken(token),
+		"confirmedAt": bson.M{"$exists": false},
+		"revertedAt":  bson.M{"$exists": false},
+		"expiresAt":   bson.M{"$gt": now},
+	}
+
+	var change user_model.EmailChange
+
+	done := metrics.ObserveMongo("email_changes", "FindOne")
+	err := emailChanges.FindOne(ctx, filter).Decode(&change)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, &error_handler.NewError{
+			Error:      "invalid or expired confirmation link",
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+	if err != nil {
+		return nil, dbError(ctx, "ConfirmEmailChange", err, http.StatusInternalServerError)
+	}
+
+	// The address may have been taken by another account since the change was requested.
+	done = metrics.ObserveMongo("users", "CountDocuments")
+	count, err := users.CountDocuments(ctx, bson.M{"email": change.NewEmail, "_id": bson.M{"$ne": change.UserID}})
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "ConfirmEmailChange", err, http.StatusInternalServerError)
+	}
+	if count > 0 {
+		return nil, &error_handler.NewError{
+			Error:      "user with this email already exist.",
+			StatusCode: http.StatusConflict,
+		}
+	}
+
+	update := bson.M{
+		"$set":   bson.M{"email": change.NewEmail, "updatedat": now},
+		"$unset": bson.M{"pendingemail": ""},
+		"$inc":   bson.M{"version": 1},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user user_model.User
+
+	done = metrics.ObserveMongo("users", "FindOneAndUpdate")
+	err = users.FindOneAndUpdate(ctx, activeUser(bson.M{"_id": change.UserID, "pendingemail": change.NewEmail}), update, opts).Decode(&user)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, &error_handler.NewError{
+			Error:      "this email change was cancelled or replaced by a newer one",
+			StatusCode: http.StatusConflict,
+		}
+	}
+	if err != nil {
+		return nil, dbError(ctx, "ConfirmEmailChange", err, http.StatusInternalServerError)
+	}
+
+	// The revert link restores the old email of a confirmed change, so the change must be marked even
+	// though the email has been applied already.
+	done = metrics.ObserveMongo("email_changes", "UpdateOne")
+	_, err = emailChanges.UpdateOne(ctx, bson.M{"_id": change.ID}, bson.M{"$set": bson.M{"confirmedAt": now}})
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "ConfirmEmailChange", err, http.StatusInternalServerError)
+	}
+
+	recordAudit(ctx, user_model.AuditEvent{
+		Action:     user_model.AuditEmailChanged,
+		ActorID:    &change.UserID,
+		UserID:     &change.UserID,
+		ResourceID: change.ID,
+		Changes:    map[string]user_model.AuditChange{"email": {Before: change.OldEmail, After: change.NewEmail}},
+	})
+
+	return &user, nil
+}
+
+// The function cancels the email change of the revert link `token`, or restores the old email when
+// the change was already confirmed. Whoever asked for the change may hold a stolen token, so the user
+// is logged out everywhere. The link is only used up once the user has changed, so a link that fails
+// because the old address is taken can be tried again.
+func RevertEmailChange(ctx context.Context, token string) (e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.RevertEmailChange")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "email_change")
+	defer cancel()
+
+	now := time.Now().UTC()
+	filter := bson.M{
+		"revertTokenHash": hashToken(token),
+		"revertedAt":      bson.M{"$exists": false},
+		"revertExpiresAt": bson.M{"$gt": now},
+	}
+
+	var change user_model.EmailChange
+
+	done := metrics.ObserveMongo("email_changes", "FindOne")
+	err := emailChanges.FindOne(ctx, filter).Decode(&change)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return &error_handler.NewError{
+			Error:      "invalid or expired revert link",
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+	if err != nil {
+		return dbError(ctx, "RevertEmailChange", err, http.StatusInternalServerError)
+	}
+
+	// A pending change is dropped; a confirmed one is undone as long as the user still has the new
+	// email. When nothing matches, the change was replaced or undone already and there is nothing left
+	// to revert.
+	userFilter := bson.M{"_id": change.UserID, "pendingemail": change.NewEmail}
+	set := bson.M{"updatedat": now}
+
+	if change.ConfirmedAt != nil {
+		done := metrics.ObserveMongo("users", "CountDocuments")
+		count, err := users.CountDocuments(ctx, bson.M{"email": change.OldEmail, "_id": bson.M{"$ne": change.UserID}})
+		done(err)
+
+		if err != nil {
+			return dbError(ctx, "RevertEmailChange", err, http.StatusInternalServerError)
+		}
+		if count > 0 {
+			return &error_handler.NewError{
+				Error:      "the old email is now used by another account",
+				StatusCode: http.StatusConflict,
+			}
+		}
+
+		userFilter = bson.M{"_id": change.UserID, "email": change.NewEmail}
+		set["email"] = change.OldEmail
+	}
+
+	update := bson.M{"$set": set, "$unset": bson.M{"pendingemail": ""}, "$inc": bson.M{"version": 1}}
+
+	done = metrics.ObserveMongo("users", "UpdateOne")
+	result, err := users.UpdateOne(ctx, userFilter, update)
+	done(err)
+
+	if err != nil {
+		return dbError(ctx, "RevertEmailChange", err, http.StatusInternalServerError)
+	}
+	if result.ModifiedCount == 0 {
+		return nil
+	}
+
+	done = metrics.ObserveMongo("email_changes", "UpdateOne")
+	_, err = emailChanges.UpdateOne(ctx, bson.M{"_id": change.ID, "revertedAt": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"revertedAt": now}})
+	done(err)
+
+	if err != nil {
+		return dbError(ctx, "RevertEmailChange", err, http.StatusInternalServerError)
+	}
+
+	if e := revokeUserCredentials(ctx, change.UserID, now); e != nil {
+		return e
+	}
+
+	recordAudit(ctx, user_model.AuditEvent{
+		Action:     user_model.AuditEmailChangeReverted,
+		ActorID:    &change.UserID,
+		UserID:     &change.UserID,
+		ResourceID: change.ID,
+		Changes:    map[string]user_model.AuditChange{"email": {Before: change.NewEmail, After: change.OldEmail}},
+	})
+
+	return nil
+}
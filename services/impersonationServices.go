@@ -0,0 +1,97 @@
+package user_services
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/http-crud/api/helpers"
+	"github.com/http-crud/api/metrics"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/tracing"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The function lets the admin `adminID` act as the user with `userID`. It opens a session on the user's
+// account marked with the admin and returns a token for it that lives for `IMPERSONATION_TTL` (default
+// 15m) and can't be refreshed. Admins can't be impersonated, and a `reason` such as the support ticket
+// is required; it is kept in the audit log.
+func StartImpersonation(ctx context.Context, adminID primitive.ObjectID, userID, reason string) (res *user_model.ImpersonationResponse, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.StartImpersonation")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	reason = strings.TrimSpace(reason)
+
+	if reason == "" || len(reason) > 500 {
+		return nil, &error_handler.NewError{
+			Error:      "a reason of at most 500 characters is required",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	user, e := GetUserById(ctx, userID)
+
+	if e != nil {
+		return nil, e
+	}
+
+	if user.ID == adminID || user.Role == user_model.RoleAdmin {
+		return nil, &error_handler.NewError{
+			Error:      "admins can't be impersonated",
+			StatusCode: http.StatusForbidden,
+		}
+	}
+
+	ctx, cancel := withOperationTimeout(ctx, "impersonate")
+	defer cancel()
+
+	client := helpers.ClientInfoFromContext(ctx)
+	now := time.Now().UTC()
+	ttl := helpers.EnvDuration("IMPERSONATION_TTL", 15*time.Minute)
+
+	session := user_model.Session{
+		ID:             primitive.NewObjectID(),
+		UserID:         user.ID,
+		DeviceName:     "Impersonated by an administrator",
+		UserAgent:      client.UserAgent,
+		IP:             client.IP,
+		CreatedAt:      now,
+		LastSeenAt:     now,
+		ExpiresAt:      now.Add(ttl),
+		ImpersonatorID: &adminID,
+	}
+
+	done := metrics.ObserveMongo("sessions", "InsertOne")
+	_, err := sessions.InsertOne(ctx, session)
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "StartImpersonation", err, http.StatusInternalServerError)
+	}
+
+	// The start is recorded before the token exists, so no impersonation goes unaudited.
+	if e := RecordAuditEvent(ctx, user_model.AuditEvent{
+		Action:    user_model.AuditImpersonationStart,
+		ActorID:   &adminID,
+		UserID:    &user.ID,
+		SessionID: session.ID.Hex(),
+		Reason:    reason,
+	}); e != nil {
+		return nil, e
+	}
+
+	jwt, e := helpers.GenerateImpersonationJWT(user, session.ID.Hex(), adminID, ttl)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return &user_model.ImpersonationResponse{
+		Accesstoken: jwt,
+		UserID:      user.ID,
+		SessionID:   session.ID.Hex(),
+		ExpiresAt:   session.ExpiresAt,
+	}, nil
+}
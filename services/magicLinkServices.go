@@ -0,0 +1,248 @@
+package user_services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/http-crud/api/database"
+	"github.com/http-crud/api/helpers"
+	"github.com/http-crud/api/mailer"
+	"github.com/http-crud/api/metrics"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/tracing"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// This is a set of functions for passwordless login with single-use links sent by email.
+var (
+	magicLinks        *mongo.Collection = database.OpenCollection(*database.Client, "magic_links")
+	magicLinkRequests *mongo.Collection = database.OpenCollection(*database.Client, "magic_link_requests")
+)
+
+// The function emails a login link to the user with `email`. Nothing is sent when there is no such
+// user, but the caller gets the same answer so the endpoint can't be used to find accounts. Every
+// request counts towards the limits, whether or not the email is registered: at most
+// `MAGIC_LINK_RATE_LIMIT` requests (default 5) per email and `MAGIC_LINK_IP_RATE_LIMIT` (default 20)
+// per client IP in `MAGIC_LINK_RATE_WINDOW` (default 1h). Links are valid for `MAGIC_LINK_TTL`
+// (default 15m).
+func RequestMagicLink(ctx context.Context, email, ip, callbackURL string) (e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.RequestMagicLink")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "magic_link")
+	defer cancel()
+
+	email = strings.TrimSpace(email)
+	now := time.Now().UTC()
+
+	if _, err := mail.ParseAddress(email); err != nil {
+		return &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	sender, e := emailSender()
+
+	if e != nil {
+		return e
+	}
+
+	limit := helpers.EnvInt("MAGIC_LINK_RATE_LIMIT", 5)
+	ipLimit := helpers.EnvInt("MAGIC_LINK_IP_RATE_LIMIT", 20)
+	window := helpers.EnvDuration("MAGIC_LINK_RATE_WINDOW", time.Hour)
+	since := bson.M{"$gt": now.Add(-window)}
+
+	for _, l := range []struct {
+		filter bson.M
+		limit  int64
+	}{
+		{bson.M{"email": strings.ToLower(email), "createdAt": since}, limit},
+		{bson.M{"ip": ip, "createdAt": since}, ipLimit},
+	} {
+		done := metrics.ObserveMongo("magic_link_requests", "CountDocuments")
+		count, err := magicLinkRequests.CountDocuments(ctx, l.filter)
+		done(err)
+
+		if err != nil {
+			return dbError(ctx, "RequestMagicLink", err, http.StatusInternalServerError)
+		}
+
+		if count >= l.limit {
+			return &error_handler.NewError{
+				Error:      "too many login links requested, try again later",
+				StatusCode: http.StatusTooManyRequests,
+			}
+		}
+	}
+
+	done := metrics.ObserveMongo("magic_link_requests", "InsertOne")
+	_, err := magicLinkRequests.InsertOne(ctx, user_model.MagicLinkRequest{
+		ID:        primitive.NewObjectID(),
+		Email:     strings.ToLower(email),
+		IP:        ip,
+		CreatedAt: now,
+		ExpiresAt: now.Add(window),
+	})
+	done(err)
+
+	if err != nil {
+		return dbError(ctx, "RequestMagicLink", err, http.StatusInternalServerError)
+	}
+
+	var user user_model.User
+
+	done = metrics.ObserveMongo("users", "FindOne")
+	err = users.FindOne(ctx, activeUser(bson.M{"email": email}), byEmail()).Decode(&user)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+
+	if err != nil {
+		return dbError(ctx, "RequestMagicLink", err, http.StatusInternalServerError)
+	}
+
+	token := randomString()
+	ttl := helpers.EnvDuration("MAGIC_LINK_TTL", 15*time.Minute)
+
+	link := user_model.MagicLink{
+		ID:        hashToken(token),
+		UserID:    user.ID,
+		Email:     user.Email,
+		IP:        ip,
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+
+	done = metrics.ObserveMongo("magic_links", "InsertOne")
+	_, err = magicLinks.InsertOne(ctx, link)
+	done(err)
+
+	if err != nil {
+		return dbError(ctx, "RequestMagicLink", err, http.StatusInternalServerError)
+	}
+
+	err = sender.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the link below to log in. It can be used once and expires in %v.\n\n%s\n\nIf you didn't ask for it, you can ignore this email.\n",
+			user.Name, ttl, withQuery(callbackURL, url.Values{"token": {token}})),
+	})
+
+	if err != nil {
+		return &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusBadGateway,
+		}
+	}
+
+	return nil
+}
+
+// The function exchanges a login link for an access token, or for an MFA challenge when the user has
+// two-step login on. The link is consumed so it can only be used once. When `MAGIC_LINK_BIND_IP` is
+// true the link must be opened from the IP that requested it; opening it elsewhere doesn't use it up.
+func CompleteMagicLinkLogin(ctx context.Context, token, ip string) (res *user_model.UserLoginResponse, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.CompleteMagicLinkLogin")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "magic_link")
+	defer cancel()
+
+	now := time.Now().UTC()
+	var link user_model.MagicLink
+
+	filter := bson.M{"_id": hashToken(token), "usedAt": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": now}}
+
+	invalidLink := &error_handler.NewError{
+		Error:      "invalid or expired login link",
+		StatusCode: http.StatusUnauthorized,
+	}
+
+	done := metrics.ObserveMongo("magic_links", "FindOne")
+	err := magicLinks.FindOne(ctx, filter).Decode(&link)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		metrics.ObserveLogin(false)
+		return nil, invalidLink
+	}
+
+	if err != nil {
+		return nil, dbError(ctx, "CompleteMagicLinkLogin", err, http.StatusInternalServerError)
+	}
+
+	if bind, _ := strconv.ParseBool(os.Getenv("MAGIC_LINK_BIND_IP")); bind && link.IP != ip {
+		metrics.ObserveLogin(false)
+		return nil, &error_handler.NewError{
+			Error:      "login link must be opened from the device that requested it",
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	// The link is only used up now, and only once when it is opened twice at the same time.
+	done = metrics.ObserveMongo("magic_links", "UpdateOne")
+	result, err := magicLinks.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"usedAt": now}})
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "CompleteMagicLinkLogin", err, http.StatusInternalServerError)
+	}
+
+	if result.ModifiedCount == 0 {
+		metrics.ObserveLogin(false)
+		return nil, invalidLink
+	}
+
+	var user user_model.User
+
+	done = metrics.ObserveMongo("users", "FindOne")
+	err = users.FindOne(ctx, activeUser(bson.M{"_id": link.UserID})).Decode(&user)
+	done(err)
+
+	if err != nil {
+		metrics.ObserveLogin(false)
+		return nil, dbError(ctx, "CompleteMagicLinkLogin", err, http.StatusUnauthorized)
+	}
+
+	return loginOrChallenge(ctx, &user)
+}
+
+// The function creates the indexes of the magic link collections. Requests are only kept for their
+// rate limit window, then MongoDB deletes them.
+func EnsureMagicLinkIndexes(ctx context.Context) error {
+	ctx, cancel := withOperationTimeout(ctx, "create_indexes")
+	defer cancel()
+
+	_, err := magicLinkRequests.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// The function returns the configured mailer, or fails with 503 when there is none.
+func emailSender() (mailer.Mailer, *error_handler.NewError) {
+	sender, err := mailer.Default()
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      "emails are disabled: " + err.Error(),
+			StatusCode: http.StatusServiceUnavailable,
+		}
+	}
+	return sender, nil
+}
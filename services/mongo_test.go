@@ -0,0 +1,32 @@
+package user_services
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/http-crud/api/database"
+	_ "github.com/http-crud/api/database/databasetest"
+)
+
+// The function skips the test unless the MongoDB of `MONGO_CONNECTION_URI` (a local one by default,
+// see `databasetest`) answers. Tests write to the "http-crud-test" database, or `MONGO_DATABASE` when
+// set, and remove what they create.
+func requireMongo(t *testing.T) {
+	t.Helper()
+
+	pingOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		pingErr = database.Client.Ping(ctx, nil)
+	})
+	if pingErr != nil {
+		t.Skipf("MongoDB is not reachable: %v", pingErr)
+	}
+}
+
+var (
+	pingOnce sync.Once
+	pingErr  error
+)
@@ -0,0 +1,654 @@
+package user_services
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/http-crud/api/database"
+	"github.com/http-crud/api/helpers"
+	"github.com/http-crud/api/metrics"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/tracing"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Prefixes of the opaque tokens issued by the authorization server.
+const (
+	oauthAccessTokenPrefix  = "oat_"
+	oauthRefreshTokenPrefix = "ort_"
+)
+
+// This is a set of functions that let this service act as an OAuth 2.0 authorization server for other
+// applications: client registration, the authorization code grant with PKCE, the client credentials
+// and refresh token grants, token introspection (RFC 7662) and revocation (RFC 7009).
+var (
+	oauthClients  *mongo.Collection = database.OpenCollection(*database.Client, "oauth_clients")
+	oauthCodes    *mongo.Collection = database.OpenCollection(*database.Client, "oauth_authorization_codes")
+	oauthTokens   *mongo.Collection = database.OpenCollection(*database.Client, "oauth_tokens")
+	oauthConsents *mongo.Collection = database.OpenCollection(*database.Client, "oauth_consents")
+)
+
+func RegisterOAuthClient(ctx context.Context, createdBy primitive.ObjectID, client user_model.OAuthClient) (res *user_model.OAuthClientRegistrationResponse, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.RegisterOAuthClient")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "register_client")
+	defer cancel()
+
+	client.Name = strings.TrimSpace(client.Name)
+
+	if client.Name == "" {
+		return nil, &error_handler.NewError{
+			Error:      "client name can't be empty",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	if len(client.GrantTypes) == 0 {
+		client.GrantTypes = []string{user_model.GrantTypeAuthorizationCode, user_model.GrantTypeRefreshToken}
+	}
+
+	for _, grant := range client.GrantTypes {
+		switch grant {
+		case user_model.GrantTypeAuthorizationCode, user_model.GrantTypeRefreshToken:
+		case user_model.GrantTypeClientCredentials:
+			if !client.Confidential {
+				return nil, &error_handler.NewError{
+					Error:      "only confidential clients can use the client_credentials grant",
+					StatusCode: http.StatusBadRequest,
+				}
+			}
+		default:
+			return nil, &error_handler.NewError{
+				Error:      "unsupported grant type: " + grant,
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+	}
+
+	if contains(client.GrantTypes, user_model.GrantTypeAuthorizationCode) && len(client.RedirectURIs) == 0 {
+		return nil, &error_handler.NewError{
+			Error:      "at least one redirect uri is required",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	for _, uri := range client.RedirectURIs {
+		if !validRedirectURI(uri) {
+			return nil, &error_handler.NewError{
+				Error:      "invalid redirect uri: " + uri,
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+	}
+
+	if len(client.Scopes) == 0 {
+		return nil, &error_handler.NewError{
+			Error:      "at least one scope is required",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	client.ID = helpers.NewTokenID()
+	client.CreatedBy = createdBy
+	client.CreatedAt = time.Now().UTC()
+
+	var secret string
+
+	if client.Confidential {
+		secret = randomString()
+		client.SecretHash = hashToken(secret)
+	}
+
+	done := metrics.ObserveMongo("oauth_clients", "InsertOne")
+	_, err := oauthClients.InsertOne(ctx, client)
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "RegisterOAuthClient", err, http.StatusInternalServerError)
+	}
+
+	return &user_model.OAuthClientRegistrationResponse{
+		ClientSecret: secret,
+		OAuthClient:  client,
+	}, nil
+}
+
+// The function validates an authorization request and tells the consent screen what to show. Consent
+// isn't required again when the user already approved every requested scope for the client.
+func GetOAuthConsentPrompt(ctx context.Context, userID primitive.ObjectID, req *user_model.OAuthAuthorizationRequest) (res *user_model.OAuthConsentPrompt, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.GetOAuthConsentPrompt")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "oauth_authorize")
+	defer cancel()
+
+	client, e := validateAuthorizationRequest(ctx, req)
+
+	if e != nil {
+		return nil, e
+	}
+
+	var consent user_model.OAuthConsent
+
+	done := metrics.ObserveMongo("oauth_consents", "FindOne")
+	err := oauthConsents.FindOne(ctx, bson.M{"_id": consentID(userID, client.ID)}).Decode(&consent)
+	done(err)
+
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, dbError(ctx, "GetOAuthConsentPrompt", err, http.StatusInternalServerError)
+	}
+
+	return &user_model.OAuthConsentPrompt{
+		ClientID:        client.ID,
+		ClientName:      client.Name,
+		RedirectURI:     req.RedirectURI,
+		Scopes:          req.Scopes,
+		ConsentRequired: err == mongo.ErrNoDocuments || !subset(req.Scopes, consent.Scopes),
+	}, nil
+}
+
+// The function records the user's decision on an authorization request. An approval stores the consent
+// and issues an authorization code; either way the response tells the consent screen where to send
+// the browser.
+func DecideOAuthAuthorization(ctx context.Context, userID primitive.ObjectID, req *user_model.OAuthAuthorizationRequest, approve bool) (res *user_model.OAuthAuthorizationResponse, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.DecideOAuthAuthorization")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "oauth_authorize")
+	defer cancel()
+
+	client, e := validateAuthorizationRequest(ctx, req)
+
+	if e != nil {
+		return nil, e
+	}
+
+	query := url.Values{}
+
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+
+	if !approve {
+		query.Set("error", "access_denied")
+		return &user_model.OAuthAuthorizationResponse{RedirectTo: withQuery(req.RedirectURI, query)}, nil
+	}
+
+	now := time.Now().UTC()
+
+	consent := bson.M{"$set": bson.M{"userId": userID, "clientId": client.ID, "grantedAt": now}, "$addToSet": bson.M{"scopes": bson.M{"$each": req.Scopes}}}
+
+	done := metrics.ObserveMongo("oauth_consents", "UpdateOne")
+	_, err := oauthConsents.UpdateOne(ctx, bson.M{"_id": consentID(userID, client.ID)}, consent, options.Update().SetUpsert(true))
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "DecideOAuthAuthorization", err, http.StatusInternalServerError)
+	}
+
+	code := randomString()
+
+	authorizationCode := user_model.OAuthAuthorizationCode{
+		ID:            hashToken(code),
+		ClientID:      client.ID,
+		UserID:        userID,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        req.Scopes,
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     now.Add(helpers.EnvDuration("OAUTH_CODE_TTL", time.Minute)),
+	}
+
+	done = metrics.ObserveMongo("oauth_authorization_codes", "InsertOne")
+	_, err = oauthCodes.InsertOne(ctx, authorizationCode)
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "DecideOAuthAuthorization", err, http.StatusInternalServerError)
+	}
+
+	query.Set("code", code)
+
+	return &user_model.OAuthAuthorizationResponse{RedirectTo: withQuery(req.RedirectURI, query)}, nil
+}
+
+// The function implements the token endpoint for the authorization code, refresh token and client
+// credentials grants.
+func ExchangeOAuthToken(ctx context.Context, req *user_model.OAuthTokenRequest) (res *user_model.OAuthTokenResponse, e *user_model.OAuthError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.ExchangeOAuthToken")
+	defer func() { tracing.EndSpan(span, oauthErrorToNewError(e)) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "oauth_token")
+	defer cancel()
+
+	client, e := authenticateOAuthClient(ctx, req.ClientID, req.ClientSecret)
+
+	if e != nil {
+		return nil, e
+	}
+
+	if !contains(client.GrantTypes, req.GrantType) {
+		return nil, oauthError("unauthorized_client", "the client may not use this grant type", http.StatusBadRequest)
+	}
+
+	switch req.GrantType {
+	case user_model.GrantTypeAuthorizationCode:
+		return exchangeAuthorizationCode(ctx, client, req)
+	case user_model.GrantTypeRefreshToken:
+		return exchangeRefreshToken(ctx, client, req)
+	case user_model.GrantTypeClientCredentials:
+		scopes := req.Scopes
+		if len(scopes) == 0 {
+			scopes = client.Scopes
+		}
+		if !subset(scopes, client.Scopes) {
+			return nil, oauthError("invalid_scope", "the client may not request these scopes", http.StatusBadRequest)
+		}
+		return issueOAuthTokens(ctx, client, nil, scopes, helpers.NewTokenID(), false)
+	}
+
+	return nil, oauthError("unsupported_grant_type", "", http.StatusBadRequest)
+}
+
+// The function implements RFC 7662 token introspection. Only confidential clients may introspect.
+func IntrospectOAuthToken(ctx context.Context, clientID, clientSecret, token string) (res *user_model.OAuthIntrospectionResponse, e *user_model.OAuthError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.IntrospectOAuthToken")
+	defer func() { tracing.EndSpan(span, oauthErrorToNewError(e)) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "oauth_introspect")
+	defer cancel()
+
+	client, e := authenticateOAuthClient(ctx, clientID, clientSecret)
+
+	if e != nil {
+		return nil, e
+	}
+
+	if !client.Confidential {
+		return nil, oauthError("unauthorized_client", "only confidential clients may introspect tokens", http.StatusUnauthorized)
+	}
+
+	var stored user_model.OAuthToken
+
+	done := metrics.ObserveMongo("oauth_tokens", "FindOne")
+	err := oauthTokens.FindOne(ctx, bson.M{"_id": hashToken(token)}).Decode(&stored)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return &user_model.OAuthIntrospectionResponse{Active: false}, nil
+	}
+
+	if err != nil {
+		return nil, oauthServerError(dbError(ctx, "IntrospectOAuthToken", err, http.StatusInternalServerError))
+	}
+
+	if stored.RevokedAt != nil || time.Now().After(stored.ExpiresAt) {
+		return &user_model.OAuthIntrospectionResponse{Active: false}, nil
+	}
+
+	res = &user_model.OAuthIntrospectionResponse{
+		Active:    true,
+		Scope:     strings.Join(stored.Scopes, " "),
+		ClientID:  stored.ClientID,
+		TokenType: "Bearer",
+		ExpiresAt: stored.ExpiresAt.Unix(),
+		IssuedAt:  stored.CreatedAt.Unix(),
+		Issuer:    helpers.LoadTokenConfig().Issuer,
+	}
+
+	if stored.Kind == user_model.OAuthTokenRefresh {
+		res.TokenType = user_model.OAuthTokenRefresh
+	}
+
+	if stored.UserID != nil {
+		res.Subject = stored.UserID.Hex()
+	}
+
+	return res, nil
+}
+
+// The function implements RFC 7009 token revocation. A client can only revoke its own tokens, and
+// revoking a refresh token also revokes the access tokens issued with it. Unknown tokens are not an
+// error.
+func RevokeOAuthToken(ctx context.Context, clientID, clientSecret, token string) (e *user_model.OAuthError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.RevokeOAuthToken")
+	defer func() { tracing.EndSpan(span, oauthErrorToNewError(e)) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "oauth_revoke")
+	defer cancel()
+
+	client, e := authenticateOAuthClient(ctx, clientID, clientSecret)
+
+	if e != nil {
+		return e
+	}
+
+	var stored user_model.OAuthToken
+
+	done := metrics.ObserveMongo("oauth_tokens", "FindOne")
+	err := oauthTokens.FindOne(ctx, bson.M{"_id": hashToken(token), "clientId": client.ID}).Decode(&stored)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+
+	if err != nil {
+		return oauthServerError(dbError(ctx, "RevokeOAuthToken", err, http.StatusInternalServerError))
+	}
+
+	filter := bson.M{"_id": stored.ID}
+
+	if stored.Kind == user_model.OAuthTokenRefresh {
+		filter = bson.M{"grantId": stored.GrantID}
+	}
+
+	return revokeOAuthTokens(ctx, filter)
+}
+
+func exchangeAuthorizationCode(ctx context.Context, client *user_model.OAuthClient, req *user_model.OAuthTokenRequest) (*user_model.OAuthTokenResponse, *user_model.OAuthError) {
+	var code user_model.OAuthAuthorizationCode
+
+	// The code is deleted as it is read, so it can only be exchanged once.
+	filter := bson.M{"_id": hashToken(req.Code), "clientId": client.ID, "expiresAt": bson.M{"$gt": time.Now().UTC()}}
+
+	done := metrics.ObserveMongo("oauth_authorization_codes", "FindOneAndDelete")
+	err := oauthCodes.FindOneAndDelete(ctx, filter).Decode(&code)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, oauthError("invalid_grant", "invalid or expired authorization code", http.StatusBadRequest)
+	}
+
+	if err != nil {
+		return nil, oauthServerError(dbError(ctx, "ExchangeOAuthToken", err, http.StatusInternalServerError))
+	}
+
+	if code.RedirectURI != req.RedirectURI {
+		return nil, oauthError("invalid_grant", "redirect_uri does not match the authorization request", http.StatusBadRequest)
+	}
+
+	challenge := sha256.Sum256([]byte(req.CodeVerifier))
+
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(challenge[:])), []byte(code.CodeChallenge)) != 1 {
+		return nil, oauthError("invalid_grant", "code_verifier does not match the code challenge", http.StatusBadRequest)
+	}
+
+	withRefresh := contains(client.GrantTypes, user_model.GrantTypeRefreshToken)
+
+	return issueOAuthTokens(ctx, client, &code.UserID, code.Scopes, helpers.NewTokenID(), withRefresh)
+}
+
+// The function rotates a refresh token: the presented token is revoked and a new one is issued with
+// the access token. Presenting a token that was already rotated means it leaked, so every token of
+// the grant is revoked.
+func exchangeRefreshToken(ctx context.Context, client *user_model.OAuthClient, req *user_model.OAuthTokenRequest) (*user_model.OAuthTokenResponse, *user_model.OAuthError) {
+	now := time.Now().UTC()
+	var stored user_model.OAuthToken
+
+	filter := bson.M{"_id": hashToken(req.RefreshToken), "kind": user_model.OAuthTokenRefresh, "clientId": client.ID}
+
+	done := metrics.ObserveMongo("oauth_tokens", "FindOneAndUpdate")
+	err := oauthTokens.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"revokedAt": now}}).Decode(&stored)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, oauthError("invalid_grant", "invalid refresh token", http.StatusBadRequest)
+	}
+
+	if err != nil {
+		return nil, oauthServerError(dbError(ctx, "ExchangeOAuthToken", err, http.StatusInternalServerError))
+	}
+
+	if stored.RevokedAt != nil {
+		if e := revokeOAuthTokens(ctx, bson.M{"grantId": stored.GrantID}); e != nil {
+			return nil, e
+		}
+		return nil, oauthError("invalid_grant", "refresh token was already used", http.StatusBadRequest)
+	}
+
+	if now.After(stored.ExpiresAt) {
+		return nil, oauthError("invalid_grant", "refresh token expired", http.StatusBadRequest)
+	}
+
+	scopes := stored.Scopes
+
+	if len(req.Scopes) != 0 {
+		if !subset(req.Scopes, stored.Scopes) {
+			return nil, oauthError("invalid_scope", "the refresh token was not granted these scopes", http.StatusBadRequest)
+		}
+		scopes = req.Scopes
+	}
+
+	return issueOAuthTokens(ctx, client, stored.UserID, scopes, stored.GrantID, true)
+}
+
+func issueOAuthTokens(ctx context.Context, client *user_model.OAuthClient, userID *primitive.ObjectID, scopes []string, grantID string, withRefresh bool) (*user_model.OAuthTokenResponse, *user_model.OAuthError) {
+	now := time.Now().UTC()
+	accessTTL := helpers.EnvDuration("OAUTH_ACCESS_TOKEN_TTL", time.Hour)
+
+	accessToken := oauthAccessTokenPrefix + randomString()
+	tokens := []interface{}{user_model.OAuthToken{
+		ID:        hashToken(accessToken),
+		Kind:      user_model.OAuthTokenAccess,
+		GrantID:   grantID,
+		ClientID:  client.ID,
+		UserID:    userID,
+		Scopes:    scopes,
+		ExpiresAt: now.Add(accessTTL),
+		CreatedAt: now,
+	}}
+
+	res := &user_model.OAuthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(accessTTL.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	}
+
+	if withRefresh && userID != nil {
+		res.RefreshToken = oauthRefreshTokenPrefix + randomString()
+		tokens = append(tokens, user_model.OAuthToken{
+			ID:        hashToken(res.RefreshToken),
+			Kind:      user_model.OAuthTokenRefresh,
+			GrantID:   grantID,
+			ClientID:  client.ID,
+			UserID:    userID,
+			Scopes:    scopes,
+			ExpiresAt: now.Add(helpers.EnvDuration("OAUTH_REFRESH_TOKEN_TTL", 30*24*time.Hour)),
+			CreatedAt: now,
+		})
+	}
+
+	done := metrics.ObserveMongo("oauth_tokens", "InsertMany")
+	_, err := oauthTokens.InsertMany(ctx, tokens)
+	done(err)
+
+	if err != nil {
+		return nil, oauthServerError(dbError(ctx, "ExchangeOAuthToken", err, http.StatusInternalServerError))
+	}
+
+	return res, nil
+}
+
+func revokeOAuthTokens(ctx context.Context, filter bson.M) *user_model.OAuthError {
+	filter["revokedAt"] = bson.M{"$exists": false}
+
+	done := metrics.ObserveMongo("oauth_tokens", "UpdateMany")
+	_, err := oauthTokens.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revokedAt": time.Now().UTC()}})
+	done(err)
+
+	if err != nil {
+		return oauthServerError(dbError(ctx, "RevokeOAuthToken", err, http.StatusInternalServerError))
+	}
+	return nil
+}
+
+// The function checks the client credentials. Confidential clients must present their secret;
+// public clients are identified by their id alone.
+func authenticateOAuthClient(ctx context.Context, clientID, clientSecret string) (*user_model.OAuthClient, *user_model.OAuthError) {
+	if clientID == "" {
+		return nil, oauthError("invalid_client", "client authentication failed", http.StatusUnauthorized)
+	}
+
+	var client user_model.OAuthClient
+
+	done := metrics.ObserveMongo("oauth_clients", "FindOne")
+	err := oauthClients.FindOne(ctx, bson.M{"_id": clientID}).Decode(&client)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, oauthError("invalid_client", "client authentication failed", http.StatusUnauthorized)
+	}
+
+	if err != nil {
+		return nil, oauthServerError(dbError(ctx, "AuthenticateOAuthClient", err, http.StatusInternalServerError))
+	}
+
+	if client.Confidential && subtle.ConstantTimeCompare([]byte(hashToken(clientSecret)), []byte(client.SecretHash)) != 1 {
+		return nil, oauthError("invalid_client", "client authentication failed", http.StatusUnauthorized)
+	}
+
+	return &client, nil
+}
+
+func validateAuthorizationRequest(ctx context.Context, req *user_model.OAuthAuthorizationRequest) (*user_model.OAuthClient, *error_handler.NewError) {
+	var client user_model.OAuthClient
+
+	done := metrics.ObserveMongo("oauth_clients", "FindOne")
+	err := oauthClients.FindOne(ctx, bson.M{"_id": req.ClientID}).Decode(&client)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, &error_handler.NewError{
+			Error:      "unknown client",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	if err != nil {
+		return nil, dbError(ctx, "ValidateAuthorizationRequest", err, http.StatusInternalServerError)
+	}
+
+	if !contains(client.GrantTypes, user_model.GrantTypeAuthorizationCode) {
+		return nil, &error_handler.NewError{
+			Error:      "the client may not use the authorization code grant",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	// The redirect uri must match a registered one exactly. It may only be left out when the client
+	// registered a single one.
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+
+	if !contains(client.RedirectURIs, req.RedirectURI) {
+		return nil, &error_handler.NewError{
+			Error:      "redirect uri is not registered for this client",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	if len(req.Scopes) == 0 {
+		req.Scopes = client.Scopes
+	}
+
+	if !subset(req.Scopes, client.Scopes) {
+		return nil, &error_handler.NewError{
+			Error:      "the client may not request these scopes",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return nil, &error_handler.NewError{
+			Error:      "a S256 code challenge is required",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	return &client, nil
+}
+
+// Redirect uris must be absolute, without a fragment, and use https unless they point at the local
+// machine.
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+
+	if err != nil || !u.IsAbs() || u.Fragment != "" || u.Host == "" {
+		return false
+	}
+
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+	return false
+}
+
+func withQuery(uri string, query url.Values) string {
+	u, _ := url.Parse(uri)
+	q := u.Query()
+
+	for k, v := range query {
+		q[k] = v
+	}
+
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func consentID(userID primitive.ObjectID, clientID string) string {
+	return userID.Hex() + ":" + clientID
+}
+
+func oauthError(code, description string, status int) *user_model.OAuthError {
+	return &user_model.OAuthError{Code: code, Description: description, StatusCode: status}
+}
+
+func oauthServerError(e *error_handler.NewError) *user_model.OAuthError {
+	if e.StatusCode == http.StatusGatewayTimeout {
+		return oauthError("temporarily_unavailable", e.Error, e.StatusCode)
+	}
+	return oauthError("server_error", e.Error, e.StatusCode)
+}
+
+func oauthErrorToNewError(e *user_model.OAuthError) *error_handler.NewError {
+	if e == nil {
+		return nil
+	}
+	return &error_handler.NewError{Error: e.Code + ": " + e.Description, StatusCode: e.StatusCode}
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// The function reports whether every value of `values` is in `of`.
+func subset(values, of []string) bool {
+	for _, v := range values {
+		if !contains(of, v) {
+			return false
+		}
+	}
+	return true
+}
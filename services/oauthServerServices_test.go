@@ -0,0 +1,488 @@
+package user_services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	user_model "github.com/http-crud/api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const testRedirectURI = "https://app.example.com/callback"
+
+// The function registers a client and removes it with its codes, tokens and consents after the test.
+func registerTestOAuthClient(t *testing.T, confidential bool, grants ...string) *user_model.OAuthClientRegistrationResponse {
+	t.Helper()
+	ctx := context.Background()
+
+	client, e := RegisterOAuthClient(ctx, primitive.NewObjectID(), user_model.OAuthClient{
+		Name:         "Test app",
+		RedirectURIs: []string{testRedirectURI, "http://localhost:3000/callback"},
+		GrantTypes:   grants,
+		Scopes:       []string{user_model.ScopeUserRead, user_model.ScopeUserWrite},
+		Confidential: confidential,
+	})
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+
+	t.Cleanup(func() {
+		oauthClients.DeleteOne(ctx, bson.M{"_id": client.ID})
+		oauthCodes.DeleteMany(ctx, bson.M{"clientId": client.ID})
+		oauthTokens.DeleteMany(ctx, bson.M{"clientId": client.ID})
+		oauthConsents.DeleteMany(ctx, bson.M{"clientId": client.ID})
+	})
+	return client
+}
+
+// The function approves an authorization request of `client` for `userID` with the PKCE challenge of
+// `verifier` and returns the authorization code.
+func authorizeTestOAuthClient(t *testing.T, client *user_model.OAuthClientRegistrationResponse, userID primitive.ObjectID, verifier string, scopes ...string) string {
+	t.Helper()
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	res, e := DecideOAuthAuthorization(context.Background(), userID, &user_model.OAuthAuthorizationRequest{
+		ClientID:            client.ID,
+		RedirectURI:         testRedirectURI,
+		Scopes:              scopes,
+		State:               "state-1",
+		CodeChallenge:       base64.RawURLEncoding.EncodeToString(challenge[:]),
+		CodeChallengeMethod: "S256",
+	}, true)
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+
+	redirect, err := url.Parse(res.RedirectTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redirect.Query().Get("state") != "state-1" || redirect.Query().Get("code") == "" {
+		t.Fatalf("redirect = %v", res.RedirectTo)
+	}
+	return redirect.Query().Get("code")
+}
+
+func assertOAuthError(t *testing.T, e *user_model.OAuthError, code string, status int) {
+	t.Helper()
+
+	if e == nil || e.Code != code || e.StatusCode != status {
+		t.Fatalf("err = %+v, want %v %d", e, code, status)
+	}
+}
+
+// The function introspects `token` as a confidential resource server and returns whether it is active.
+func tokenActive(t *testing.T, resourceServer *user_model.OAuthClientRegistrationResponse, token string) bool {
+	t.Helper()
+
+	res, e := IntrospectOAuthToken(context.Background(), resourceServer.ID, resourceServer.ClientSecret, token)
+	if e != nil {
+		t.Fatalf("introspection: %+v", e)
+	}
+	return res.Active
+}
+
+func TestExchangeOAuthAuthorizationCode(t *testing.T) {
+	requireMongo(t)
+	ctx := context.Background()
+
+	client := registerTestOAuthClient(t, false)
+	userID := primitive.NewObjectID()
+	verifier := randomString()
+
+	exchange := func(code, redirectURI, verifier string) (*user_model.OAuthTokenResponse, *user_model.OAuthError) {
+		return ExchangeOAuthToken(ctx, &user_model.OAuthTokenRequest{
+			GrantType:    user_model.GrantTypeAuthorizationCode,
+			Code:         code,
+			RedirectURI:  redirectURI,
+			CodeVerifier: verifier,
+			ClientID:     client.ID,
+		})
+	}
+
+	// A public client is identified by its id alone and gets a refresh token with the access token.
+	code := authorizeTestOAuthClient(t, client, userID, verifier, user_model.ScopeUserRead)
+	res, e := exchange(code, testRedirectURI, verifier)
+	if e != nil {
+		t.Fatalf("%+v", e)
+	}
+	if res.AccessToken == "" || res.RefreshToken == "" || res.TokenType != "Bearer" || res.Scope != user_model.ScopeUserRead {
+		t.Fatalf("token response = %+v", res)
+	}
+
+	// The code can only be exchanged once.
+	_, e = exchange(code, testRedirectURI, verifier)
+	assertOAuthError(t, e, "invalid_grant", http.StatusBadRequest)
+
+	for _, tc := range []struct {
+		name        string
+		redirectURI string
+		verifier    string
+	}{
+		{"wrong verifier", testRedirectURI, randomString()},
+		{"missing verifier", testRedirectURI, ""},
+		// The code challenge itself isn't a verifier.
+		{"challenge as verifier", testRedirectURI, func() string {
+			challenge := sha256.Sum256([]byte(verifier))
+			return base64.RawURLEncoding.EncodeToString(challenge[:])
+		}()},
+		{"other registered redirect uri", "http://localhost:3000/callback", verifier},
+		{"missing redirect uri", "", verifier},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code := authorizeTestOAuthClient(t, client, userID, verifier)
+
+			_, e := exchange(code, tc.redirectURI, tc.verifier)
+			assertOAuthError(t, e, "invalid_grant", http.StatusBadRequest)
+
+			// A failed exchange uses the code up too, so it can't be retried with guesses.
+			_, e = exchange(code, testRedirectURI, verifier)
+			assertOAuthError(t, e, "invalid_grant", http.StatusBadRequest)
+		})
+	}
+
+	t.Run("code of another client", func(t *testing.T) {
+		other := registerTestOAuthClient(t, false)
+		code := authorizeTestOAuthClient(t, other, userID, verifier)
+
+		_, e := exchange(code, testRedirectURI, verifier)
+		assertOAuthError(t, e, "invalid_grant", http.StatusBadRequest)
+	})
+
+	t.Run("expired code", func(t *testing.T) {
+		code := authorizeTestOAuthClient(t, client, userID, verifier)
+		if _, err := oauthCodes.UpdateOne(ctx, bson.M{"_id": hashToken(code)}, bson.M{"$set": bson.M{"expiresAt": time.Now().UTC().Add(-time.Second)}}); err != nil {
+			t.Fatal(err)
+		}
+
+		_, e := exchange(code, testRedirectURI, verifier)
+		assertOAuthError(t, e, "invalid_grant", http.StatusBadRequest)
+	})
+}
+
+func TestExchangeOAuthTokenClientAuthentication(t *testing.T) {
+	requireMongo(t)
+	ctx := context.Background()
+
+	confidential := registerTestOAuthClient(t, true)
+	if confidential.ClientSecret == "" {
+		t.Fatal("a confidential client was registered without a secret")
+	}
+	userID := primitive.NewObjectID()
+	verifier := randomString()
+
+	for _, tc := range []struct {
+		name     string
+		clientID string
+		secret   string
+	}{
+		{"missing client id", "", confidential.ClientSecret},
+		{"unknown client", "unknown", confidential.ClientSecret},
+		{"missing secret", confidential.ID, ""},
+		{"wrong secret", confidential.ID, randomString()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code := authorizeTestOAuthClient(t, confidential, userID, verifier)
+
+			_, e := ExchangeOAuthToken(ctx, &user_model.OAuthTokenRequest{
+				GrantType:    user_model.GrantTypeAuthorizationCode,
+				Code:         code,
+				RedirectURI:  testRedirectURI,
+				CodeVerifier: verifier,
+				ClientID:     tc.clientID,
+				ClientSecret: tc.secret,
+			})
+			assertOAuthError(t, e, "invalid_client", http.StatusUnauthorized)
+		})
+	}
+
+	code := authorizeTestOAuthClient(t, confidential, userID, verifier)
+	if _, e := ExchangeOAuthToken(ctx, &user_model.OAuthTokenRequest{
+		GrantType:    user_model.GrantTypeAuthorizationCode,
+		Code:         code,
+		RedirectURI:  testRedirectURI,
+		CodeVerifier: verifier,
+		ClientID:     confidential.ID,
+		ClientSecret: confidential.ClientSecret,
+	}); e != nil {
+		t.Fatalf("%+v", e)
+	}
+
+	// A grant the client didn't register is refused before anything else.
+	_, e := ExchangeOAuthToken(ctx, &user_model.OAuthTokenRequest{
+		GrantType:    user_model.GrantTypeClientCredentials,
+		ClientID:     confidential.ID,
+		ClientSecret: confidential.ClientSecret,
+	})
+	assertOAuthError(t, e, "unauthorized_client", http.StatusBadRequest)
+}
+
+func TestExchangeOAuthRefreshToken(t *testing.T) {
+	requireMongo(t)
+	ctx := context.Background()
+
+	client := registerTestOAuthClient(t, false)
+	resourceServer := registerTestOAuthClient(t, true, user_model.GrantTypeClientCredentials)
+	verifier := randomString()
+
+	first, e := ExchangeOAuthToken(ctx, &user_model.OAuthTokenRequest{
+		GrantType:    user_model.GrantTypeAuthorizationCode,
+		Code:         authorizeTestOAuthClient(t, client, primitive.NewObjectID(), verifier),
+		RedirectURI:  testRedirectURI,
+		CodeVerifier: verifier,
+		ClientID:     client.ID,
+	})
+	if e != nil {
+		t.Fatalf("%+v", e)
+	}
+
+	refresh := func(token string, scopes ...string) (*user_model.OAuthTokenResponse, *user_model.OAuthError) {
+		return ExchangeOAuthToken(ctx, &user_model.OAuthTokenRequest{
+			GrantType:    user_model.GrantTypeRefreshToken,
+			RefreshToken: token,
+			Scopes:       scopes,
+			ClientID:     client.ID,
+		})
+	}
+
+	// A refresh token may ask for fewer scopes, never for more.
+	_, e = refresh(first.RefreshToken, user_model.ScopeUserDelete)
+	assertOAuthError(t, e, "invalid_scope", http.StatusBadRequest)
+
+	// The token was used by the failed request, which counts as a rotation. Start again.
+	first, e = ExchangeOAuthToken(ctx, &user_model.OAuthTokenRequest{
+		GrantType:    user_model.GrantTypeAuthorizationCode,
+		Code:         authorizeTestOAuthClient(t, client, primitive.NewObjectID(), verifier),
+		RedirectURI:  testRedirectURI,
+		CodeVerifier: verifier,
+		ClientID:     client.ID,
+	})
+	if e != nil {
+		t.Fatalf("%+v", e)
+	}
+
+	second, e := refresh(first.RefreshToken, user_model.ScopeUserRead)
+	if e != nil {
+		t.Fatalf("%+v", e)
+	}
+	if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken || second.Scope != user_model.ScopeUserRead {
+		t.Fatalf("refreshed = %+v", second)
+	}
+	if tokenActive(t, resourceServer, first.RefreshToken) {
+		t.Fatal("the rotated refresh token is still active")
+	}
+	if !tokenActive(t, resourceServer, second.AccessToken) || !tokenActive(t, resourceServer, first.AccessToken) {
+		t.Fatal("a rotation revoked the access tokens")
+	}
+
+	// The refresh token of another client doesn't work, even for a client that knows it.
+	other := registerTestOAuthClient(t, false)
+	_, e = ExchangeOAuthToken(ctx, &user_model.OAuthTokenRequest{
+		GrantType:    user_model.GrantTypeRefreshToken,
+		RefreshToken: second.RefreshToken,
+		ClientID:     other.ID,
+	})
+	assertOAuthError(t, e, "invalid_grant", http.StatusBadRequest)
+
+	// Presenting a rotated token again means it leaked: every token of the grant is revoked.
+	_, e = refresh(first.RefreshToken)
+	assertOAuthError(t, e, "invalid_grant", http.StatusBadRequest)
+
+	for _, token := range []string{first.AccessToken, second.AccessToken, second.RefreshToken} {
+		if tokenActive(t, resourceServer, token) {
+			t.Fatal("a token of a replayed grant is still active")
+		}
+	}
+	_, e = refresh(second.RefreshToken)
+	assertOAuthError(t, e, "invalid_grant", http.StatusBadRequest)
+
+	_, e = refresh("ort_unknown")
+	assertOAuthError(t, e, "invalid_grant", http.StatusBadRequest)
+
+	// An access token isn't a refresh token.
+	_, e = refresh(second.AccessToken)
+	assertOAuthError(t, e, "invalid_grant", http.StatusBadRequest)
+}
+
+func TestExchangeOAuthClientCredentials(t *testing.T) {
+	requireMongo(t)
+	ctx := context.Background()
+
+	client := registerTestOAuthClient(t, true, user_model.GrantTypeClientCredentials)
+
+	res, e := ExchangeOAuthToken(ctx, &user_model.OAuthTokenRequest{
+		GrantType:    user_model.GrantTypeClientCredentials,
+		ClientID:     client.ID,
+		ClientSecret: client.ClientSecret,
+	})
+	if e != nil {
+		t.Fatalf("%+v", e)
+	}
+	if res.AccessToken == "" || res.RefreshToken != "" || res.Scope != user_model.ScopeUserRead+" "+user_model.ScopeUserWrite {
+		t.Fatalf("token response = %+v", res)
+	}
+
+	introspection, e := IntrospectOAuthToken(ctx, client.ID, client.ClientSecret, res.AccessToken)
+	if e != nil {
+		t.Fatalf("%+v", e)
+	}
+	if !introspection.Active || introspection.Subject != "" || introspection.ClientID != client.ID {
+		t.Fatalf("introspection = %+v", introspection)
+	}
+
+	_, e = ExchangeOAuthToken(ctx, &user_model.OAuthTokenRequest{
+		GrantType:    user_model.GrantTypeClientCredentials,
+		Scopes:       []string{user_model.ScopeUserDelete},
+		ClientID:     client.ID,
+		ClientSecret: client.ClientSecret,
+	})
+	assertOAuthError(t, e, "invalid_scope", http.StatusBadRequest)
+
+	// Public clients can't even register the grant.
+	if _, e := RegisterOAuthClient(ctx, primitive.NewObjectID(), user_model.OAuthClient{
+		Name:       "Public app",
+		GrantTypes: []string{user_model.GrantTypeClientCredentials},
+		Scopes:     []string{user_model.ScopeUserRead},
+	}); e == nil || e.StatusCode != http.StatusBadRequest {
+		t.Fatalf("err = %+v, want 400", e)
+	}
+}
+
+func TestIntrospectOAuthToken(t *testing.T) {
+	requireMongo(t)
+	ctx := context.Background()
+
+	client := registerTestOAuthClient(t, false)
+	resourceServer := registerTestOAuthClient(t, true, user_model.GrantTypeClientCredentials)
+	userID := primitive.NewObjectID()
+	verifier := randomString()
+
+	tokens, e := ExchangeOAuthToken(ctx, &user_model.OAuthTokenRequest{
+		GrantType:    user_model.GrantTypeAuthorizationCode,
+		Code:         authorizeTestOAuthClient(t, client, userID, verifier, user_model.ScopeUserRead),
+		RedirectURI:  testRedirectURI,
+		CodeVerifier: verifier,
+		ClientID:     client.ID,
+	})
+	if e != nil {
+		t.Fatalf("%+v", e)
+	}
+
+	res, e := IntrospectOAuthToken(ctx, resourceServer.ID, resourceServer.ClientSecret, tokens.AccessToken)
+	if e != nil {
+		t.Fatalf("%+v", e)
+	}
+	if !res.Active || res.Subject != userID.Hex() || res.ClientID != client.ID || res.Scope != user_model.ScopeUserRead || res.TokenType != "Bearer" || res.ExpiresAt <= time.Now().Unix() {
+		t.Fatalf("introspection = %+v", res)
+	}
+
+	res, e = IntrospectOAuthToken(ctx, resourceServer.ID, resourceServer.ClientSecret, tokens.RefreshToken)
+	if e != nil {
+		t.Fatalf("%+v", e)
+	}
+	if !res.Active || res.TokenType != user_model.OAuthTokenRefresh {
+		t.Fatalf("introspection of the refresh token = %+v", res)
+	}
+
+	// Unknown and expired tokens are inactive, and nothing else is said about them.
+	if _, err := oauthTokens.UpdateOne(ctx, bson.M{"_id": hashToken(tokens.RefreshToken)}, bson.M{"$set": bson.M{"expiresAt": time.Now().UTC().Add(-time.Second)}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"oat_unknown", tokens.RefreshToken} {
+		res, e := IntrospectOAuthToken(ctx, resourceServer.ID, resourceServer.ClientSecret, token)
+		if e != nil {
+			t.Fatalf("%+v", e)
+		}
+		if *res != (user_model.OAuthIntrospectionResponse{Active: false}) {
+			t.Fatalf("introspection = %+v, want only inactive", res)
+		}
+	}
+
+	// Only an authenticated confidential client may introspect.
+	_, e = IntrospectOAuthToken(ctx, client.ID, "", tokens.AccessToken)
+	assertOAuthError(t, e, "unauthorized_client", http.StatusUnauthorized)
+
+	_, e = IntrospectOAuthToken(ctx, resourceServer.ID, randomString(), tokens.AccessToken)
+	assertOAuthError(t, e, "invalid_client", http.StatusUnauthorized)
+}
+
+func TestRevokeOAuthToken(t *testing.T) {
+	requireMongo(t)
+	ctx := context.Background()
+
+	client := registerTestOAuthClient(t, false)
+	other := registerTestOAuthClient(t, false)
+	resourceServer := registerTestOAuthClient(t, true, user_model.GrantTypeClientCredentials)
+	verifier := randomString()
+
+	grant := func() *user_model.OAuthTokenResponse {
+		t.Helper()
+
+		res, e := ExchangeOAuthToken(ctx, &user_model.OAuthTokenRequest{
+			GrantType:    user_model.GrantTypeAuthorizationCode,
+			Code:         authorizeTestOAuthClient(t, client, primitive.NewObjectID(), verifier),
+			RedirectURI:  testRedirectURI,
+			CodeVerifier: verifier,
+			ClientID:     client.ID,
+		})
+		if e != nil {
+			t.Fatalf("%+v", e)
+		}
+		return res
+	}
+
+	// Revoking an access token leaves the refresh token of its grant alone.
+	tokens := grant()
+	if e := RevokeOAuthToken(ctx, client.ID, "", tokens.AccessToken); e != nil {
+		t.Fatalf("%+v", e)
+	}
+	if tokenActive(t, resourceServer, tokens.AccessToken) || !tokenActive(t, resourceServer, tokens.RefreshToken) {
+		t.Fatal("revoking the access token didn't revoke just the access token")
+	}
+
+	// Revoking a refresh token revokes the access tokens of its grant too.
+	refreshed, e := ExchangeOAuthToken(ctx, &user_model.OAuthTokenRequest{
+		GrantType:    user_model.GrantTypeRefreshToken,
+		RefreshToken: tokens.RefreshToken,
+		ClientID:     client.ID,
+	})
+	if e != nil {
+		t.Fatalf("%+v", e)
+	}
+	untouched := grant()
+
+	if e := RevokeOAuthToken(ctx, client.ID, "", refreshed.RefreshToken); e != nil {
+		t.Fatalf("%+v", e)
+	}
+	if tokenActive(t, resourceServer, refreshed.AccessToken) || tokenActive(t, resourceServer, refreshed.RefreshToken) {
+		t.Fatal("a token of the revoked grant is still active")
+	}
+	if !tokenActive(t, resourceServer, untouched.AccessToken) {
+		t.Fatal("revoking a grant revoked the tokens of another one")
+	}
+
+	// A client can't revoke the tokens of another client, and unknown tokens aren't an error.
+	for _, token := range []string{untouched.AccessToken, "oat_unknown"} {
+		if e := RevokeOAuthToken(ctx, other.ID, "", token); e != nil {
+			t.Fatalf("%+v", e)
+		}
+	}
+	if !tokenActive(t, resourceServer, untouched.AccessToken) {
+		t.Fatal("another client revoked the token")
+	}
+
+	// Revoking twice is fine.
+	if e := RevokeOAuthToken(ctx, client.ID, "", refreshed.RefreshToken); e != nil {
+		t.Fatalf("%+v", e)
+	}
+
+	e = RevokeOAuthToken(ctx, resourceServer.ID, "", untouched.AccessToken)
+	assertOAuthError(t, e, "invalid_client", http.StatusUnauthorized)
+}
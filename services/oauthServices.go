@@ -0,0 +1,283 @@
+package user_services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/http-crud/api/database"
+	"github.com/http-crud/api/identity"
+	"github.com/http-crud/api/metrics"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/tracing"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/oauth2"
+)
+
+const oauthLoginStateTTL = 10 * time.Minute
+
+// This is a set of functions for logging in with an external identity provider using the
+// authorization code flow with PKCE.
+var (
+	oauthLoginStates   *mongo.Collection = database.OpenCollection(*database.Client, "oauth_login_states")
+	externalIdentities *mongo.Collection = database.OpenCollection(*database.Client, "external_identities")
+)
+
+// The function starts a login with `provider`. It stores the state, nonce and PKCE verifier and
+// returns the URL to redirect the user to, along with the state so the caller can bind it to the
+// browser.
+func StartOAuthLogin(ctx context.Context, provider string) (authURL string, state string, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.StartOAuthLogin")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "oauth_login")
+	defer cancel()
+
+	p, err := identity.Lookup(ctx, provider)
+
+	if errors.Is(err, identity.ErrUnknownProvider) {
+		return "", "", &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusNotFound,
+		}
+	}
+
+	if err != nil {
+		return "", "", &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusBadGateway,
+		}
+	}
+
+	state = randomString()
+
+	loginState := user_model.OAuthLoginState{
+		ID:        hashToken(state),
+		Provider:  p.Name,
+		Nonce:     randomString(),
+		Verifier:  oauth2.GenerateVerifier(),
+		ExpiresAt: time.Now().Add(oauthLoginStateTTL).UTC(),
+	}
+
+	done := metrics.ObserveMongo("oauth_login_states", "InsertOne")
+	_, err = oauthLoginStates.InsertOne(ctx, loginState)
+	done(err)
+
+	if err != nil {
+		return "", "", dbError(ctx, "StartOAuthLogin", err, http.StatusInternalServerError)
+	}
+
+	return p.AuthCodeURL(state, loginState.Nonce, loginState.Verifier), state, nil
+}
+
+// The function completes a login started by `StartOAuthLogin`. The state is consumed so it can only be
+// used once. The external identity is linked to the user it was linked to before, or else to the user
+// with the same verified email; a new user is created when there is none and `OAUTH_ALLOW_SIGNUP`
+// isn't false. A user with two-step login on gets an MFA challenge instead of the tokens.
+func CompleteOAuthLogin(ctx context.Context, state, code string) (res *user_model.UserLoginResponse, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.CompleteOAuthLogin")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "oauth_callback")
+	defer cancel()
+
+	var loginState user_model.OAuthLoginState
+
+	filter := bson.M{"_id": hashToken(state), "expiresAt": bson.M{"$gt": time.Now().UTC()}}
+
+	done := metrics.ObserveMongo("oauth_login_states", "FindOneAndDelete")
+	err := oauthLoginStates.FindOneAndDelete(ctx, filter).Decode(&loginState)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		metrics.ObserveLogin(false)
+		return nil, &error_handler.NewError{
+			Error:      "invalid or expired state",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	if err != nil {
+		return nil, dbError(ctx, "CompleteOAuthLogin", err, http.StatusInternalServerError)
+	}
+
+	p, err := identity.Lookup(ctx, loginState.Provider)
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusBadGateway,
+		}
+	}
+
+	ident, err := p.Exchange(ctx, code, loginState.Verifier, loginState.Nonce)
+
+	if err != nil {
+		metrics.ObserveLogin(false)
+		return nil, &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	user, e := linkExternalIdentity(ctx, ident)
+
+	if e != nil {
+		metrics.ObserveLogin(false)
+		return nil, e
+	}
+
+	return loginOrChallenge(ctx, user)
+}
+
+func linkExternalIdentity(ctx context.Context, ident *identity.Identity) (*user_model.User, *error_handler.NewError) {
+	now := time.Now().UTC()
+	var link user_model.ExternalIdentity
+	var user user_model.User
+
+	filter := bson.M{"provider": ident.Provider, "subject": ident.Subject}
+	update := bson.M{"$set": bson.M{"lastLoginAt": now}}
+
+	done := metrics.ObserveMongo("external_identities", "FindOneAndUpdate")
+	err := externalIdentities.FindOneAndUpdate(ctx, filter, update).Decode(&link)
+	done(err)
+
+	if err == nil {
+		return linkedUser(ctx, link.UserID)
+	}
+
+	if err != mongo.ErrNoDocuments {
+		return nil, dbError(ctx, "CompleteOAuthLogin", err, http.StatusInternalServerError)
+	}
+
+	// An unverified email could belong to someone else, so it is never used to link or create an
+	// account.
+	if ident.Email == "" || !ident.EmailVerified {
+		return nil, &error_handler.NewError{
+			Error:      "the provider did not return a verified email",
+			StatusCode: http.StatusForbidden,
+		}
+	}
+
+	done = metrics.ObserveMongo("users", "FindOne")
+	err = users.FindOne(ctx, bson.M{"email": ident.Email}, byEmail()).Decode(&user)
+	done(err)
+
+	switch {
+	case err == mongo.ErrNoDocuments:
+		if allow, err := strconv.ParseBool(os.Getenv("OAUTH_ALLOW_SIGNUP")); err == nil && !allow {
+			return nil, &error_handler.NewError{
+				Error:      "no account exists for this email",
+				StatusCode: http.StatusForbidden,
+			}
+		}
+
+		// Users created here have no password; they log in through the provider.
+		user = user_model.User{
+			ID:        primitive.NewObjectID(),
+			Name:      ident.Name,
+			Email:     ident.Email,
+			Role:      user_model.RoleUser,
+			CreatedAt: now,
+			UpdatedAt: now,
+			Version:   1,
+		}
+
+		done := metrics.ObserveMongo("users", "InsertOne")
+		_, err = users.InsertOne(ctx, user)
+		done(err)
+
+		if err != nil {
+			metrics.ObserveRegistration(false)
+			return nil, dbError(ctx, "CompleteOAuthLogin", err, http.StatusInternalServerError)
+		}
+		metrics.ObserveRegistration(true)
+	case err != nil:
+		return nil, dbError(ctx, "CompleteOAuthLogin", err, http.StatusInternalServerError)
+	case user.DeletedAt != nil:
+		// The email stays taken until the deleted account is purged.
+		return nil, &error_handler.NewError{
+			Error:      "the account for this email has been deleted",
+			StatusCode: http.StatusForbidden,
+		}
+	}
+
+	link = user_model.ExternalIdentity{
+		ID:          primitive.NewObjectID(),
+		UserID:      user.ID,
+		Provider:    ident.Provider,
+		Subject:     ident.Subject,
+		Email:       ident.Email,
+		LinkedAt:    now,
+		LastLoginAt: now,
+	}
+
+	done = metrics.ObserveMongo("external_identities", "InsertOne")
+	_, err = externalIdentities.InsertOne(ctx, link)
+	done(err)
+
+	// Two callbacks of the same identity raced and the other one linked it first.
+	if mongo.IsDuplicateKeyError(err) {
+		done := metrics.ObserveMongo("external_identities", "FindOne")
+		err = externalIdentities.FindOne(ctx, filter).Decode(&link)
+		done(err)
+
+		if err == nil {
+			return linkedUser(ctx, link.UserID)
+		}
+	}
+	if err != nil {
+		return nil, dbError(ctx, "CompleteOAuthLogin", err, http.StatusInternalServerError)
+	}
+
+	return &user, nil
+}
+
+// The function returns the active user an external identity is linked to.
+func linkedUser(ctx context.Context, userID primitive.ObjectID) (*user_model.User, *error_handler.NewError) {
+	var user user_model.User
+
+	done := metrics.ObserveMongo("users", "FindOne")
+	err := users.FindOne(ctx, activeUser(bson.M{"_id": userID})).Decode(&user)
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "CompleteOAuthLogin", err, http.StatusUnauthorized)
+	}
+	return &user, nil
+}
+
+// The function returns the options to find a user by email. Stored emails keep the case they were
+// registered with, so they are matched without regard to case.
+func byEmail() *options.FindOneOptions {
+	return options.FindOne().SetCollation(&options.Collation{Locale: "en", Strength: 2})
+}
+
+// The function creates the indexes of the external identities. An identity of a provider can only be
+// linked to one user, even when two logins with it complete at the same time.
+func EnsureOAuthIndexes(ctx context.Context) error {
+	ctx, cancel := withOperationTimeout(ctx, "create_indexes")
+	defer cancel()
+
+	_, err := externalIdentities.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "provider", Value: 1}, {Key: "subject", Value: 1}},
+		Options: options.Index().SetName("provider_subject_unique").SetUnique(true),
+	})
+	return err
+}
+
+// The function returns 32 random bytes encoded for use in URLs.
+func randomString() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,99 @@
+package user_services
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/http-crud/api/identity"
+	user_model "github.com/http-crud/api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLinkExternalIdentity(t *testing.T) {
+	requireMongo(t)
+	ctx := context.Background()
+
+	if err := EnsureOAuthIndexes(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stored email keeps the case it was registered with.
+	existing := user_model.User{
+		ID:        primitive.NewObjectID(),
+		Name:      "Jane",
+		Email:     "Jane." + primitive.NewObjectID().Hex() + "@Example.com",
+		Role:      user_model.RoleUser,
+		CreatedAt: time.Now().UTC(),
+		UpdatedAt: time.Now().UTC(),
+		Version:   1,
+	}
+	if _, err := users.InsertOne(ctx, existing); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := "mock-" + primitive.NewObjectID().Hex()
+	t.Cleanup(func() {
+		users.DeleteOne(ctx, bson.M{"_id": existing.ID})
+		externalIdentities.DeleteMany(ctx, bson.M{"provider": provider})
+	})
+
+	ident := &identity.Identity{
+		Provider:      provider,
+		Subject:       "subject-1",
+		Email:         strings.ToLower(existing.Email),
+		EmailVerified: true,
+	}
+
+	user, e := linkExternalIdentity(ctx, ident)
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+	if user.ID != existing.ID {
+		t.Fatalf("linked to %v, want the user with the same email %v", user.ID, existing.ID)
+	}
+
+	// Once linked, the identity logs into the same user even when the provider reports another email.
+	ident.Email = "someone.else@example.com"
+	user, e = linkExternalIdentity(ctx, ident)
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+	if user.ID != existing.ID {
+		t.Fatalf("linked to %v, want %v", user.ID, existing.ID)
+	}
+
+	count, err := externalIdentities.CountDocuments(ctx, bson.M{"provider": provider, "subject": "subject-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("%d links of the identity, want 1", count)
+	}
+
+	// The unique index keeps a second link of the same identity out.
+	if _, err := externalIdentities.InsertOne(ctx, user_model.ExternalIdentity{
+		ID:       primitive.NewObjectID(),
+		UserID:   primitive.NewObjectID(),
+		Provider: provider,
+		Subject:  "subject-1",
+	}); err == nil {
+		t.Fatal("a second link of the identity was stored")
+	}
+}
+
+func TestLinkExternalIdentityRequiresVerifiedEmail(t *testing.T) {
+	requireMongo(t)
+
+	_, e := linkExternalIdentity(context.Background(), &identity.Identity{
+		Provider: "mock-" + primitive.NewObjectID().Hex(),
+		Subject:  "subject-1",
+		Email:    "jane@example.com",
+	})
+	if e == nil || e.StatusCode != http.StatusForbidden {
+		t.Fatalf("err = %+v, want 403", e)
+	}
+}
@@ -0,0 +1,501 @@
+package user_services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/http-crud/api/database"
+	"github.com/http-crud/api/helpers"
+	"github.com/http-crud/api/metrics"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/sms"
+	"github.com/http-crud/api/tracing"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// This is a set of functions to verify the phone of a user with codes sent by text message, and to use
+// the verified phone to log in and as the second step of a login. Codes are valid for `PHONE_CODE_TTL`
+// (default 10m) and allow `PHONE_CODE_MAX_ATTEMPTS` wrong guesses (default 5). At most
+// `PHONE_CODE_RATE_LIMIT` codes (default 5) are sent to a number in `PHONE_CODE_RATE_WINDOW`
+// (default 1h).
+var phoneCodes *mongo.Collection = database.OpenCollection(*database.Client, "phone_codes")
+
+// `PhoneCodeDigits` is the length of the codes sent by text message.
+const PhoneCodeDigits = 6
+
+// The function texts a code to the phone of the user with `userID` to verify it. The phone is set with
+// the profile fields and must not be verified yet, by them or by another user.
+func SendPhoneVerification(ctx context.Context, userID primitive.ObjectID) (e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.SendPhoneVerification")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "phone_code")
+	defer cancel()
+
+	user, e := findActiveUser(ctx, userID)
+
+	if e != nil {
+		return e
+	}
+
+	switch {
+	case user.Phone == "":
+		return &error_handler.NewError{
+			Error:      "add a phone to your profile first",
+			StatusCode: http.StatusConflict,
+			Field:      "phone",
+		}
+	case user.PhoneVerifiedAt != nil:
+		return &error_handler.NewError{
+			Error:      "the phone is already verified",
+			StatusCode: http.StatusConflict,
+			Field:      "phone",
+		}
+	}
+
+	if e := phoneAvailable(ctx, user.Phone, userID); e != nil {
+		return e
+	}
+
+	sender, e := smsSender()
+
+	if e != nil {
+		return e
+	}
+
+	code, e := sendPhoneCode(ctx, user, user_model.PhoneCodeVerify, "")
+
+	if e != nil {
+		return e
+	}
+
+	return textPhoneCode(ctx, sender, user.Phone, fmt.Sprintf("Your verification code is %s. It expires in %v.", code, phoneCodeTTL()))
+}
+
+// The function verifies the phone of the user with `userID` with the code texted to it. A phone
+// changed since the code was sent stays unverified.
+func ConfirmPhone(ctx context.Context, userID primitive.ObjectID, code string) (res *user_model.User, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.ConfirmPhone")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "phone_code")
+	defer cancel()
+
+	user, e := findActiveUser(ctx, userID)
+
+	if e != nil {
+		return nil, e
+	}
+
+	filter := bson.M{"userId": userID, "purpose": user_model.PhoneCodeVerify, "phone": user.Phone}
+
+	if _, e := usePhoneCode(ctx, filter, code); e != nil {
+		return nil, e
+	}
+
+	now := time.Now().UTC()
+	update := bson.M{
+		"$set": bson.M{"phoneverifiedat": now, "updatedat": now},
+		"$inc": bson.M{"version": 1},
+	}
+	userFilter := bson.M{"_id": userID, "phone": user.Phone, "phoneverifiedat": bson.M{"$exists": false}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var verified user_model.User
+
+	done := metrics.ObserveMongo("users", "FindOneAndUpdate")
+	err := users.FindOneAndUpdate(ctx, activeUser(userFilter), update, opts).Decode(&verified)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, &error_handler.NewError{
+			Error:      "the phone has changed since the code was sent",
+			StatusCode: http.StatusConflict,
+			Field:      "phone",
+		}
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, phoneTaken()
+	}
+	if err != nil {
+		return nil, dbError(ctx, "ConfirmPhone", err, http.StatusInternalServerError)
+	}
+
+	recordAudit(ctx, user_model.AuditEvent{
+		Action:  user_model.AuditPhoneVerified,
+		UserID:  &userID,
+		Changes: map[string]user_model.AuditChange{"phone": {Before: nil, After: verified.Phone}},
+	})
+
+	return &verified, nil
+}
+
+// The function turns the two-step login of the user with `userID` on or off. The user confirms it like
+// an erasure, with their password or, without one, with their email. It can only be turned on with a
+// verified phone, where the login codes are sent.
+func SetMFA(ctx context.Context, userID primitive.ObjectID, enabled bool, password, confirm string) (res *user_model.User, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.SetMFA")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "update_user")
+	defer cancel()
+
+	user, e := findActiveUser(ctx, userID)
+
+	if e != nil {
+		return nil, e
+	}
+
+	if e := confirmAccountOwner(user, password, confirm); e != nil {
+		return nil, e
+	}
+
+	filter := bson.M{"_id": userID}
+	set := bson.M{"updatedat": time.Now().UTC()}
+	update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	action := user_model.AuditMFADisabled
+
+	if enabled {
+		if user.PhoneVerifiedAt == nil {
+			return nil, &error_handler.NewError{
+				Error:      "verify your phone first",
+				StatusCode: http.StatusConflict,
+				Field:      "phone",
+			}
+		}
+		// Users would be locked out if the login codes can't be sent.
+		if _, e := smsSender(); e != nil {
+			return nil, e
+		}
+		filter["phoneverifiedat"] = bson.M{"$exists": true}
+		set["mfaenabled"] = true
+		action = user_model.AuditMFAEnabled
+	} else {
+		update["$unset"] = bson.M{"mfaenabled": ""}
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated user_model.User
+
+	done := metrics.ObserveMongo("users", "FindOneAndUpdate")
+	err := users.FindOneAndUpdate(ctx, activeUser(filter), update, opts).Decode(&updated)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, &error_handler.NewError{
+			Error:      "the phone has changed, verify it again",
+			StatusCode: http.StatusConflict,
+			Field:      "phone",
+		}
+	}
+	if err != nil {
+		return nil, dbError(ctx, "SetMFA", err, http.StatusInternalServerError)
+	}
+
+	if user.MFAEnabled != enabled {
+		recordAudit(ctx, user_model.AuditEvent{
+			Action: action,
+			UserID: &userID,
+		})
+	}
+
+	return &updated, nil
+}
+
+// The function ends the first step of a login. A user with two-step login on gets a code texted to
+// their phone and an MFA token to exchange with it at `CompleteMFALogin`; anyone else is logged in.
+// Passkeys already prove two factors, so their logins don't go through it. Without an SMS sender the
+// login fails rather than skip the second step.
+func loginOrChallenge(ctx context.Context, user *user_model.User) (*user_model.UserLoginResponse, *error_handler.NewError) {
+	if !user.MFAEnabled || user.PhoneVerifiedAt == nil || user.Phone == "" {
+		return loginResponse(ctx, user)
+	}
+
+	sender, e := smsSender()
+
+	if e != nil {
+		metrics.ObserveLogin(false)
+		return nil, e
+	}
+
+	token := randomString()
+
+	code, e := sendPhoneCode(ctx, user, user_model.PhoneCodeMFA, hashToken(token))
+
+	if e != nil {
+		metrics.ObserveLogin(false)
+		return nil, e
+	}
+
+	if e := textPhoneCode(ctx, sender, user.Phone, fmt.Sprintf("Your login code is %s. It expires in %v. Never share it with anyone.", code, phoneCodeTTL())); e != nil {
+		metrics.ObserveLogin(false)
+		return nil, e
+	}
+
+	return &user_model.UserLoginResponse{
+		ID:          user.ID,
+		MFARequired: true,
+		MFAToken:    token,
+	}, nil
+}
+
+// The function completes a two-step login with the MFA token of the first step and the code texted to
+// the user.
+func CompleteMFALogin(ctx context.Context, mfaToken, code string) (res *user_model.UserLoginResponse, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.CompleteMFALogin")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "login")
+	defer cancel()
+
+	phoneCode, e := usePhoneCode(ctx, bson.M{"challengeHash": hashToken(mfaToken), "purpose": user_model.PhoneCodeMFA}, code)
+
+	if e != nil {
+		metrics.ObserveLogin(false)
+		if phoneCode != nil {
+			recordAudit(ctx, user_model.AuditEvent{
+				Action: user_model.AuditUserLoginFailed,
+				UserID: &phoneCode.UserID,
+				Reason: e.Error,
+			})
+		}
+		return nil, e
+	}
+
+	user, e := findActiveUser(ctx, phoneCode.UserID)
+
+	if e != nil {
+		metrics.ObserveLogin(false)
+		return nil, e
+	}
+
+	return loginResponse(ctx, user)
+}
+
+// The function returns the filter of the user logging in with `identifier`, their email or their
+// verified phone.
+func loginFilter(identifier string) bson.M {
+	if isPhoneIdentifier(identifier) {
+		return bson.M{"phone": identifier, "phoneverifiedat": bson.M{"$exists": true}}
+	}
+	return bson.M{"email": identifier}
+}
+
+// Phones are in E.164 format and emails can't start with "+".
+func isPhoneIdentifier(identifier string) bool {
+	return strings.HasPrefix(identifier, "+")
+}
+
+// The function stores a new code for `user` and returns it, or fails with 429 when too many codes were
+// sent to their phone lately. `challengeHash` ties a login code to the MFA token of the login.
+func sendPhoneCode(ctx context.Context, user *user_model.User, purpose, challengeHash string) (string, *error_handler.NewError) {
+	now := time.Now().UTC()
+	limit := helpers.EnvInt("PHONE_CODE_RATE_LIMIT", 5)
+	window := helpers.EnvDuration("PHONE_CODE_RATE_WINDOW", time.Hour)
+
+	// The limit is per number, whoever asks, so the endpoint can't be used to flood a phone.
+	done := metrics.ObserveMongo("phone_codes", "CountDocuments")
+	count, err := phoneCodes.CountDocuments(ctx, bson.M{"phone": user.Phone, "createdAt": bson.M{"$gt": now.Add(-window)}})
+	done(err)
+
+	if err != nil {
+		return "", dbError(ctx, "sendPhoneCode", err, http.StatusInternalServerError)
+	}
+	if count >= limit {
+		return "", &error_handler.NewError{
+			Error:      "too many codes sent to this phone, try again later",
+			StatusCode: http.StatusTooManyRequests,
+		}
+	}
+
+	code, err := randomDigits(PhoneCodeDigits)
+
+	if err != nil {
+		return "", &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	id := primitive.NewObjectID()
+	phoneCode := user_model.PhoneCode{
+		ID:            id,
+		UserID:        user.ID,
+		Purpose:       purpose,
+		Phone:         user.Phone,
+		CodeHash:      hashToken(id.Hex() + code),
+		ChallengeHash: challengeHash,
+		ExpiresAt:     now.Add(phoneCodeTTL()),
+		CreatedAt:     now,
+	}
+
+	done = metrics.ObserveMongo("phone_codes", "InsertOne")
+	_, err = phoneCodes.InsertOne(ctx, phoneCode)
+	done(err)
+
+	if err != nil {
+		return "", dbError(ctx, "sendPhoneCode", err, http.StatusInternalServerError)
+	}
+
+	return code, nil
+}
+
+// The function checks `code` against the latest unused code matching `filter` and consumes it. Every
+// guess counts towards the attempt limit, after which the code can't be used any more. The code found
+// is returned with the error when the guess was wrong, so the caller knows whose it was.
+func usePhoneCode(ctx context.Context, filter bson.M, code string) (*user_model.PhoneCode, *error_handler.NewError) {
+	now := time.Now().UTC()
+	maxAttempts := helpers.EnvInt("PHONE_CODE_MAX_ATTEMPTS", 5)
+
+	filter["usedAt"] = bson.M{"$exists": false}
+	filter["expiresAt"] = bson.M{"$gt": now}
+
+	// Only the latest code counts, so asking for a new one replaces the previous ones.
+	var phoneCode user_model.PhoneCode
+
+	done := metrics.ObserveMongo("phone_codes", "FindOne")
+	err := phoneCodes.FindOne(ctx, filter, options.FindOne().SetSort(bson.M{"_id": -1})).Decode(&phoneCode)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, invalidPhoneCode()
+	}
+	if err != nil {
+		return nil, dbError(ctx, "usePhoneCode", err, http.StatusInternalServerError)
+	}
+
+	// The attempt is counted before the code is compared, so concurrent guesses can't go over the limit.
+	done = metrics.ObserveMongo("phone_codes", "UpdateOne")
+	result, err := phoneCodes.UpdateOne(ctx,
+		bson.M{"_id": phoneCode.ID, "attempts": bson.M{"$lt": maxAttempts}},
+		bson.M{"$inc": bson.M{"attempts": 1}})
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "usePhoneCode", err, http.StatusInternalServerError)
+	}
+	if result.ModifiedCount == 0 {
+		return &phoneCode, &error_handler.NewError{
+			Error:      "too many wrong codes, ask for a new one",
+			StatusCode: http.StatusTooManyRequests,
+		}
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(phoneCode.ID.Hex()+strings.TrimSpace(code))), []byte(phoneCode.CodeHash)) != 1 {
+		return &phoneCode, invalidPhoneCode()
+	}
+
+	done = metrics.ObserveMongo("phone_codes", "UpdateOne")
+	result, err = phoneCodes.UpdateOne(ctx,
+		bson.M{"_id": phoneCode.ID, "usedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"usedAt": now}})
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "usePhoneCode", err, http.StatusInternalServerError)
+	}
+	if result.ModifiedCount == 0 {
+		return nil, invalidPhoneCode()
+	}
+
+	return &phoneCode, nil
+}
+
+// The function returns the configured SMS sender, or fails with 503 when there is none.
+func smsSender() (sms.Sender, *error_handler.NewError) {
+	sender, err := sms.Default()
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      "text messages are disabled: " + err.Error(),
+			StatusCode: http.StatusServiceUnavailable,
+		}
+	}
+	return sender, nil
+}
+
+// The function sends `body` to `phone` with `sender`.
+func textPhoneCode(ctx context.Context, sender sms.Sender, phone, body string) *error_handler.NewError {
+	if err := sender.Send(ctx, sms.Message{To: phone, Body: body}); err != nil {
+		return &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusBadGateway,
+		}
+	}
+	return nil
+}
+
+// The function fails with 409 when `phone` is the verified phone of a user other than `self`.
+func phoneAvailable(ctx context.Context, phone string, self primitive.ObjectID) *error_handler.NewError {
+	filter := bson.M{"phone": phone, "phoneverifiedat": bson.M{"$exists": true}, "_id": bson.M{"$ne": self}}
+
+	done := metrics.ObserveMongo("users", "CountDocuments")
+	count, err := users.CountDocuments(ctx, filter)
+	done(err)
+
+	if err != nil {
+		return dbError(ctx, "phoneAvailable", err, http.StatusInternalServerError)
+	}
+	if count > 0 {
+		return phoneTaken()
+	}
+	return nil
+}
+
+// The function returns the active user with `userID`.
+func findActiveUser(ctx context.Context, userID primitive.ObjectID) (*user_model.User, *error_handler.NewError) {
+	var user user_model.User
+
+	done := metrics.ObserveMongo("users", "FindOne")
+	err := users.FindOne(ctx, activeUser(bson.M{"_id": userID})).Decode(&user)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, userNotFound()
+	}
+	if err != nil {
+		return nil, dbError(ctx, "findActiveUser", err, http.StatusInternalServerError)
+	}
+	return &user, nil
+}
+
+func phoneCodeTTL() time.Duration {
+	return helpers.EnvDuration("PHONE_CODE_TTL", 10*time.Minute)
+}
+
+// The function returns a random code of `n` decimal digits.
+func randomDigits(n int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+
+	v, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", n, v), nil
+}
+
+func invalidPhoneCode() *error_handler.NewError {
+	return &error_handler.NewError{
+		Error:      "invalid or expired code",
+		StatusCode: http.StatusUnauthorized,
+	}
+}
+
+func phoneTaken() *error_handler.NewError {
+	return &error_handler.NewError{
+		Error:      "this phone is already verified by another account",
+		StatusCode: http.StatusConflict,
+		Field:      "phone",
+	}
+}
@@ -0,0 +1,264 @@
+package user_services
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/http-crud/api/helpers"
+	"github.com/http-crud/api/metrics"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/tracing"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// This is a set of functions for the data protection rights of a user: to get a copy of everything
+// stored about them and to have it erased.
+
+// The function collects everything stored about the user with `userID`: the profile, sessions, audit
+// events by or about them, personal access tokens, applications they authorized, passkeys, linked
+// external accounts, and the phone codes and email changes requested for them.
+func ExportUserData(ctx context.Context, userID primitive.ObjectID) (res *user_model.UserDataExport, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.ExportUserData")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "export_user")
+	defer cancel()
+
+	var user user_model.User
+
+	done := metrics.ObserveMongo("users", "FindOne")
+	err := users.FindOne(ctx, activeUser(bson.M{"_id": userID})).Decode(&user)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, userNotFound()
+	}
+	if err != nil {
+		return nil, dbError(ctx, "ExportUserData", err, http.StatusInternalServerError)
+	}
+
+	export := &user_model.UserDataExport{
+		ExportedAt:           time.Now().UTC(),
+		Profile:              &user,
+		Sessions:             []user_model.Session{},
+		AuditEvents:          []user_model.AuditEvent{},
+		PersonalAccessTokens: []user_model.PersonalAccessToken{},
+		OAuthConsents:        []user_model.OAuthConsent{},
+		WebAuthnCredentials:  []user_model.WebAuthnCredential{},
+		ExternalIdentities:   []user_model.ExternalIdentity{},
+		PhoneCodes:           []user_model.PhoneCode{},
+		EmailChanges:         []user_model.EmailChange{},
+	}
+
+	owned := bson.M{"userId": userID}
+	byCreation := options.Find().SetSort(bson.M{"_id": 1})
+
+	for _, q := range []struct {
+		name       string
+		collection *mongo.Collection
+		filter     bson.M
+		results    interface{}
+	}{
+		{"sessions", sessions, owned, &export.Sessions},
+		{"audit_events", auditEvents, auditEventsOf(userID, user.Email), &export.AuditEvents},
+		{"personal_access_tokens", personalAccessTokens, owned, &export.PersonalAccessTokens},
+		{"oauth_consents", oauthConsents, owned, &export.OAuthConsents},
+		{"webauthn_credentials", webAuthnCredentials, owned, &export.WebAuthnCredentials},
+		{"external_identities", externalIdentities, owned, &export.ExternalIdentities},
+		{"phone_codes", phoneCodes, owned, &export.PhoneCodes},
+		{"email_changes", emailChanges, owned, &export.EmailChanges},
+	} {
+		done := metrics.ObserveMongo(q.name, "Find")
+		cursor, err := q.collection.Find(ctx, q.filter, byCreation)
+		done(err)
+
+		if err == nil {
+			err = cursor.All(ctx, q.results)
+		}
+		if err != nil {
+			return nil, dbError(ctx, "ExportUserData", err, http.StatusInternalServerError)
+		}
+	}
+
+	return export, nil
+}
+
+// The function erases the account of the user with `userID` right away, without the grace period of
+// a deletion. The user confirms it with their password, or with their email when the account has no
+// password. Their credentials and related data are deleted, the audit events about them are
+// anonymized, and a receipt of what was erased is returned. The receipt is only signed when tokens are
+// signed with an asymmetric key, so it can be verified with the published keys.
+func EraseUser(ctx context.Context, userID primitive.ObjectID, password, confirm string) (res *user_model.DeletionReceipt, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.EraseUser")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "erase_user")
+	defer cancel()
+
+	// The keys are loaded first, so the receipt can be signed once nothing can be undone any more.
+	keys, err := helpers.JWTKeys()
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	var user user_model.User
+
+	done := metrics.ObserveMongo("users", "FindOne")
+	err = users.FindOne(ctx, activeUser(bson.M{"_id": userID})).Decode(&user)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, userNotFound()
+	}
+	if err != nil {
+		return nil, dbError(ctx, "EraseUser", err, http.StatusInternalServerError)
+	}
+
+	if e := confirmAccountOwner(&user, password, confirm); e != nil {
+		return nil, e
+	}
+
+	now := time.Now().UTC()
+	receiptID := helpers.NewTokenID()
+
+	// The event is anonymized below with the others, so the log keeps that an account was erased but
+	// not whose.
+	if e := RecordAuditEvent(ctx, user_model.AuditEvent{
+		Action:     user_model.AuditUserErased,
+		ActorID:    &userID,
+		UserID:     &userID,
+		ResourceID: receiptID,
+	}); e != nil {
+		return nil, e
+	}
+
+	erased, e := deleteUserData(ctx, userID)
+
+	if e != nil {
+		return nil, e
+	}
+
+	anonymized, e := anonymizeAuditEvents(ctx, userID, user.Email)
+
+	if e != nil {
+		return nil, e
+	}
+	erased["audit_events_anonymized"] = anonymized
+
+	done = metrics.ObserveMongo("users", "DeleteOne")
+	result, err := users.DeleteOne(ctx, bson.M{"_id": userID})
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "EraseUser", err, http.StatusInternalServerError)
+	}
+	erased["users"] = result.DeletedCount
+
+	res = &user_model.DeletionReceipt{
+		ReceiptID: receiptID,
+		UserID:    userID,
+		ErasedAt:  now,
+		Erased:    erased,
+	}
+
+	if !keys.PublicKeySigning() {
+		return res, nil
+	}
+
+	res.Receipt, err = keys.Sign(user_model.DeletionReceiptClaims{
+		Erased: erased,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   helpers.LoadTokenConfig().Issuer,
+			Subject:  userID.Hex(),
+			IssuedAt: jwt.NewNumericDate(now),
+			ID:       receiptID,
+		},
+	})
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	return res, nil
+}
+
+// The function checks that the user confirmed a sensitive change with their `password` or, for an
+// account without a password, with their email in `confirm`.
+func confirmAccountOwner(user *user_model.User, password, confirm string) *error_handler.NewError {
+	if user.Password != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+			return &error_handler.NewError{
+				Error:      "the password is incorrect",
+				StatusCode: http.StatusUnauthorized,
+			}
+		}
+	} else if !strings.EqualFold(strings.TrimSpace(confirm), user.Email) {
+		return &error_handler.NewError{
+			Error:      "confirm with the email of the account",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	return nil
+}
+
+// The function returns the filter of the audit events by or about a user, including failed logins
+// with their email.
+func auditEventsOf(userID primitive.ObjectID, email string) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"userId": userID},
+		bson.M{"actorId": userID},
+		bson.M{"impersonatorId": userID},
+		bson.M{"email": email},
+	}}
+}
+
+// The function replaces the user's id in the audit log by a random one and removes their email,
+// client IP and user agent, and the changes made to their profile. The events stay linked to each
+// other but no longer to the person. It returns how many events were anonymized.
+func anonymizeAuditEvents(ctx context.Context, userID primitive.ObjectID, email string) (int64, *error_handler.NewError) {
+	done := metrics.ObserveMongo("audit_events", "CountDocuments")
+	count, err := auditEvents.CountDocuments(ctx, auditEventsOf(userID, email))
+	done(err)
+
+	if err != nil {
+		return 0, dbError(ctx, "anonymizeAuditEvents", err, http.StatusInternalServerError)
+	}
+
+	pseudonym := primitive.NewObjectID()
+
+	// The IP and user agent are the actor's, so they are only removed where the user acted.
+	for _, u := range []struct {
+		filter bson.M
+		update bson.M
+	}{
+		{bson.M{"actorId": userID}, bson.M{"$set": bson.M{"actorId": pseudonym}, "$unset": bson.M{"ip": "", "userAgent": ""}}},
+		{bson.M{"userId": userID}, bson.M{"$set": bson.M{"userId": pseudonym}, "$unset": bson.M{"email": "", "changes": ""}}},
+		{bson.M{"impersonatorId": userID}, bson.M{"$set": bson.M{"impersonatorId": pseudonym}}},
+		{bson.M{"email": email}, bson.M{"$unset": bson.M{"email": "", "ip": "", "userAgent": ""}}},
+	} {
+		done := metrics.ObserveMongo("audit_events", "UpdateMany")
+		_, err := auditEvents.UpdateMany(ctx, u.filter, u.update)
+		done(err)
+
+		if err != nil {
+			return 0, dbError(ctx, "anonymizeAuditEvents", err, http.StatusInternalServerError)
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,285 @@
+package user_services
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/http-crud/api/helpers"
+	"github.com/http-crud/api/metrics"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/storage"
+	"github.com/http-crud/api/tracing"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// This is a set of functions to restore deleted accounts and to purge them once their grace period is
+// over.
+
+// The function returns how long a deleted account can be restored, `USER_DELETION_GRACE_PERIOD`
+// (default 720h).
+func deletionGracePeriod() time.Duration {
+	return helpers.EnvDuration("USER_DELETION_GRACE_PERIOD", 720*time.Hour)
+}
+
+// The function restores the deleted user with `id` if the grace period isn't over.
+func RestoreUser(ctx context.Context, id string) (res *user_model.User, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.RestoreUser")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "restore_user")
+	defer cancel()
+
+	objId, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	return restoreUser(ctx, objId)
+}
+
+// The function lets a user restore their own deleted account with their email or verified phone and
+// password, and logs them in like `LoginUser`.
+func RestoreAccount(ctx context.Context, identifier, password string) (res *user_model.UserLoginResponse, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.RestoreAccount")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "restore_user")
+	defer cancel()
+
+	var user user_model.User
+
+	filter := loginFilter(identifier)
+	filter["deletedat"] = bson.M{"$ne": nil}
+
+	done := metrics.ObserveMongo("users", "FindOne")
+	err := users.FindOne(ctx, filter).Decode(&user)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, &error_handler.NewError{
+			Error:      "no deleted account exists for this email or phone",
+			StatusCode: http.StatusNotFound,
+		}
+	}
+	if err != nil {
+		return nil, dbError(ctx, "RestoreAccount", err, http.StatusInternalServerError)
+	}
+
+	if err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return nil, &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	restored, e := restoreUser(ctx, user.ID)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return loginOrChallenge(ctx, restored)
+}
+
+func restoreUser(ctx context.Context, id primitive.ObjectID) (*user_model.User, *error_handler.NewError) {
+	now := time.Now().UTC()
+	filter := bson.M{"_id": id, "deletedat": bson.M{"$gt": now.Add(-deletionGracePeriod())}}
+	update := bson.M{
+		"$unset": bson.M{"deletedat": ""},
+		"$set":   bson.M{"updatedat": now},
+		"$inc":   bson.M{"version": 1},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user user_model.User
+
+	done := metrics.ObserveMongo("users", "FindOneAndUpdate")
+	err := users.FindOneAndUpdate(ctx, filter, update, opts).Decode(&user)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		done := metrics.ObserveMongo("users", "CountDocuments")
+		count, err := users.CountDocuments(ctx, bson.M{"_id": id, "deletedat": bson.M{"$ne": nil}})
+		done(err)
+
+		if err != nil {
+			return nil, dbError(ctx, "restoreUser", err, http.StatusInternalServerError)
+		}
+		if count > 0 {
+			return nil, &error_handler.NewError{
+				Error:      "the grace period to restore this account is over",
+				StatusCode: http.StatusGone,
+			}
+		}
+		return nil, &error_handler.NewError{
+			Error:      "no deleted user found",
+			StatusCode: http.StatusNotFound,
+		}
+	}
+	if err != nil {
+		return nil, dbError(ctx, "restoreUser", err, http.StatusInternalServerError)
+	}
+
+	event := user_model.AuditEvent{Action: user_model.AuditUserRestored, UserID: &id}
+	if helpers.PrincipalFromContext(ctx) == nil {
+		// A user restoring their own account isn't logged in yet.
+		event.ActorID = &id
+	}
+	recordAudit(ctx, event)
+
+	return &user, nil
+}
+
+// The function logs a deleted user out everywhere: their sessions, personal access tokens and the
+// tokens issued to applications on their behalf are revoked.
+func revokeUserCredentials(ctx context.Context, userID primitive.ObjectID, now time.Time) *error_handler.NewError {
+	filter := bson.M{"userId": userID, "revokedAt": bson.M{"$exists": false}}
+	revoke := bson.M{"$set": bson.M{"revokedAt": now}}
+
+	for name, collection := range map[string]*mongo.Collection{
+		"sessions":               sessions,
+		"personal_access_tokens": personalAccessTokens,
+		"oauth_tokens":           oauthTokens,
+	} {
+		done := metrics.ObserveMongo(name, "UpdateMany")
+		_, err := collection.UpdateMany(ctx, filter, revoke)
+		done(err)
+
+		if err != nil {
+			return dbError(ctx, "revokeUserCredentials", err, http.StatusInternalServerError)
+		}
+	}
+
+	return nil
+}
+
+// The function permanently removes the users whose grace period is over, together with everything
+// stored about them. The audit log is kept. It returns how many users were purged.
+func PurgeDeletedUsers(ctx context.Context) (purged int, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.PurgeDeletedUsers")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "purge_users")
+	defer cancel()
+
+	filter := bson.M{"deletedat": bson.M{"$lte": time.Now().UTC().Add(-deletionGracePeriod())}}
+
+	done := metrics.ObserveMongo("users", "Find")
+	cursor, err := users.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	done(err)
+
+	if err != nil {
+		return 0, dbError(ctx, "PurgeDeletedUsers", err, http.StatusInternalServerError)
+	}
+
+	var expired []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err = cursor.All(ctx, &expired); err != nil {
+		return 0, dbError(ctx, "PurgeDeletedUsers", err, http.StatusInternalServerError)
+	}
+
+	for _, user := range expired {
+		if e := purgeUser(ctx, user.ID); e != nil {
+			return purged, e
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// The function removes a user and their related data. The user goes last, so a purge that fails
+// halfway is picked up again by the next run.
+func purgeUser(ctx context.Context, userID primitive.ObjectID) *error_handler.NewError {
+	if _, e := deleteUserData(ctx, userID); e != nil {
+		return e
+	}
+
+	done := metrics.ObserveMongo("users", "DeleteOne")
+	_, err := users.DeleteOne(ctx, bson.M{"_id": userID, "deletedat": bson.M{"$ne": nil}})
+	done(err)
+
+	if err != nil {
+		return dbError(ctx, "purgeUser", err, http.StatusInternalServerError)
+	}
+
+	recordAudit(ctx, user_model.AuditEvent{Action: user_model.AuditUserPurged, UserID: &userID})
+
+	return nil
+}
+
+// The function deletes everything stored about a user except the user itself and the audit log,
+// including their avatar images, and returns how many documents were deleted per collection.
+func deleteUserData(ctx context.Context, userID primitive.ObjectID) (map[string]int64, *error_handler.NewError) {
+	deleted := map[string]int64{}
+
+	for name, collection := range map[string]*mongo.Collection{
+		"sessions":                  sessions,
+		"personal_access_tokens":    personalAccessTokens,
+		"webauthn_credentials":      webAuthnCredentials,
+		"webauthn_sessions":         webAuthnSessions,
+		"external_identities":       externalIdentities,
+		"magic_links":               magicLinks,
+		"email_changes":             emailChanges,
+		"phone_codes":               phoneCodes,
+		"oauth_authorization_codes": oauthCodes,
+		"oauth_tokens":              oauthTokens,
+		"oauth_consents":            oauthConsents,
+	} {
+		done := metrics.ObserveMongo(name, "DeleteMany")
+		result, err := collection.DeleteMany(ctx, bson.M{"userId": userID})
+		done(err)
+
+		if err != nil {
+			return nil, dbError(ctx, "deleteUserData", err, http.StatusInternalServerError)
+		}
+		deleted[name] = result.DeletedCount
+	}
+
+	store, err := storage.Default()
+	if err == nil {
+		err = store.DeletePrefix(ctx, avatarPrefix(userID, ""))
+	}
+	if err != nil {
+		return nil, storageError(ctx, "deleteUserData", err)
+	}
+
+	return deleted, nil
+}
+
+// The function runs `PurgeDeletedUsers` in the background every `USER_PURGE_INTERVAL` (default 1h)
+// until `ctx` is cancelled.
+func StartUserPurger(ctx context.Context) {
+	interval := helpers.EnvDuration("USER_PURGE_INTERVAL", time.Hour)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if purged, e := PurgeDeletedUsers(ctx); e != nil {
+				log.Printf("user purge failed: %s", e.Error)
+			} else if purged > 0 {
+				log.Printf("purged %d deleted users", purged)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
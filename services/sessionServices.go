@@ -0,0 +1,344 @@
+package user_services
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/http-crud/api/database"
+	"github.com/http-crud/api/helpers"
+	"github.com/http-crud/api/metrics"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/tracing"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// This is a set of functions to record the devices a user is logged in on and to log them out.
+var sessions *mongo.Collection = database.OpenCollection(*database.Client, "sessions")
+
+// The function records a login of `userID` from the client stored in `ctx` and returns the session with
+// its refresh and CSRF tokens, of which only hashes are stored. Sessions last for `SESSION_TTL`
+// (default 720h); the access tokens issued for them are shorter lived and renewed with the refresh
+// token.
+func createSession(ctx context.Context, userID primitive.ObjectID) (res *user_model.Session, refreshToken, csrfToken string, e *error_handler.NewError) {
+	client := helpers.ClientInfoFromContext(ctx)
+	now := time.Now().UTC()
+
+	deviceName := client.DeviceName
+	if deviceName == "" {
+		deviceName = deviceNameFromUserAgent(client.UserAgent)
+	}
+
+	refreshToken = randomString()
+	csrfToken = randomString()
+
+	session := user_model.Session{
+		ID:         primitive.NewObjectID(),
+		UserID:     userID,
+		DeviceName: deviceName,
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(helpers.EnvDuration("SESSION_TTL", 720*time.Hour)),
+
+		RefreshTokenHash: hashToken(refreshToken),
+		CSRFTokenHash:    hashToken(csrfToken),
+	}
+
+	done := metrics.ObserveMongo("sessions", "InsertOne")
+	_, err := sessions.InsertOne(ctx, session)
+	done(err)
+
+	if err != nil {
+		return nil, "", "", dbError(ctx, "createSession", err, http.StatusInternalServerError)
+	}
+
+	return &session, refreshToken, csrfToken, nil
+}
+
+// The function exchanges a refresh token for a new access token of the same session and rotates the
+// refresh token. Presenting a refresh token that was already rotated means it was stolen, so the
+// session is revoked. When the refresh token came from a cookie, `csrfToken` is the value of the
+// `X-CSRF-Token` header and must match the session; it is nil otherwise.
+func RefreshSession(ctx context.Context, refreshToken string, csrfToken *string) (res *user_model.UserLoginResponse, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.RefreshSession")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "refresh_session")
+	defer cancel()
+
+	now := time.Now().UTC()
+	hash := hashToken(refreshToken)
+	filter := bson.M{
+		"refreshTokenHash": hash,
+		"revokedAt":        bson.M{"$exists": false},
+		"expiresAt":        bson.M{"$gt": now},
+	}
+
+	var session user_model.Session
+
+	done := metrics.ObserveMongo("sessions", "FindOne")
+	err := sessions.FindOne(ctx, filter).Decode(&session)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		reused := bson.M{"previousRefreshTokenHash": hash, "revokedAt": bson.M{"$exists": false}}
+
+		done = metrics.ObserveMongo("sessions", "UpdateOne")
+		result, err := sessions.UpdateOne(ctx, reused, bson.M{"$set": bson.M{"revokedAt": now}})
+		done(err)
+
+		if err == nil && result.ModifiedCount > 0 {
+			return nil, &error_handler.NewError{
+				Error:      "refresh token reused, the session has been revoked",
+				StatusCode: http.StatusUnauthorized,
+			}
+		}
+
+		return nil, &error_handler.NewError{
+			Error:      "invalid or expired refresh token",
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	if err != nil {
+		return nil, dbError(ctx, "RefreshSession", err, http.StatusInternalServerError)
+	}
+
+	if csrfToken != nil && !SessionCSRFValid(&session, *csrfToken) {
+		return nil, &error_handler.NewError{
+			Error:      "missing or invalid csrf token",
+			StatusCode: http.StatusForbidden,
+		}
+	}
+
+	newRefreshToken := randomString()
+	client := helpers.ClientInfoFromContext(ctx)
+
+	// The old hash is part of the filter so two concurrent refreshes can't both rotate the same token.
+	done = metrics.ObserveMongo("sessions", "UpdateOne")
+	result, err := sessions.UpdateOne(ctx, bson.M{"_id": session.ID, "refreshTokenHash": hash}, bson.M{"$set": bson.M{
+		"refreshTokenHash":         hashToken(newRefreshToken),
+		"previousRefreshTokenHash": hash,
+		"lastSeenAt":               now,
+		"lastSeenIp":               client.IP,
+	}})
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "RefreshSession", err, http.StatusInternalServerError)
+	}
+
+	if result.ModifiedCount == 0 {
+		return nil, &error_handler.NewError{
+			Error:      "invalid or expired refresh token",
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	var user user_model.User
+
+	done = metrics.ObserveMongo("users", "FindOne")
+	err = users.FindOne(ctx, activeUser(bson.M{"_id": session.UserID})).Decode(&user)
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "RefreshSession", err, http.StatusUnauthorized)
+	}
+
+	jwt, e := helpers.GenerateJWT(&user, session.ID.Hex())
+
+	if e != nil {
+		return nil, e
+	}
+
+	return &user_model.UserLoginResponse{
+		Accesstoken:  jwt,
+		RefreshToken: newRefreshToken,
+		ID:           user.ID,
+		SessionID:    session.ID.Hex(),
+	}, nil
+}
+
+// The function reports whether `csrfToken` is the CSRF token of `session`.
+func SessionCSRFValid(session *user_model.Session, csrfToken string) bool {
+	return csrfToken != "" && subtle.ConstantTimeCompare([]byte(hashToken(csrfToken)), []byte(session.CSRFTokenHash)) == 1
+}
+
+// The function checks that the session with `sessionID` belongs to `userID` and hasn't been revoked or
+// expired, and records that it was seen from `ip`.
+func AuthenticateSession(ctx context.Context, userID primitive.ObjectID, sessionID, ip string) (res *user_model.Session, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.AuthenticateSession")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "authenticate_session")
+	defer cancel()
+
+	objId, err := primitive.ObjectIDFromHex(sessionID)
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      "session not valid",
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	now := time.Now().UTC()
+	filter := bson.M{
+		"_id":       objId,
+		"userId":    userID,
+		"revokedAt": bson.M{"$exists": false},
+		"expiresAt": bson.M{"$gt": now},
+	}
+	update := bson.M{"$set": bson.M{"lastSeenAt": now, "lastSeenIp": ip}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var session user_model.Session
+
+	done := metrics.ObserveMongo("sessions", "FindOneAndUpdate")
+	err = sessions.FindOneAndUpdate(ctx, filter, update, opts).Decode(&session)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, &error_handler.NewError{
+			Error:      "session has been revoked or has expired",
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	if err != nil {
+		return nil, dbError(ctx, "AuthenticateSession", err, http.StatusInternalServerError)
+	}
+
+	return &session, nil
+}
+
+// The function lists the active sessions of `userID`, most recently seen first. The session with
+// `currentSessionID` is marked as the current one.
+func ListSessions(ctx context.Context, userID primitive.ObjectID, currentSessionID string) (res []user_model.Session, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.ListSessions")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "list_sessions")
+	defer cancel()
+
+	filter := bson.M{
+		"userId":    userID,
+		"revokedAt": bson.M{"$exists": false},
+		"expiresAt": bson.M{"$gt": time.Now().UTC()},
+	}
+
+	done := metrics.ObserveMongo("sessions", "Find")
+	cursor, err := sessions.Find(ctx, filter, options.Find().SetSort(bson.M{"lastSeenAt": -1}))
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "ListSessions", err, http.StatusInternalServerError)
+	}
+
+	res = []user_model.Session{}
+	if err = cursor.All(ctx, &res); err != nil {
+		return nil, dbError(ctx, "ListSessions", err, http.StatusInternalServerError)
+	}
+
+	for i := range res {
+		res[i].Current = res[i].ID.Hex() == currentSessionID
+	}
+
+	return res, nil
+}
+
+// The function revokes the session with `sessionID` of `userID`. The access tokens issued for it stop
+// working immediately.
+func RevokeSession(ctx context.Context, userID primitive.ObjectID, sessionID string) (res *mongo.UpdateResult, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.RevokeSession")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "revoke_session")
+	defer cancel()
+
+	objId, err := primitive.ObjectIDFromHex(sessionID)
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	filter := bson.M{"_id": objId, "userId": userID, "revokedAt": bson.M{"$exists": false}}
+
+	done := metrics.ObserveMongo("sessions", "UpdateOne")
+	result, err := sessions.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"revokedAt": time.Now().UTC()}})
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "RevokeSession", err, http.StatusInternalServerError)
+	}
+
+	if result.MatchedCount == 0 {
+		return nil, &error_handler.NewError{
+			Error:      "session not found",
+			StatusCode: http.StatusNotFound,
+		}
+	}
+
+	recordAudit(ctx, user_model.AuditEvent{
+		Action:     user_model.AuditSessionRevoked,
+		UserID:     &userID,
+		ResourceID: sessionID,
+	})
+
+	return result, nil
+}
+
+// The function makes a readable device name such as "Firefox on Windows" from a user agent, for
+// clients that don't send `X-Device-Name`.
+func deviceNameFromUserAgent(ua string) string {
+	browser := ""
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	platform := ""
+	for _, o := range []struct{ token, name string }{
+		{"Windows", "Windows"},
+		{"Android", "Android"},
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			platform = o.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	}
+	return "Unknown device"
+}
@@ -0,0 +1,68 @@
+package user_services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/http-crud/api/helpers"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// `StatusClientClosedRequest` is the non-standard status used in logs when the client went away before
+// the operation finished.
+const StatusClientClosedRequest = 499
+
+const defaultOperationTimeout = 10 * time.Second
+
+// The function returns the deadline for the service operation `op`. It reads `DB_TIMEOUT_<OP>` (for
+// example `DB_TIMEOUT_LOGIN=3s`), then `DB_TIMEOUT`, and falls back to 10 seconds. Invalid durations are
+// ignored.
+func operationTimeout(op string) time.Duration {
+	for _, key := range []string{"DB_TIMEOUT_" + strings.ToUpper(op), "DB_TIMEOUT"} {
+		if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+			return d
+		}
+	}
+	return defaultOperationTimeout
+}
+
+// The function derives the context used by the service operation `op` from the caller's context. The
+// caller's cancellation still applies, so a client disconnecting aborts the DB work.
+func withOperationTimeout(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, operationTimeout(op))
+}
+
+// The function converts an error returned by the database into the service error. A deadline that
+// expired is mapped to 504 and a client cancellation to 499; both are logged with the request and trace
+// IDs. Any other error keeps `status`.
+func dbError(ctx context.Context, op string, err error, status int) *error_handler.NewError {
+	var message string
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err):
+		status = http.StatusGatewayTimeout
+		message = "operation timed out"
+	case errors.Is(err, context.Canceled):
+		status = StatusClientClosedRequest
+		message = "client closed request"
+	default:
+		return &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: status,
+		}
+	}
+
+	log.Printf("request_id=%s trace_id=%s op=%s status=%d error=%q", helpers.RequestIDFromContext(ctx), trace.SpanContextFromContext(ctx).TraceID(), op, status, err.Error())
+
+	return &error_handler.NewError{
+		Error:      message,
+		StatusCode: status,
+	}
+}
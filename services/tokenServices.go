@@ -0,0 +1,232 @@
+package user_services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/http-crud/api/database"
+	"github.com/http-crud/api/metrics"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/tracing"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// `PersonalAccessTokenPrefix` starts every personal access token so the auth middleware can tell them
+// apart from JWTs, and so secret scanners can recognise them.
+const PersonalAccessTokenPrefix = "pat_"
+
+// This is a set of functions to create, list, revoke and authenticate personal access tokens.
+var personalAccessTokens *mongo.Collection = database.OpenCollection(*database.Client, "personal_access_tokens")
+
+func CreatePersonalAccessToken(ctx context.Context, userID primitive.ObjectID, name string, scopes []string, expiresAt *time.Time) (res *user_model.PersonalAccessTokenResponse, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.CreatePersonalAccessToken")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "create_token")
+	defer cancel()
+
+	name = strings.TrimSpace(name)
+
+	if name == "" || len(name) > 100 {
+		return nil, &error_handler.NewError{
+			Error:      "token name must be between 1 and 100 characters",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	if len(scopes) == 0 {
+		return nil, &error_handler.NewError{
+			Error:      "at least one scope is required",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return nil, &error_handler.NewError{
+				Error:      "invalid scope: " + scope,
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+	}
+
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, &error_handler.NewError{
+			Error:      "token expiry must be in the future",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return nil, &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	token := PersonalAccessTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	pat := user_model.PersonalAccessToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		Prefix:    token[:len(PersonalAccessTokenPrefix)+6],
+		Hash:      hashToken(token),
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	done := metrics.ObserveMongo("personal_access_tokens", "InsertOne")
+	_, err := personalAccessTokens.InsertOne(ctx, pat)
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "CreatePersonalAccessToken", err, http.StatusInternalServerError)
+	}
+
+	return &user_model.PersonalAccessTokenResponse{
+		Token:               token,
+		PersonalAccessToken: pat,
+	}, nil
+}
+
+func ListPersonalAccessTokens(ctx context.Context, userID primitive.ObjectID) (res []user_model.PersonalAccessToken, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.ListPersonalAccessTokens")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "list_tokens")
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+
+	done := metrics.ObserveMongo("personal_access_tokens", "Find")
+	cursor, err := personalAccessTokens.Find(ctx, bson.M{"userId": userID}, opts)
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "ListPersonalAccessTokens", err, http.StatusInternalServerError)
+	}
+
+	tokens := []user_model.PersonalAccessToken{}
+
+	if err := cursor.All(ctx, &tokens); err != nil {
+		return nil, dbError(ctx, "ListPersonalAccessTokens", err, http.StatusInternalServerError)
+	}
+
+	return tokens, nil
+}
+
+func RevokePersonalAccessToken(ctx context.Context, userID primitive.ObjectID, tokenID string) (res *user_model.PersonalAccessToken, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.RevokePersonalAccessToken")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "revoke_token")
+	defer cancel()
+
+	objId, err := primitive.ObjectIDFromHex(tokenID)
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	// The owner is part of the filter so users can only revoke their own tokens.
+	filter := bson.M{"_id": objId, "userId": userID, "revokedAt": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"revokedAt": time.Now().UTC()}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var pat user_model.PersonalAccessToken
+
+	done := metrics.ObserveMongo("personal_access_tokens", "FindOneAndUpdate")
+	err = personalAccessTokens.FindOneAndUpdate(ctx, filter, update, opts).Decode(&pat)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, &error_handler.NewError{
+			Error:      "token not found",
+			StatusCode: http.StatusNotFound,
+		}
+	}
+
+	if err != nil {
+		return nil, dbError(ctx, "RevokePersonalAccessToken", err, http.StatusInternalServerError)
+	}
+
+	recordAudit(ctx, user_model.AuditEvent{
+		Action:     user_model.AuditTokenRevoked,
+		UserID:     &userID,
+		ResourceID: pat.ID.Hex(),
+	})
+
+	return &pat, nil
+}
+
+// The function looks up a personal access token by its hash and checks it isn't revoked or expired.
+// The last-used time and IP are recorded on success.
+func AuthenticatePersonalAccessToken(ctx context.Context, token, ip string) (res *user_model.PersonalAccessToken, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.AuthenticatePersonalAccessToken")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "authenticate_token")
+	defer cancel()
+
+	now := time.Now().UTC()
+	filter := bson.M{
+		"hash":      hashToken(token),
+		"revokedAt": bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"expiresAt": bson.M{"$exists": false}},
+			bson.M{"expiresAt": bson.M{"$gt": now}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"lastUsedAt": now, "lastUsedIp": ip}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var pat user_model.PersonalAccessToken
+
+	done := metrics.ObserveMongo("personal_access_tokens", "FindOneAndUpdate")
+	err := personalAccessTokens.FindOneAndUpdate(ctx, filter, update, opts).Decode(&pat)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, &error_handler.NewError{
+			Error:      "token not valid",
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	if err != nil {
+		return nil, dbError(ctx, "AuthenticatePersonalAccessToken", err, http.StatusInternalServerError)
+	}
+
+	return &pat, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validScope(scope string) bool {
+	for _, s := range user_model.PersonalAccessTokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -2,13 +2,20 @@ package user_services
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
+	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/go-playground/validator/v10"
 	"github.com/http-crud/api/database"
 	"github.com/http-crud/api/helpers"
+	"github.com/http-crud/api/metrics"
 	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/tracing"
 	error_handler "github.com/http-crud/api/utils"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -21,27 +28,37 @@ import (
 // MongoDB and Go.
 var users *mongo.Collection = database.OpenCollection(*database.Client, "users")
 
-func RegisterUser(user *user_model.User) (*mongo.InsertOneResult, *error_handler.NewError) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+func RegisterUser(ctx context.Context, user *user_model.User) (res *mongo.InsertOneResult, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.RegisterUser")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "register")
 	defer cancel()
 
+	done := metrics.ObserveMongo("users", "CountDocuments")
 	count, err := users.CountDocuments(ctx, bson.M{"email": user.Email})
+	done(err)
 
 	if err != nil {
-		return nil, &error_handler.NewError{
-			Error:      err.Error(),
-			StatusCode: http.StatusInternalServerError,
-		}
+		metrics.ObserveRegistration(false)
+		return nil, dbError(ctx, "RegisterUser", err, http.StatusInternalServerError)
 	}
 
 	if count > 0 {
+		metrics.ObserveRegistration(false)
 		return nil, &error_handler.NewError{
 			Error:      "user with the same name already exist",
 			StatusCode: http.StatusResetContent,
 		}
 	}
+
+	if e := usernameAvailable(ctx, user.Username, primitive.NilObjectID); e != nil {
+		metrics.ObserveRegistration(false)
+		return nil, e
+	}
 	var validator = validator.New()
 	if err = validator.Struct(user); err != nil {
+		metrics.ObserveRegistration(false)
 		return nil, &error_handler.NewError{
 			Error:      err.Error(),
 			StatusCode: http.StatusBadRequest,
@@ -53,6 +70,7 @@ func RegisterUser(user *user_model.User) (*mongo.InsertOneResult, *error_handler
 	hashedPass, err := helpers.HashPassword(user.Password)
 
 	if err != nil {
+		metrics.ObserveRegistration(false)
 		return nil, &error_handler.NewError{
 			Error:      err.Error(),
 			StatusCode: http.StatusInternalServerError,
@@ -61,37 +79,77 @@ func RegisterUser(user *user_model.User) (*mongo.InsertOneResult, *error_handler
 
 	user.Password = hashedPass
 	user.ConfirmPassword = hashedPass
+	user.Role = user_model.RoleUser
+	user.Version = 1
 
 	user.ID = primitive.NewObjectID()
 
+	done = metrics.ObserveMongo("users", "InsertOne")
 	insertionResult, err := users.InsertOne(ctx, user)
+	done(err)
 
+	if mongo.IsDuplicateKeyError(err) {
+		metrics.ObserveRegistration(false)
+		return nil, userConflict(err)
+	}
 	if err != nil {
-		return nil, &error_handler.NewError{
-			Error:      err.Error(),
-			StatusCode: http.StatusInternalServerError,
-		}
+		metrics.ObserveRegistration(false)
+		return nil, dbError(ctx, "RegisterUser", err, http.StatusInternalServerError)
 	}
 
+	metrics.ObserveRegistration(true)
+	recordAudit(ctx, user_model.AuditEvent{
+		Action:  user_model.AuditUserRegistered,
+		ActorID: &user.ID,
+		UserID:  &user.ID,
+		Email:   user.Email,
+	})
 	return insertionResult, nil
 }
 
-func LoginUser(email, password string) (*user_model.UserLoginResponse, *error_handler.NewError) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+// The function logs in the user with the email or verified phone `identifier` and `password`. A user
+// with two-step login on gets an MFA challenge instead of the tokens.
+func LoginUser(ctx context.Context, identifier, password string) (res *user_model.UserLoginResponse, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.LoginUser")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "login")
 
 	defer cancel()
 
-	filter := bson.M{"email": email}
-	var user user_model.User
+	user, e := AuthenticateUser(ctx, identifier, password)
 
-	if err := users.FindOne(ctx, filter, nil).Decode(&user); err != nil {
-		return nil, &error_handler.NewError{
-			Error:      err.Error(),
-			StatusCode: http.StatusNotFound,
+	if e != nil {
+		metrics.ObserveLogin(false)
+		event := user_model.AuditEvent{
+			Action: user_model.AuditUserLoginFailed,
+			Reason: e.Error,
+		}
+		if !isPhoneIdentifier(identifier) {
+			event.Email = identifier
 		}
+		recordAudit(ctx, event)
+		return nil, e
 	}
 
-	var err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	return loginOrChallenge(ctx, user)
+}
+
+// The function checks the email or verified phone `identifier` and the password of a user and returns
+// the user when they match. It is the credential check behind `/user/login`.
+func AuthenticateUser(ctx context.Context, identifier, password string) (*user_model.User, *error_handler.NewError) {
+	filter := loginFilter(identifier)
+	var user user_model.User
+
+	done := metrics.ObserveMongo("users", "FindOne")
+	err := users.FindOne(ctx, activeUser(filter)).Decode(&user)
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "AuthenticateUser", err, http.StatusNotFound)
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
 
 	if err != nil {
 		return nil, &error_handler.NewError{
@@ -100,23 +158,157 @@ func LoginUser(email, password string) (*user_model.UserLoginResponse, *error_ha
 		}
 	}
 
-	jwt, jwtErr := helpers.GenerateJWT(&user)
+	return &user, nil
+}
 
-	jwtRes := &user_model.UserLoginResponse{
-		Accesstoken: jwt,
-		ID:          user.ID,
+// The function issues the access token of a user who has been authenticated, whichever way they logged
+// in, and records the login as a new session.
+func loginResponse(ctx context.Context, user *user_model.User) (*user_model.UserLoginResponse, *error_handler.NewError) {
+	session, refreshToken, csrfToken, e := createSession(ctx, user.ID)
+
+	if e != nil {
+		metrics.ObserveLogin(false)
+		return nil, e
 	}
 
+	jwt, jwtErr := helpers.GenerateJWT(user, session.ID.Hex())
+
 	if jwtErr != nil {
+		metrics.ObserveLogin(false)
 		return nil, jwtErr
 	}
 
-	return jwtRes, nil
+	metrics.ObserveLogin(true)
+	recordAudit(ctx, user_model.AuditEvent{
+		Action:     user_model.AuditUserLogin,
+		ActorID:    &user.ID,
+		UserID:     &user.ID,
+		SessionID:  session.ID.Hex(),
+		ResourceID: session.ID.Hex(),
+	})
+	return &user_model.UserLoginResponse{
+		Accesstoken:  jwt,
+		RefreshToken: refreshToken,
+		CSRFToken:    csrfToken,
+		ID:           user.ID,
+		SessionID:    session.ID.Hex(),
+	}, nil
 }
 
-func GetUserById(id string) (*user_model.User, *error_handler.NewError) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+// The function changes the password of the user with `userID` after checking the current one. The new
+// password must follow the registration rules. Every other session of the user is revoked, so a
+// stolen session doesn't survive the change.
+func ChangePassword(ctx context.Context, userID primitive.ObjectID, currentSessionID, currentPassword, password, confirmPassword string) (e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.ChangePassword")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "change_password")
 	defer cancel()
+
+	hasNum, hasHupper, hasSpecial := helpers.VerifyPassword(password)
+
+	switch {
+	case strings.TrimSpace(password) == "":
+		return &error_handler.NewError{Error: "password can't be empty", StatusCode: http.StatusBadRequest}
+	case !hasNum || !hasHupper || !hasSpecial:
+		return &error_handler.NewError{
+			Error:      fmt.Sprintf("Password missing field. hasNum: %v, hasUpper: %v, hasSpecial: %v", hasNum, hasHupper, hasSpecial),
+			StatusCode: http.StatusBadRequest,
+		}
+	case password != confirmPassword:
+		return &error_handler.NewError{Error: "password & conform password is not matched", StatusCode: http.StatusBadRequest}
+	}
+
+	var user user_model.User
+
+	done := metrics.ObserveMongo("users", "FindOne")
+	err := users.FindOne(ctx, activeUser(bson.M{"_id": userID})).Decode(&user)
+	done(err)
+
+	if err != nil {
+		return dbError(ctx, "ChangePassword", err, http.StatusUnauthorized)
+	}
+
+	if err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(currentPassword)); err != nil {
+		return &error_handler.NewError{
+			Error:      "current password is not correct",
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	hashedPass, err := helpers.HashPassword(password)
+
+	if err != nil {
+		return &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	now := time.Now().UTC()
+
+	done = metrics.ObserveMongo("users", "UpdateOne")
+	_, err = users.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{
+		"$set": bson.M{"password": hashedPass, "confirmpassword": hashedPass, "updatedat": now},
+		"$inc": bson.M{"version": 1},
+	})
+	done(err)
+
+	if err != nil {
+		return dbError(ctx, "ChangePassword", err, http.StatusInternalServerError)
+	}
+
+	filter := bson.M{"userId": userID, "revokedAt": bson.M{"$exists": false}}
+	if sessionID, err := primitive.ObjectIDFromHex(currentSessionID); err == nil {
+		filter["_id"] = bson.M{"$ne": sessionID}
+	}
+
+	done = metrics.ObserveMongo("sessions", "UpdateMany")
+	_, err = sessions.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revokedAt": now}})
+	done(err)
+
+	if err != nil {
+		return dbError(ctx, "ChangePassword", err, http.StatusInternalServerError)
+	}
+
+	recordAudit(ctx, user_model.AuditEvent{
+		Action:    user_model.AuditUserPasswordChanged,
+		ActorID:   &userID,
+		UserID:    &userID,
+		SessionID: currentSessionID,
+	})
+
+	return nil
+}
+
+// The function makes the user with `email` an admin. It backs the `promote-admin` command, which is
+// how the first admin of a deployment is created since only admins can change roles through the API.
+func PromoteAdmin(ctx context.Context, email string) (*user_model.User, *error_handler.NewError) {
+	var user user_model.User
+
+	done := metrics.ObserveMongo("users", "FindOne")
+	err := users.FindOne(ctx, activeUser(bson.M{"email": strings.TrimSpace(email)})).Decode(&user)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, userNotFound()
+	}
+	if err != nil {
+		return nil, dbError(ctx, "PromoteAdmin", err, http.StatusInternalServerError)
+	}
+
+	return SetUserRole(ctx, user.ID.Hex(), user_model.RoleAdmin)
+}
+
+// The function changes the role of the user with `id` to `role`. Admins can't change their own role,
+// so the last admin can't lock everyone out by accident.
+func SetUserRole(ctx context.Context, id, role string) (res *user_model.User, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.SetUserRole")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "update_user")
+	defer cancel()
+
 	objId, err := primitive.ObjectIDFromHex(id)
 
 	if err != nil {
@@ -126,20 +318,121 @@ func GetUserById(id string) (*user_model.User, *error_handler.NewError) {
 		}
 	}
 
-	filter := bson.M{"_id": objId}
-	var user user_model.User
-	if err := users.FindOne(ctx, filter).Decode(&user); err != nil {
+	if role != user_model.RoleUser && role != user_model.RoleAdmin {
+		return nil, &error_handler.NewError{
+			Error:      fmt.Sprintf("invalid role %q", role),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	if principal := helpers.PrincipalFromContext(ctx); principal != nil && principal.UserID == objId {
+		return nil, &error_handler.NewError{
+			Error:      "admins can't change their own role",
+			StatusCode: http.StatusForbidden,
+		}
+	}
+
+	update := bson.M{
+		"$set": bson.M{"role": role, "updatedat": time.Now().UTC()},
+		"$inc": bson.M{"version": 1},
+	}
+
+	var before user_model.User
+
+	done := metrics.ObserveMongo("users", "FindOneAndUpdate")
+	err = users.FindOneAndUpdate(ctx, activeUser(bson.M{"_id": objId}), update).Decode(&before)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, userNotFound()
+	}
+	if err != nil {
+		return nil, dbError(ctx, "SetUserRole", err, http.StatusInternalServerError)
+	}
+
+	after := before
+	after.Role = role
+	after.Version++
+
+	if before.Role != role {
+		recordAudit(ctx, user_model.AuditEvent{
+			Action:  user_model.AuditUserRoleChanged,
+			UserID:  &objId,
+			Changes: map[string]user_model.AuditChange{"role": {Before: before.Role, After: role}},
+		})
+	}
+
+	return &after, nil
+}
+
+func GetUserById(ctx context.Context, id string) (res *user_model.User, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.GetUserById")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "get_user")
+	defer cancel()
+	objId, err := primitive.ObjectIDFromHex(id)
+
+	if err != nil {
 		return nil, &error_handler.NewError{
 			Error:      err.Error(),
-			StatusCode: http.StatusUnauthorized,
+			StatusCode: http.StatusBadRequest,
 		}
 	}
 
+	filter := bson.M{"_id": objId}
+	var user user_model.User
+	done := metrics.ObserveMongo("users", "FindOne")
+	err = users.FindOne(ctx, activeUser(filter)).Decode(&user)
+	done(err)
+	if err != nil {
+		return nil, dbError(ctx, "GetUserById", err, http.StatusUnauthorized)
+	}
+
 	return &user, nil
 }
 
-func UpdateUser(user *user_model.User, id string) (*mongo.UpdateResult, *error_handler.NewError) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// Content types accepted by `UpdateUser`. Plain JSON is treated as a merge patch.
+const (
+	MergePatchContentType = "application/merge-patch+json"
+	JSONPatchContentType  = "application/json-patch+json"
+)
+
+// `UserMutableFields` are the fields of a user a patch may change. Everything else, such as the role or
+// the password, has its own endpoint or can't be changed.
+var UserMutableFields = []string{"name", "email", "gender", "displayName", "username", "phone", "locale", "timezone", "dateOfBirth", "bio"}
+
+// `requiredUserFields` are the mutable fields a user always has.
+var requiredUserFields = []string{"name", "email", "gender"}
+
+// The function returns the mutable fields of `user` by their JSON name. The fields are stored under
+// the lower case of that name.
+func userProfileFields(user *user_model.User) map[string]*string {
+	return map[string]*string{
+		"name":        &user.Name,
+		"email":       &user.Email,
+		"gender":      &user.Gender,
+		"displayName": &user.DisplayName,
+		"username":    &user.Username,
+		"phone":       &user.Phone,
+		"locale":      &user.Locale,
+		"timezone":    &user.Timezone,
+		"dateOfBirth": &user.DateOfBirth,
+		"bio":         &user.Bio,
+	}
+}
+
+// The function applies `patch` to the mutable fields of the user with `id` and returns the updated
+// user. `contentType` selects JSON Merge Patch (RFC 7396) or JSON Patch (RFC 6902). Touching a field
+// outside `UserMutableFields` is rejected, and the result must pass the registration rules. `ifMatch`
+// is the version the client last saw, or nil for "*"; the update fails with 412 when the user has
+// changed since, including concurrently with this update. A new email is only stored as pending and
+// the confirmation and revert emails link to `links`.
+func UpdateUser(ctx context.Context, id string, ifMatch *int64, contentType string, patch []byte, links user_model.EmailChangeLinks) (res *user_model.User, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.UpdateUser")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "update_user")
 	defer cancel()
 
 	objId, err := primitive.ObjectIDFromHex(id)
@@ -153,63 +446,269 @@ func UpdateUser(user *user_model.User, id string) (*mongo.UpdateResult, *error_h
 
 	filter := bson.M{"_id": objId}
 
-	var updateObj bson.D
+	var userData *user_model.User
+
+	done := metrics.ObserveMongo("users", "FindOne")
+	err = users.FindOne(ctx, activeUser(filter)).Decode(&userData)
+	done(err)
 
-	if user.Name != "" {
-		updateObj = append(updateObj, bson.E{"name", user.Name})
+	if err == mongo.ErrNoDocuments {
+		return nil, userNotFound()
+	}
+	if err != nil {
+		return nil, dbError(ctx, "UpdateUser", err, http.StatusInternalServerError)
 	}
 
-	var userData *user_model.User
+	if ifMatch != nil && *ifMatch != userData.Version {
+		return nil, versionMismatch()
+	}
+
+	fields, e := applyUserPatch(userData, contentType, patch)
+
+	if e != nil {
+		return nil, e
+	}
 
-	if err := users.FindOne(ctx, filter, nil).Decode(&userData); err != nil {
+	// A field the patch removed is left empty; the required ones then fail the validation.
+	updated := *userData
+	for field, value := range userProfileFields(&updated) {
+		*value = fields[field]
+	}
+	updated.Username = helpers.NormalizeUsername(updated.Username)
+
+	if capturedErrors := helpers.ValidateUser(&updated, false); len(capturedErrors) != 0 {
+		messages := make([]string, len(capturedErrors))
+		for i, c := range capturedErrors {
+			messages[i] = c.Error
+		}
 		return nil, &error_handler.NewError{
-			Error:      err.Error(),
-			StatusCode: http.StatusUnauthorized,
+			Error:      strings.Join(messages, "; "),
+			StatusCode: http.StatusBadRequest,
 		}
 	}
 
-	if user.Email != "" {
-		count, err := users.CountDocuments(ctx, bson.M{"email": user.Email})
+	if updated.Email != userData.Email {
+		done := metrics.ObserveMongo("users", "CountDocuments")
+		count, err := users.CountDocuments(ctx, bson.M{"email": updated.Email, "_id": bson.M{"$ne": objId}})
+		done(err)
 
 		if err != nil {
-			return nil, &error_handler.NewError{
-				Error:      err.Error(),
-				StatusCode: http.StatusInternalServerError,
-			}
+			return nil, dbError(ctx, "UpdateUser", err, http.StatusInternalServerError)
 		}
 
-		if count > 0 && userData.ID != objId {
+		if count > 0 {
 			return nil, &error_handler.NewError{
 				Error:      "user with this email already exist.",
 				StatusCode: http.StatusNotAcceptable,
 			}
 		}
+	}
 
-		updateObj = append(updateObj, bson.E{"email", user.Email})
+	if updated.Username != userData.Username {
+		if e := usernameAvailable(ctx, updated.Username, objId); e != nil {
+			return nil, e
+		}
 	}
 
-	userData.UpdatedAt, _ = time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
+	// The login codes go to the verified phone, so it can't be swapped while they are on.
+	if updated.Phone != userData.Phone && userData.MFAEnabled {
+		return nil, &error_handler.NewError{
+			Error:      "turn off two-step login before changing the phone",
+			StatusCode: http.StatusConflict,
+			Field:      "phone",
+		}
+	}
 
-	upsert := true
+	// A new email only becomes pending; it replaces the current one once confirmed.
+	pendingEmail := ""
+	if updated.Email != userData.Email {
+		pendingEmail, updated.Email = updated.Email, userData.Email
+	}
 
-	opt := options.UpdateOptions{
-		Upsert: &upsert,
+	// Empty optional fields are removed rather than stored empty, so the unique index on usernames
+	// only covers users that have one.
+	set := bson.M{"updatedat": time.Now().UTC()}
+	unset := bson.M{}
+	for field, value := range userProfileFields(&updated) {
+		if *value == "" {
+			unset[strings.ToLower(field)] = ""
+		} else {
+			set[strings.ToLower(field)] = *value
+		}
 	}
 
-	result, err := users.UpdateOne(ctx, filter, bson.D{{"$set", updateObj}}, &opt)
+	if pendingEmail != "" {
+		set["pendingemail"] = pendingEmail
+	}
 
+	// A new phone has to be verified again.
+	if updated.Phone != userData.Phone {
+		unset["phoneverifiedat"] = ""
+	}
+
+	update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	// The email change is recorded and its emails are sent before anything is saved, so a failure leaves
+	// the user as it was and the client can simply retry. If the update fails afterwards, the change is
+	// cancelled and its links no longer work.
+	changeID := ""
+	if pendingEmail != "" {
+		if changeID, e = requestEmailChange(ctx, &updated, pendingEmail, links); e != nil {
+			return nil, e
+		}
+	}
+
+	// The update only applies to the version that was read and patched, so a concurrent change makes it
+	// fail instead of being overwritten. There is no upsert: a user deleted meanwhile is not recreated.
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user user_model.User
+
+	done = metrics.ObserveMongo("users", "FindOneAndUpdate")
+	err = users.FindOneAndUpdate(ctx, versionFilter(objId, userData.Version), update, opts).Decode(&user)
+	done(err)
+
+	if err != nil && changeID != "" {
+		cancelEmailChange(ctx, changeID)
+	}
+	if err == mongo.ErrNoDocuments {
+		return nil, preconditionFailed(ctx, "UpdateUser", objId)
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, userConflict(err)
+	}
 	if err != nil {
+		return nil, dbError(ctx, "UpdateUser", err, http.StatusInternalServerError)
+	}
+
+	if pendingEmail != "" {
+		recordAudit(ctx, user_model.AuditEvent{
+			Action:     user_model.AuditEmailChangeStarted,
+			UserID:     &objId,
+			ResourceID: changeID,
+			Changes:    map[string]user_model.AuditChange{"email": {Before: user.Email, After: pendingEmail}},
+		})
+	}
+
+	if changes := userChanges(userData, &user); len(changes) > 0 {
+		recordAudit(ctx, user_model.AuditEvent{
+			Action:  user_model.AuditUserUpdated,
+			UserID:  &objId,
+			Changes: changes,
+		})
+	}
+
+	return &user, nil
+}
+
+// The function returns the profile fields that differ between `before` and `after`.
+func userChanges(before, after *user_model.User) map[string]user_model.AuditChange {
+	changes := map[string]user_model.AuditChange{}
+
+	afterFields := userProfileFields(after)
+	for field, value := range userProfileFields(before) {
+		if *value != *afterFields[field] {
+			changes[field] = user_model.AuditChange{Before: *value, After: *afterFields[field]}
+		}
+	}
+
+	return changes
+}
+
+// The function applies a merge patch or JSON patch to the mutable fields of `user` and returns their
+// new values.
+func applyUserPatch(user *user_model.User, contentType string, patch []byte) (map[string]string, *error_handler.NewError) {
+	// The document has the fields the user has, like the user's JSON representation.
+	current := map[string]string{}
+	for field, value := range userProfileFields(user) {
+		if *value != "" || contains(requiredUserFields, field) {
+			current[field] = *value
+		}
+	}
+	doc, _ := json.Marshal(current)
+
+	var (
+		patched []byte
+		err     error
+	)
+
+	switch contentType {
+	case MergePatchContentType, "application/json":
+		var fields map[string]json.RawMessage
+		if err = json.Unmarshal(patch, &fields); err != nil {
+			return nil, &error_handler.NewError{
+				Error:      "a merge patch must be a JSON object",
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+		for field := range fields {
+			if !contains(UserMutableFields, field) {
+				return nil, &error_handler.NewError{
+					Error:      fmt.Sprintf("field %q can't be changed", field),
+					StatusCode: http.StatusUnprocessableEntity,
+				}
+			}
+		}
+		patched, err = jsonpatch.MergePatch(doc, patch)
+	case JSONPatchContentType:
+		var operations jsonpatch.Patch
+		if operations, err = jsonpatch.DecodePatch(patch); err == nil {
+			patched, err = operations.Apply(doc)
+		}
+	default:
 		return nil, &error_handler.NewError{
-			Error:      err.Error(),
-			StatusCode: http.StatusInternalServerError,
+			Error:      fmt.Sprintf("unsupported content type %q, use %s or %s", contentType, MergePatchContentType, JSONPatchContentType),
+			StatusCode: http.StatusUnsupportedMediaType,
+		}
+	}
+
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      "invalid patch: " + err.Error(),
+			StatusCode: http.StatusUnprocessableEntity,
+		}
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(patched, &result); err != nil {
+		return nil, &error_handler.NewError{
+			Error:      "patch must leave a JSON object",
+			StatusCode: http.StatusUnprocessableEntity,
 		}
 	}
 
-	return result, nil
+	fields := map[string]string{}
+	for field, value := range result {
+		if !contains(UserMutableFields, field) {
+			return nil, &error_handler.NewError{
+				Error:      fmt.Sprintf("field %q can't be changed", field),
+				StatusCode: http.StatusUnprocessableEntity,
+			}
+		}
+		s, ok := value.(string)
+		if !ok {
+			return nil, &error_handler.NewError{
+				Error:      fmt.Sprintf("field %q must be a string", field),
+				StatusCode: http.StatusUnprocessableEntity,
+			}
+		}
+		fields[field] = strings.TrimSpace(s)
+	}
+
+	return fields, nil
 }
 
-func DeleteUser(id string) (*mongo.DeleteResult, *error_handler.NewError) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// The function deletes the user with `id`. The account is only marked as deleted: it is logged out
+// everywhere, can't log in and can be restored with `RestoreUser` until `USER_DELETION_GRACE_PERIOD`
+// is over, after which the purger removes it. `ifMatch` is the version the client last saw, or nil for
+// "*"; the deletion fails with 412 when the user has changed since and 404 when there is no such user.
+func DeleteUser(ctx context.Context, id string, ifMatch *int64) (res *user_model.User, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.DeleteUser")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "delete_user")
 	defer cancel()
 	objId, err := primitive.ObjectIDFromHex(id)
 
@@ -220,16 +719,171 @@ func DeleteUser(id string) (*mongo.DeleteResult, *error_handler.NewError) {
 		}
 	}
 
-	filter := bson.M{"_id": objId}
+	filter := activeUser(bson.M{"_id": objId})
+	if ifMatch != nil {
+		filter = versionFilter(objId, *ifMatch)
+	}
+
+	now := time.Now().UTC()
+	update := bson.M{
+		"$set": bson.M{"deletedat": now, "updatedat": now},
+		"$inc": bson.M{"version": 1},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user user_model.User
 
-	dResult, err := users.DeleteOne(ctx, filter, nil)
+	done := metrics.ObserveMongo("users", "FindOneAndUpdate")
+	err = users.FindOneAndUpdate(ctx, filter, update, opts).Decode(&user)
+	done(err)
 
+	if err == mongo.ErrNoDocuments {
+		return nil, preconditionFailed(ctx, "DeleteUser", objId)
+	}
 	if err != nil {
-		return nil, &error_handler.NewError{
-			Error:      err.Error(),
-			StatusCode: http.StatusInternalServerError,
+		return nil, dbError(ctx, "DeleteUser", err, http.StatusInternalServerError)
+	}
+
+	if e := revokeUserCredentials(ctx, objId, now); e != nil {
+		return nil, e
+	}
+
+	recordAudit(ctx, user_model.AuditEvent{Action: user_model.AuditUserDeleted, UserID: &objId})
+
+	return &user, nil
+}
+
+// The function matches the user with `id` at `version`, unless it has been deleted. Users stored
+// before versions were added have no version field and match version 0.
+func versionFilter(id primitive.ObjectID, version int64) bson.M {
+	if version == 0 {
+		return activeUser(bson.M{"_id": id, "$or": bson.A{
+			bson.M{"version": 0},
+			bson.M{"version": bson.M{"$exists": false}},
+		}})
+	}
+	return activeUser(bson.M{"_id": id, "version": version})
+}
+
+// The function restricts a users filter to users that haven't been deleted. Deleted users can't log in
+// and aren't found by lookups until they are restored.
+func activeUser(filter bson.M) bson.M {
+	filter["deletedat"] = nil
+	return filter
+}
+
+// The function explains why a versioned write to the user with `id` matched nothing: either the user
+// doesn't exist or it is at another version.
+func preconditionFailed(ctx context.Context, op string, id primitive.ObjectID) *error_handler.NewError {
+	done := metrics.ObserveMongo("users", "CountDocuments")
+	count, err := users.CountDocuments(ctx, activeUser(bson.M{"_id": id}))
+	done(err)
+
+	if err != nil {
+		return dbError(ctx, op, err, http.StatusInternalServerError)
+	}
+
+	if count == 0 {
+		return userNotFound()
+	}
+	return versionMismatch()
+}
+
+// The function checks that no other user than `self` has the handle `username`. An empty username is
+// always available.
+func usernameAvailable(ctx context.Context, username string, self primitive.ObjectID) *error_handler.NewError {
+	if username == "" {
+		return nil
+	}
+
+	done := metrics.ObserveMongo("users", "CountDocuments")
+	count, err := users.CountDocuments(ctx, bson.M{"username": username, "_id": bson.M{"$ne": self}})
+	done(err)
+
+	if err != nil {
+		return dbError(ctx, "usernameAvailable", err, http.StatusInternalServerError)
+	}
+	if count > 0 {
+		return usernameTaken()
+	}
+
+	return nil
+}
+
+func usernameTaken() *error_handler.NewError {
+	return &error_handler.NewError{
+		Error:      "username is already taken",
+		StatusCode: http.StatusConflict,
+		Field:      "username",
+	}
+}
+
+// The function maps a duplicate key error of the users collection to the field whose unique index
+// was violated, read from the server's message. A violation of an index this code doesn't create, such
+// as a unique email index added to the database by hand, is still reported as a conflict but without
+// blaming the username.
+func userConflict(err error) *error_handler.NewError {
+	switch {
+	case duplicateOnIndex(err, "index: username_unique "):
+		return usernameTaken()
+	case duplicateOnIndex(err, "index: verified_phone_unique "):
+		return phoneTaken()
+	case duplicateOnIndex(err, "dup key: { email: "):
+		return &error_handler.NewError{
+			Error:      "a user with this email already exists",
+			StatusCode: http.StatusConflict,
+			Field:      "email",
 		}
 	}
+	return &error_handler.NewError{
+		Error:      "the user conflicts with an existing account",
+		StatusCode: http.StatusConflict,
+	}
+}
+
+// The function reports whether `err` is a duplicate key error whose message contains `message`.
+func duplicateOnIndex(err error, message string) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCodeWithMessage(11000, message)
+}
+
+// The function creates the indexes of the users collection. The unique index on `username` is what
+// enforces unique handles when two users claim one at the same time; users without a username are
+// left out of it. Likewise a phone can only be verified by one user, since it is a login identifier,
+// while unverified phones may be shared.
+func EnsureUserIndexes(ctx context.Context) error {
+	ctx, cancel := withOperationTimeout(ctx, "create_indexes")
+	defer cancel()
+
+	_, err := users.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().
+				SetName("username_unique").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"username": bson.M{"$type": "string"}}),
+		},
+		{
+			Keys: bson.D{{Key: "phone", Value: 1}},
+			Options: options.Index().
+				SetName("verified_phone_unique").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"phoneverifiedat": bson.M{"$exists": true}}),
+		},
+	})
+	return err
+}
+
+func userNotFound() *error_handler.NewError {
+	return &error_handler.NewError{
+		Error:      "user not found",
+		StatusCode: http.StatusNotFound,
+	}
+}
 
-	return dResult, nil
+func versionMismatch() *error_handler.NewError {
+	return &error_handler.NewError{
+		Error:      "user has been modified since it was fetched, fetch it again and retry",
+		StatusCode: http.StatusPreconditionFailed,
+	}
 }
@@ -0,0 +1,171 @@
+package user_services
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/http-crud/api/helpers"
+	user_model "github.com/http-crud/api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestApplyUserPatch(t *testing.T) {
+	user := func() *user_model.User {
+		return &user_model.User{
+			Name:     "Jane",
+			Email:    "jane@example.com",
+			Gender:   "female",
+			Bio:      "hello",
+			Role:     user_model.RoleUser,
+			Password: "hash",
+		}
+	}
+	unchanged := map[string]string{"name": "Jane", "email": "jane@example.com", "gender": "female", "bio": "hello"}
+	with := func(changes map[string]string) map[string]string {
+		fields := map[string]string{}
+		for field, value := range unchanged {
+			fields[field] = value
+		}
+		for field, value := range changes {
+			if value == "" {
+				delete(fields, field)
+			} else {
+				fields[field] = value
+			}
+		}
+		return fields
+	}
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		patch       string
+		want        map[string]string
+		status      int
+	}{
+		{"merge sets a field", MergePatchContentType, `{"displayName": " Jane D "}`, with(map[string]string{"displayName": "Jane D"}), 0},
+		{"merge null deletes a field", MergePatchContentType, `{"bio": null}`, with(map[string]string{"bio": ""}), 0},
+		{"merge null on an absent field", MergePatchContentType, `{"locale": null}`, unchanged, 0},
+		{"plain JSON is a merge patch", "application/json", `{"name": "Janet"}`, with(map[string]string{"name": "Janet"}), 0},
+		{"merge of a protected field", MergePatchContentType, `{"role": "admin"}`, nil, http.StatusUnprocessableEntity},
+		{"merge of the password", MergePatchContentType, `{"password": "secret"}`, nil, http.StatusUnprocessableEntity},
+		{"merge deleting a protected field", MergePatchContentType, `{"version": null}`, nil, http.StatusUnprocessableEntity},
+		{"merge of a number", MergePatchContentType, `{"name": 5}`, nil, http.StatusUnprocessableEntity},
+		{"merge that isn't an object", MergePatchContentType, `["name"]`, nil, http.StatusBadRequest},
+		{"JSON patch replace", JSONPatchContentType, `[{"op": "replace", "path": "/name", "value": "Janet"}]`, with(map[string]string{"name": "Janet"}), 0},
+		{"JSON patch remove", JSONPatchContentType, `[{"op": "remove", "path": "/bio"}]`, with(map[string]string{"bio": ""}), 0},
+		{"JSON patch test and add", JSONPatchContentType, `[{"op": "test", "path": "/name", "value": "Jane"}, {"op": "add", "path": "/locale", "value": "en"}]`, with(map[string]string{"locale": "en"}), 0},
+		{"JSON patch failed test", JSONPatchContentType, `[{"op": "test", "path": "/name", "value": "Bob"}, {"op": "add", "path": "/locale", "value": "en"}]`, nil, http.StatusUnprocessableEntity},
+		{"JSON patch unknown op", JSONPatchContentType, `[{"op": "frobnicate", "path": "/name", "value": "Janet"}]`, nil, http.StatusUnprocessableEntity},
+		{"JSON patch remove of a missing field", JSONPatchContentType, `[{"op": "remove", "path": "/locale"}]`, nil, http.StatusUnprocessableEntity},
+		{"JSON patch of a protected field", JSONPatchContentType, `[{"op": "add", "path": "/role", "value": "admin"}]`, nil, http.StatusUnprocessableEntity},
+		{"JSON patch replacing the document", JSONPatchContentType, `[{"op": "replace", "path": "", "value": {"role": "admin"}}]`, nil, http.StatusUnprocessableEntity},
+		{"malformed JSON patch", JSONPatchContentType, `{"op": "replace"}`, nil, http.StatusUnprocessableEntity},
+		{"unsupported content type", "text/plain", `name=Janet`, nil, http.StatusUnsupportedMediaType},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fields, e := applyUserPatch(user(), tc.contentType, []byte(tc.patch))
+
+			if tc.status != 0 {
+				if e == nil || e.StatusCode != tc.status {
+					t.Fatalf("err = %+v, want %d", e, tc.status)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatal(e.Error)
+			}
+			if !reflect.DeepEqual(fields, tc.want) {
+				t.Fatalf("fields = %v, want %v", fields, tc.want)
+			}
+		})
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	requireMongo(t)
+	ctx := context.Background()
+
+	password, err := helpers.HashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := user_model.User{
+		ID:        primitive.NewObjectID(),
+		Name:      "Jane",
+		Email:     "jane." + primitive.NewObjectID().Hex() + "@example.com",
+		Gender:    "female",
+		Bio:       "hello",
+		Password:  password,
+		Role:      user_model.RoleUser,
+		CreatedAt: time.Now().UTC(),
+		UpdatedAt: time.Now().UTC(),
+		Version:   1,
+	}
+	if _, err := users.InsertOne(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { users.DeleteOne(ctx, bson.M{"_id": user.ID}) })
+
+	id := user.ID.Hex()
+	version := func(v int64) *int64 { return &v }
+
+	res, e := UpdateUser(ctx, id, version(1), MergePatchContentType, []byte(`{"bio": null, "displayName": "JD"}`), user_model.EmailChangeLinks{})
+	if e != nil {
+		t.Fatal(e.Error)
+	}
+	if res.Bio != "" || res.DisplayName != "JD" || res.Version != 2 || res.Role != user_model.RoleUser {
+		t.Fatalf("updated user = %+v", res)
+	}
+
+	var stored bson.M
+	if err := users.FindOne(ctx, bson.M{"_id": user.ID}).Decode(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stored["bio"]; ok {
+		t.Fatalf("the deleted bio is still stored: %v", stored["bio"])
+	}
+
+	for _, tc := range []struct {
+		name        string
+		id          string
+		ifMatch     *int64
+		contentType string
+		patch       string
+		status      int
+	}{
+		{"stale version", id, version(1), MergePatchContentType, `{"name": "Janet"}`, http.StatusPreconditionFailed},
+		{"required field deleted", id, version(2), MergePatchContentType, `{"name": null}`, http.StatusBadRequest},
+		{"protected field", id, version(2), JSONPatchContentType, `[{"op": "replace", "path": "/role", "value": "admin"}]`, http.StatusUnprocessableEntity},
+		{"bad op", id, version(2), JSONPatchContentType, `[{"op": "frobnicate", "path": "/name"}]`, http.StatusUnprocessableEntity},
+		// There is no upsert, a missing user isn't created.
+		{"missing user", primitive.NewObjectID().Hex(), nil, MergePatchContentType, `{"name": "Ghost"}`, http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, e := UpdateUser(ctx, tc.id, tc.ifMatch, tc.contentType, []byte(tc.patch), user_model.EmailChangeLinks{})
+			if e == nil || e.StatusCode != tc.status {
+				t.Fatalf("err = %+v, want %d", e, tc.status)
+			}
+		})
+	}
+
+	count, err := users.CountDocuments(ctx, bson.M{"name": "Ghost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatal("updating a missing user created it")
+	}
+
+	var after user_model.User
+	if err := users.FindOne(ctx, bson.M{"_id": user.ID}).Decode(&after); err != nil {
+		t.Fatal(err)
+	}
+	if after.Version != 2 || after.Name != "Jane" || after.Role != user_model.RoleUser {
+		t.Fatalf("a rejected patch changed the user: %+v", after)
+	}
+}
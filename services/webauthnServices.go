@@ -0,0 +1,522 @@
+package user_services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/http-crud/api/database"
+	"github.com/http-crud/api/helpers"
+	"github.com/http-crud/api/identity"
+	"github.com/http-crud/api/metrics"
+	user_model "github.com/http-crud/api/models"
+	"github.com/http-crud/api/tracing"
+	error_handler "github.com/http-crud/api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// This is a set of functions for registering passkeys and security keys and logging in with them.
+var webAuthnCredentials *mongo.Collection = database.OpenCollection(*database.Client, "webauthn_credentials")
+var webAuthnSessions *mongo.Collection = database.OpenCollection(*database.Client, "webauthn_sessions")
+
+// `webAuthnUser` adapts a user and their registered credentials to the `webauthn.User` interface. The
+// user handle given to authenticators is the 12 bytes of the user's ObjectID.
+type webAuthnUser struct {
+	user        *user_model.User
+	credentials []webauthn.Credential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte                         { return u.user.ID[:] }
+func (u *webAuthnUser) WebAuthnName() string                       { return u.user.Email }
+func (u *webAuthnUser) WebAuthnDisplayName() string                { return u.user.Name }
+func (u *webAuthnUser) WebAuthnIcon() string                       { return "" }
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+// The function starts registering a new passkey for the user with `userID`. The options are passed to
+// `navigator.credentials.create()`; the credentials the user already has are excluded so the same
+// authenticator isn't registered twice.
+func BeginWebAuthnRegistration(ctx context.Context, userID primitive.ObjectID) (res *user_model.WebAuthnBeginResponse, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.BeginWebAuthnRegistration")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "webauthn")
+	defer cancel()
+
+	wa, err := identity.WebAuthn()
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      "webauthn is not configured: " + err.Error(),
+			StatusCode: http.StatusNotImplemented,
+		}
+	}
+
+	u, e := loadWebAuthnUser(ctx, userID)
+	if e != nil {
+		return nil, e
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(u.credentials))
+	for _, c := range u.credentials {
+		exclusions = append(exclusions, c.Descriptor())
+	}
+
+	creation, session, err := wa.BeginRegistration(u, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		return nil, webAuthnError(err)
+	}
+
+	sessionID, e := saveWebAuthnSession(ctx, user_model.WebAuthnRegistration, &userID, session)
+	if e != nil {
+		return nil, e
+	}
+
+	return &user_model.WebAuthnBeginResponse{
+		SessionID: sessionID,
+		Options:   creation,
+	}, nil
+}
+
+// The function verifies the attestation in `body`, the JSON the browser returned from
+// `navigator.credentials.create()`, against the ceremony started with `sessionID` and stores the new
+// credential under `name`.
+func FinishWebAuthnRegistration(ctx context.Context, userID primitive.ObjectID, sessionID, name string, body io.Reader) (res *user_model.WebAuthnCredential, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.FinishWebAuthnRegistration")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "webauthn")
+	defer cancel()
+
+	wa, err := identity.WebAuthn()
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      "webauthn is not configured: " + err.Error(),
+			StatusCode: http.StatusNotImplemented,
+		}
+	}
+
+	session, e := consumeWebAuthnSession(ctx, user_model.WebAuthnRegistration, sessionID)
+	if e != nil {
+		return nil, e
+	}
+
+	if session.UserID == nil || *session.UserID != userID {
+		return nil, &error_handler.NewError{
+			Error:      "invalid or expired webauthn session",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(body)
+	if err != nil {
+		return nil, webAuthnError(err)
+	}
+
+	u, e := loadWebAuthnUser(ctx, userID)
+	if e != nil {
+		return nil, e
+	}
+
+	credential, err := wa.CreateCredential(u, session.Data, parsed)
+	if err != nil {
+		return nil, webAuthnError(err)
+	}
+
+	done := metrics.ObserveMongo("webauthn_credentials", "CountDocuments")
+	count, err := webAuthnCredentials.CountDocuments(ctx, bson.M{"credentialId": credential.ID})
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "FinishWebAuthnRegistration", err, http.StatusInternalServerError)
+	}
+
+	if count > 0 {
+		return nil, &error_handler.NewError{
+			Error:      "this authenticator is already registered",
+			StatusCode: http.StatusConflict,
+		}
+	}
+
+	if name = strings.TrimSpace(name); name == "" {
+		name = "Passkey"
+	}
+
+	doc := user_model.WebAuthnCredential{
+		ID:           primitive.NewObjectID(),
+		UserID:       userID,
+		Name:         name,
+		CredentialID: credential.ID,
+		Credential:   *credential,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	done = metrics.ObserveMongo("webauthn_credentials", "InsertOne")
+	_, err = webAuthnCredentials.InsertOne(ctx, doc)
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "FinishWebAuthnRegistration", err, http.StatusInternalServerError)
+	}
+
+	return &doc, nil
+}
+
+// The function starts a passkey login. With an `email` the options only allow that user's credentials;
+// without one it is a discoverable login where the authenticator picks the account.
+func BeginWebAuthnLogin(ctx context.Context, email string) (res *user_model.WebAuthnBeginResponse, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.BeginWebAuthnLogin")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "webauthn")
+	defer cancel()
+
+	wa, err := identity.WebAuthn()
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      "webauthn is not configured: " + err.Error(),
+			StatusCode: http.StatusNotImplemented,
+		}
+	}
+
+	var (
+		assertion *protocol.CredentialAssertion
+		session   *webauthn.SessionData
+		userID    *primitive.ObjectID
+	)
+
+	if email = strings.TrimSpace(email); email == "" {
+		assertion, session, err = wa.BeginDiscoverableLogin()
+	} else {
+		var user user_model.User
+
+		done := metrics.ObserveMongo("users", "FindOne")
+		err = users.FindOne(ctx, activeUser(bson.M{"email": email}), byEmail()).Decode(&user)
+		done(err)
+
+		if err != nil && err != mongo.ErrNoDocuments {
+			return nil, dbError(ctx, "BeginWebAuthnLogin", err, http.StatusInternalServerError)
+		}
+
+		// An unknown email and an account without passkeys get the same answer.
+		var u *webAuthnUser
+		if err == nil {
+			if u, e = loadWebAuthnUser(ctx, user.ID); e != nil {
+				return nil, e
+			}
+		}
+
+		if u == nil || len(u.credentials) == 0 {
+			metrics.ObserveLogin(false)
+			return nil, &error_handler.NewError{
+				Error:      "no passkey is registered for this account",
+				StatusCode: http.StatusNotFound,
+			}
+		}
+
+		userID = &user.ID
+		assertion, session, err = wa.BeginLogin(u)
+	}
+
+	if err != nil {
+		return nil, webAuthnError(err)
+	}
+
+	sessionID, e := saveWebAuthnSession(ctx, user_model.WebAuthnAuthentication, userID, session)
+	if e != nil {
+		return nil, e
+	}
+
+	return &user_model.WebAuthnBeginResponse{
+		SessionID: sessionID,
+		Options:   assertion,
+	}, nil
+}
+
+// The function verifies the assertion in `body`, the JSON the browser returned from
+// `navigator.credentials.get()`, and logs the user in. The stored sign count is updated; a login whose
+// count doesn't increase means the authenticator may have been cloned, so it is refused and the
+// credential is flagged. A flagged credential is refused before its assertion is even verified, until
+// the user removes it and registers the authenticator again.
+func FinishWebAuthnLogin(ctx context.Context, sessionID string, body io.Reader) (res *user_model.UserLoginResponse, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.FinishWebAuthnLogin")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "webauthn")
+	defer cancel()
+
+	wa, err := identity.WebAuthn()
+	if err != nil {
+		return nil, &error_handler.NewError{
+			Error:      "webauthn is not configured: " + err.Error(),
+			StatusCode: http.StatusNotImplemented,
+		}
+	}
+
+	session, e := consumeWebAuthnSession(ctx, user_model.WebAuthnAuthentication, sessionID)
+	if e != nil {
+		metrics.ObserveLogin(false)
+		return nil, e
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(body)
+	if err != nil {
+		metrics.ObserveLogin(false)
+		return nil, webAuthnError(err)
+	}
+
+	var (
+		u          *webAuthnUser
+		credential *webauthn.Credential
+		refused    *error_handler.NewError
+	)
+
+	if session.UserID != nil {
+		if u, e = loadWebAuthnUser(ctx, *session.UserID); e != nil {
+			metrics.ObserveLogin(false)
+			return nil, e
+		}
+		if e = refuseClonedCredential(u, parsed.RawID); e != nil {
+			metrics.ObserveLogin(false)
+			return nil, e
+		}
+		credential, err = wa.ValidateLogin(u, session.Data, parsed)
+	} else {
+		credential, err = wa.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			if len(userHandle) != len(primitive.ObjectID{}) {
+				return nil, mongo.ErrNoDocuments
+			}
+
+			var id primitive.ObjectID
+			copy(id[:], userHandle)
+
+			user, lookupErr := loadWebAuthnUser(ctx, id)
+			if lookupErr != nil {
+				return nil, mongo.ErrNoDocuments
+			}
+			u = user
+
+			if refused = refuseClonedCredential(u, rawID); refused != nil {
+				return nil, errors.New(refused.Error)
+			}
+			return u, nil
+		}, session.Data, parsed)
+	}
+
+	if refused != nil {
+		metrics.ObserveLogin(false)
+		return nil, refused
+	}
+	if err != nil {
+		metrics.ObserveLogin(false)
+		return nil, webAuthnError(err)
+	}
+
+	now := time.Now().UTC()
+	filter := bson.M{"userId": u.user.ID, "credentialId": credential.ID}
+	update := bson.M{"credential": credential, "lastUsedAt": now}
+
+	if credential.Authenticator.CloneWarning {
+		update = bson.M{"credential.authenticator.clonewarning": true}
+	}
+
+	done := metrics.ObserveMongo("webauthn_credentials", "UpdateOne")
+	_, err = webAuthnCredentials.UpdateOne(ctx, filter, bson.M{"$set": update})
+	done(err)
+
+	if err != nil {
+		metrics.ObserveLogin(false)
+		return nil, dbError(ctx, "FinishWebAuthnLogin", err, http.StatusInternalServerError)
+	}
+
+	if credential.Authenticator.CloneWarning {
+		metrics.ObserveLogin(false)
+		return nil, clonedCredential()
+	}
+
+	return loginResponse(ctx, u.user)
+}
+
+// The function lists the passkeys registered by the user with `userID`.
+func ListWebAuthnCredentials(ctx context.Context, userID primitive.ObjectID) (res []user_model.WebAuthnCredential, e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.ListWebAuthnCredentials")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "webauthn")
+	defer cancel()
+
+	done := metrics.ObserveMongo("webauthn_credentials", "Find")
+	cursor, err := webAuthnCredentials.Find(ctx, bson.M{"userId": userID}, options.Find().SetSort(bson.M{"createdAt": -1}))
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "ListWebAuthnCredentials", err, http.StatusInternalServerError)
+	}
+
+	res = []user_model.WebAuthnCredential{}
+	if err = cursor.All(ctx, &res); err != nil {
+		return nil, dbError(ctx, "ListWebAuthnCredentials", err, http.StatusInternalServerError)
+	}
+	for i := range res {
+		res[i].CloneWarning = res[i].Credential.Authenticator.CloneWarning
+	}
+
+	return res, nil
+}
+
+// The function removes the passkey with `id` from the user with `userID`.
+func DeleteWebAuthnCredential(ctx context.Context, userID primitive.ObjectID, id string) (e *error_handler.NewError) {
+	ctx, span := tracing.StartSpan(ctx, "user_services.DeleteWebAuthnCredential")
+	defer func() { tracing.EndSpan(span, e) }()
+
+	ctx, cancel := withOperationTimeout(ctx, "webauthn")
+	defer cancel()
+
+	objId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return &error_handler.NewError{
+			Error:      err.Error(),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	done := metrics.ObserveMongo("webauthn_credentials", "DeleteOne")
+	result, err := webAuthnCredentials.DeleteOne(ctx, bson.M{"_id": objId, "userId": userID})
+	done(err)
+
+	if err != nil {
+		return dbError(ctx, "DeleteWebAuthnCredential", err, http.StatusInternalServerError)
+	}
+
+	if result.DeletedCount == 0 {
+		return &error_handler.NewError{
+			Error:      "credential not found",
+			StatusCode: http.StatusNotFound,
+		}
+	}
+
+	return nil
+}
+
+// The function loads a user together with their registered credentials.
+func loadWebAuthnUser(ctx context.Context, userID primitive.ObjectID) (*webAuthnUser, *error_handler.NewError) {
+	var user user_model.User
+
+	done := metrics.ObserveMongo("users", "FindOne")
+	err := users.FindOne(ctx, activeUser(bson.M{"_id": userID})).Decode(&user)
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "loadWebAuthnUser", err, http.StatusUnauthorized)
+	}
+
+	done = metrics.ObserveMongo("webauthn_credentials", "Find")
+	cursor, err := webAuthnCredentials.Find(ctx, bson.M{"userId": userID})
+	done(err)
+
+	if err != nil {
+		return nil, dbError(ctx, "loadWebAuthnUser", err, http.StatusInternalServerError)
+	}
+
+	var docs []user_model.WebAuthnCredential
+	if err = cursor.All(ctx, &docs); err != nil {
+		return nil, dbError(ctx, "loadWebAuthnUser", err, http.StatusInternalServerError)
+	}
+
+	u := &webAuthnUser{user: &user}
+	for _, doc := range docs {
+		u.credentials = append(u.credentials, doc.Credential)
+	}
+
+	return u, nil
+}
+
+// The function stores the challenge of a ceremony and returns the id the client sends back to finish
+// it. Sessions live for `WEBAUTHN_SESSION_TTL` (default 5m).
+func saveWebAuthnSession(ctx context.Context, ceremony string, userID *primitive.ObjectID, data *webauthn.SessionData) (string, *error_handler.NewError) {
+	sessionID := randomString()
+
+	session := user_model.WebAuthnSession{
+		ID:        hashToken(sessionID),
+		Ceremony:  ceremony,
+		UserID:    userID,
+		Data:      *data,
+		ExpiresAt: time.Now().UTC().Add(helpers.EnvDuration("WEBAUTHN_SESSION_TTL", 5*time.Minute)),
+	}
+
+	done := metrics.ObserveMongo("webauthn_sessions", "InsertOne")
+	_, err := webAuthnSessions.InsertOne(ctx, session)
+	done(err)
+
+	if err != nil {
+		return "", dbError(ctx, "saveWebAuthnSession", err, http.StatusInternalServerError)
+	}
+
+	return sessionID, nil
+}
+
+// The function takes the session of a ceremony out of the store so its challenge can only be answered
+// once.
+func consumeWebAuthnSession(ctx context.Context, ceremony, sessionID string) (*user_model.WebAuthnSession, *error_handler.NewError) {
+	var session user_model.WebAuthnSession
+
+	filter := bson.M{"_id": hashToken(sessionID), "ceremony": ceremony, "expiresAt": bson.M{"$gt": time.Now().UTC()}}
+
+	done := metrics.ObserveMongo("webauthn_sessions", "FindOneAndDelete")
+	err := webAuthnSessions.FindOneAndDelete(ctx, filter).Decode(&session)
+	done(err)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, &error_handler.NewError{
+			Error:      "invalid or expired webauthn session",
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+
+	if err != nil {
+		return nil, dbError(ctx, "consumeWebAuthnSession", err, http.StatusInternalServerError)
+	}
+
+	return &session, nil
+}
+
+// The function refuses a login with the credential `rawID` of `u` when an earlier login flagged it as
+// possibly cloned. The flag is never cleared, so a cloned key stays refused even once its counter has
+// caught up again.
+func refuseClonedCredential(u *webAuthnUser, rawID []byte) *error_handler.NewError {
+	for _, c := range u.credentials {
+		if bytes.Equal(c.ID, rawID) && c.Authenticator.CloneWarning {
+			return clonedCredential()
+		}
+	}
+	return nil
+}
+
+func clonedCredential() *error_handler.NewError {
+	return &error_handler.NewError{
+		Error:      "the authenticator's signature counter went backwards, it may have been cloned; remove this passkey and register it again",
+		StatusCode: http.StatusUnauthorized,
+	}
+}
+
+// The function turns an error of the webauthn library into an API error, keeping the library's details
+// about why the ceremony failed.
+func webAuthnError(err error) *error_handler.NewError {
+	message := err.Error()
+
+	if perr, ok := err.(*protocol.Error); ok && perr.DevInfo != "" {
+		message = perr.Details + ": " + perr.DevInfo
+	}
+
+	return &error_handler.NewError{
+		Error:      message,
+		StatusCode: http.StatusBadRequest,
+	}
+}
@@ -0,0 +1,317 @@
+package user_services
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/http-crud/api/identity"
+	user_model "github.com/http-crud/api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost:3000"
+)
+
+// `softAuthenticator` is a software passkey: a P-256 key pair with a signature counter, answering the
+// ceremonies the way a browser and a security key would.
+type softAuthenticator struct {
+	key     *ecdsa.PrivateKey
+	id      []byte
+	counter uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, id: id}
+}
+
+// The function returns the authenticator data for the relying party, with `attested` appended.
+func (a *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	return append(data, attested...)
+}
+
+func clientData(t *testing.T, ceremony, challenge string) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": testOrigin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// The function answers `navigator.credentials.create()` with a "none" attestation.
+func (a *softAuthenticator) create(t *testing.T, challenge string) *protocol.ParsedCredentialCreationData {
+	t.Helper()
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.id)))
+	attested = append(attested, a.id...)
+	attested = append(attested, publicKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(0x45, attested), // user present, user verified, attested data
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.id),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData(t, "webauthn.create", challenge)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	})
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+// The function answers `navigator.credentials.get()` with the current counter and returns the JSON
+// body the browser would post.
+func (a *softAuthenticator) get(t *testing.T, challenge string, userHandle []byte) []byte {
+	t.Helper()
+
+	authData := a.authData(0x05, nil) // user present, user verified
+	client := clientData(t, "webauthn.get", challenge)
+	clientHash := sha256.Sum256(client)
+	digest := sha256.Sum256(append(authData, clientHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.id),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(client),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(userHandle),
+		},
+	})
+	return body
+}
+
+func testWebAuthn(t *testing.T) *webauthn.WebAuthn {
+	t.Helper()
+
+	t.Setenv("WEBAUTHN_RP_ID", testRPID)
+	t.Setenv("WEBAUTHN_RP_ORIGINS", testOrigin)
+
+	wa, err := identity.WebAuthn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wa
+}
+
+// The function registers `a` for a new user and returns the user with the credential.
+func registerSoftAuthenticator(t *testing.T, wa *webauthn.WebAuthn, a *softAuthenticator) *webAuthnUser {
+	t.Helper()
+
+	u := &webAuthnUser{user: &user_model.User{ID: primitive.NewObjectID(), Email: "jane@example.com", Name: "Jane"}}
+
+	_, session, err := wa.BeginRegistration(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := wa.CreateCredential(u, *session, a.create(t, session.Challenge))
+	if err != nil {
+		t.Fatal(webAuthnError(err).Error)
+	}
+	u.credentials = append(u.credentials, *credential)
+	return u
+}
+
+// The function runs a login of `u` with `a` and stores the updated credential like a successful
+// login does.
+func softLogin(t *testing.T, wa *webauthn.WebAuthn, u *webAuthnUser, a *softAuthenticator) (*webauthn.Credential, error) {
+	t.Helper()
+
+	_, session, err := wa.BeginLogin(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(a.get(t, session.Challenge, u.WebAuthnID())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := wa.ValidateLogin(u, *session, parsed)
+	if err == nil {
+		u.credentials[0] = *credential
+	}
+	return credential, err
+}
+
+func TestWebAuthnSoftwareAuthenticator(t *testing.T) {
+	wa := testWebAuthn(t)
+	a := newSoftAuthenticator(t)
+	u := registerSoftAuthenticator(t, wa, a)
+
+	for counter := uint32(1); counter <= 2; counter++ {
+		a.counter = counter
+
+		credential, err := softLogin(t, wa, u, a)
+		if err != nil {
+			t.Fatal(webAuthnError(err).Error)
+		}
+		if credential.Authenticator.CloneWarning || credential.Authenticator.SignCount != counter {
+			t.Fatalf("login %d: authenticator = %+v", counter, credential.Authenticator)
+		}
+	}
+
+	// A clone of the key still has the counter of when it was copied.
+	a.counter = 1
+	credential, err := softLogin(t, wa, u, a)
+	if err != nil {
+		t.Fatal(webAuthnError(err).Error)
+	}
+	if !credential.Authenticator.CloneWarning {
+		t.Fatal("a counter going backwards wasn't flagged")
+	}
+	if e := refuseClonedCredential(u, a.id); e == nil || e.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("flagged credential: err = %+v, want 401", e)
+	}
+
+	// The flag stays even once the counter has caught up again.
+	a.counter = 10
+	if _, err := softLogin(t, wa, u, a); err != nil {
+		t.Fatal(webAuthnError(err).Error)
+	}
+	if e := refuseClonedCredential(u, a.id); e == nil {
+		t.Fatal("the flag was cleared by a later login")
+	}
+}
+
+func TestWebAuthnRejectsForeignSignature(t *testing.T) {
+	wa := testWebAuthn(t)
+	a := newSoftAuthenticator(t)
+	u := registerSoftAuthenticator(t, wa, a)
+
+	// Another key answering with the registered credential id.
+	impostor := newSoftAuthenticator(t)
+	impostor.id = a.id
+	impostor.counter = 1
+
+	if _, err := softLogin(t, wa, u, impostor); err == nil {
+		t.Fatal("a login signed by another key succeeded")
+	}
+}
+
+func TestFinishWebAuthnLoginRefusesClonedCredential(t *testing.T) {
+	requireMongo(t)
+	wa := testWebAuthn(t)
+	ctx := context.Background()
+
+	a := newSoftAuthenticator(t)
+	u := registerSoftAuthenticator(t, wa, a)
+	u.user.Email = "jane." + u.user.ID.Hex() + "@example.com"
+
+	if _, err := users.InsertOne(ctx, u.user); err != nil {
+		t.Fatal(err)
+	}
+	credential := u.credentials[0]
+	credential.Authenticator.SignCount = 5
+	if _, err := webAuthnCredentials.InsertOne(ctx, user_model.WebAuthnCredential{
+		ID:           primitive.NewObjectID(),
+		UserID:       u.user.ID,
+		Name:         "Passkey",
+		CredentialID: credential.ID,
+		Credential:   credential,
+		CreatedAt:    time.Now().UTC(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		users.DeleteOne(ctx, bson.M{"_id": u.user.ID})
+		webAuthnCredentials.DeleteMany(ctx, bson.M{"userId": u.user.ID})
+	})
+
+	login := func(counter uint32) {
+		t.Helper()
+
+		_, session, err := wa.BeginLogin(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionID, e := saveWebAuthnSession(ctx, user_model.WebAuthnAuthentication, &u.user.ID, session)
+		if e != nil {
+			t.Fatal(e.Error)
+		}
+
+		a.counter = counter
+		_, e = FinishWebAuthnLogin(ctx, sessionID, bytes.NewReader(a.get(t, session.Challenge, u.WebAuthnID())))
+		if e == nil || e.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("login with counter %d: err = %+v, want 401", counter, e)
+		}
+	}
+
+	// The counter goes backwards: the login is refused and the credential flagged.
+	login(3)
+
+	var stored user_model.WebAuthnCredential
+	if err := webAuthnCredentials.FindOne(ctx, bson.M{"userId": u.user.ID}).Decode(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Credential.Authenticator.CloneWarning || stored.Credential.Authenticator.SignCount != 5 {
+		t.Fatalf("stored authenticator = %+v, want flagged with the old counter", stored.Credential.Authenticator)
+	}
+
+	// A valid signature with a higher counter is still refused.
+	login(6)
+}
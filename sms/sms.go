@@ -0,0 +1,163 @@
+package sms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// `Message` is a text message to a phone number in E.164 format.
+type Message struct {
+	To   string
+	Body string
+}
+
+// `Sender` sends text messages. Implementations must be safe for concurrent use.
+type Sender interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// `ErrNotConfigured` is returned by `Default` when no sender is configured, or only one meant for
+// development outside of development mode.
+var ErrNotConfigured = errors.New("no SMS sender is configured")
+
+var (
+	defaultOnce   sync.Once
+	defaultSender Sender
+	defaultErr    error
+)
+
+// The function returns the sender configured with `SMS_SENDER`:
+//   - "webhook" posts every message as JSON to `SMS_WEBHOOK_URL`, typically an SMS gateway or a small
+//     relay in front of one, with `SMS_WEBHOOK_TOKEN` as bearer token when set.
+//   - "log" logs the messages and "file" appends them to `SMS_FILE` (default "sms.log"). The codes sent
+//     would end up in the logs, so they are only accepted when `SMS_DEV_MODE` is true.
+//
+// Anything else fails with `ErrNotConfigured`, so no code is sent by accident where anyone who reads
+// the logs would get it. Another sender is plugged in with `SetDefault`.
+func Default() (Sender, error) {
+	defaultOnce.Do(func() {
+		devMode, _ := strconv.ParseBool(os.Getenv("SMS_DEV_MODE"))
+
+		switch sender := os.Getenv("SMS_SENDER"); {
+		case sender == "webhook":
+			if os.Getenv("SMS_WEBHOOK_URL") == "" {
+				defaultErr = fmt.Errorf("%w: SMS_WEBHOOK_URL is not set", ErrNotConfigured)
+				return
+			}
+			defaultSender = &WebhookSender{
+				URL:    os.Getenv("SMS_WEBHOOK_URL"),
+				Token:  os.Getenv("SMS_WEBHOOK_TOKEN"),
+				Client: &http.Client{Timeout: 10 * time.Second},
+			}
+		case (sender == "log" || sender == "file") && !devMode:
+			defaultErr = fmt.Errorf("%w: SMS_SENDER=%s needs SMS_DEV_MODE=true", ErrNotConfigured, sender)
+		case sender == "log":
+			defaultSender = LogSender{}
+		case sender == "file":
+			path := os.Getenv("SMS_FILE")
+			if path == "" {
+				path = "sms.log"
+			}
+			defaultSender = &FileSender{Path: path}
+		default:
+			defaultErr = ErrNotConfigured
+		}
+	})
+	return defaultSender, defaultErr
+}
+
+// The function replaces the sender returned by `Default`.
+func SetDefault(s Sender) {
+	defaultOnce.Do(func() {})
+	defaultSender, defaultErr = s, nil
+}
+
+// `LogSender` writes text messages to the log instead of sending them.
+type LogSender struct{}
+
+func (LogSender) Send(_ context.Context, m Message) error {
+	log.Printf("sms to=%s\n%s", m.To, m.Body)
+	return nil
+}
+
+// `FileSender` appends text messages to the file at `Path`, one JSON object per line, so tests and
+// local tools can read the codes sent.
+type FileSender struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (f *FileSender) Send(_ context.Context, m Message) error {
+	line, err := json.Marshal(struct {
+		To     string    `json:"to"`
+		Body   string    `json:"body"`
+		SentAt time.Time `json:"sentAt"`
+	}{m.To, m.Body, time.Now().UTC()})
+
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("error occured while opening the sms file %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error occured while writing the sms file %w", err)
+	}
+	return nil
+}
+
+// `WebhookSender` posts text messages as a JSON object with `to` and `body` to `URL`. Any status
+// other than 2xx is an error.
+type WebhookSender struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func (s *WebhookSender) Send(ctx context.Context, m Message) error {
+	payload, err := json.Marshal(struct {
+		To   string `json:"to"`
+		Body string `json:"body"`
+	}{m.To, m.Body})
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error occured while sending sms %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("sms webhook returned %v", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// `LocalStore` keeps blobs as files under `Dir`. The app serves them itself with `Handler`, under
+// `PublicURL`.
+type LocalStore struct {
+	Dir       string
+	PublicURL string
+}
+
+// The function creates `dir` if needed and returns a store keeping its blobs there.
+func NewLocalStore(dir, publicURL string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error occured while creating the blob directory %w", err)
+	}
+	return &LocalStore{Dir: dir, PublicURL: publicURL}, nil
+}
+
+// The file is written next to its final path and renamed, so a blob is never read half written.
+func (s *LocalStore) Put(_ context.Context, key string, r io.Reader, _ int64, _ string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Keys are slash separated, so a prefix ending in "/" is a directory and is removed with everything
+// in it.
+func (s *LocalStore) DeletePrefix(_ context.Context, prefix string) error {
+	path, err := s.path(strings.TrimSuffix(prefix, "/"))
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(prefix, "/") {
+		return os.RemoveAll(path)
+	}
+
+	matches, err := filepath.Glob(path + "*")
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		if err := os.RemoveAll(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *LocalStore) URL(key string) string {
+	return s.PublicURL + "/" + key
+}
+
+// The function returns the handler serving the blobs, to be mounted at `PublicURL`. Keys are never
+// reused for new content, so the responses can be cached for good; directories aren't listed.
+func (s *LocalStore) Handler() http.Handler {
+	files := http.StripPrefix(s.PublicURL+"/", http.FileServer(http.Dir(s.Dir)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		files.ServeHTTP(w, r)
+	})
+}
+
+// The function returns the file path of `key`, refusing keys that would leave `Dir`.
+func (s *LocalStore) path(key string) (string, error) {
+	key = filepath.FromSlash(key)
+	if key == "" || !filepath.IsLocal(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.Dir, key), nil
+}
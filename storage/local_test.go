@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestLocalStore(t *testing.T) *LocalStore {
+	t.Helper()
+
+	store, err := NewLocalStore(filepath.Join(t.TempDir(), "blobs"), "/blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func put(t *testing.T, store BlobStore, key, content string) {
+	t.Helper()
+
+	if err := store.Put(context.Background(), key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatalf("put %v: %v", key, err)
+	}
+}
+
+func TestLocalStorePutReplacesBlob(t *testing.T) {
+	store := newTestLocalStore(t)
+
+	put(t, store, "avatars/u1/a1/64.jpg", "first")
+	put(t, store, "avatars/u1/a1/64.jpg", "second")
+
+	data, err := os.ReadFile(filepath.Join(store.Dir, "avatars", "u1", "a1", "64.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "second" {
+		t.Fatalf("blob = %q, want %q", data, "second")
+	}
+
+	// No temporary file of the uploads is left behind.
+	entries, err := os.ReadDir(filepath.Join(store.Dir, "avatars", "u1", "a1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("%d files in the blob directory, want 1", len(entries))
+	}
+
+	if got := store.URL("avatars/u1/a1/64.jpg"); got != "/blobs/avatars/u1/a1/64.jpg" {
+		t.Fatalf("URL = %q", got)
+	}
+}
+
+func TestLocalStoreRejectsKeysOutsideDir(t *testing.T) {
+	store := newTestLocalStore(t)
+	ctx := context.Background()
+
+	for _, key := range []string{"", "../escape", "avatars/../../escape", "/etc/passwd"} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("put %q succeeded", key)
+		}
+		if err := store.DeletePrefix(ctx, key); err == nil {
+			t.Errorf("delete prefix %q succeeded", key)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(store.Dir), "escape")); !os.IsNotExist(err) {
+		t.Fatalf("a blob was written outside the store: %v", err)
+	}
+}
+
+func TestLocalStoreDeletePrefix(t *testing.T) {
+	store := newTestLocalStore(t)
+	ctx := context.Background()
+
+	put(t, store, "avatars/u1/a1/64.jpg", "x")
+	put(t, store, "avatars/u1/a1/128.jpg", "x")
+	put(t, store, "avatars/u1/a2/64.jpg", "x")
+	put(t, store, "avatars/u10/a1/64.jpg", "x")
+
+	// A prefix ending in "/" removes a directory.
+	if err := store.DeletePrefix(ctx, "avatars/u1/a1/"); err != nil {
+		t.Fatal(err)
+	}
+	assertBlobs(t, store, "avatars/u1/a2/64.jpg", "avatars/u10/a1/64.jpg")
+
+	// Any other prefix matches the start of the names.
+	if err := store.DeletePrefix(ctx, "avatars/u1"); err != nil {
+		t.Fatal(err)
+	}
+	assertBlobs(t, store)
+
+	if err := store.DeletePrefix(ctx, "avatars/missing/"); err != nil {
+		t.Fatalf("deleting nothing: %v", err)
+	}
+}
+
+func assertBlobs(t *testing.T, store *LocalStore, want ...string) {
+	t.Helper()
+
+	var got []string
+	filepath.WalkDir(store.Dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(store.Dir, path)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("blobs = %v, want %v", got, want)
+	}
+}
+
+func TestLocalStoreHandler(t *testing.T) {
+	store := newTestLocalStore(t)
+	put(t, store, "avatars/u1/a1/64.jpg", "image")
+
+	server := httptest.NewServer(store.Handler())
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/blobs/avatars/u1/a1/64.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || string(body) != "image" {
+		t.Fatalf("GET blob = %v %q", res.Status, body)
+	}
+	if res.Header.Get("X-Content-Type-Options") != "nosniff" || !strings.Contains(res.Header.Get("Cache-Control"), "immutable") {
+		t.Fatalf("headers = %v", res.Header)
+	}
+
+	// Directories aren't listed.
+	res, err = http.Get(server.URL + "/blobs/avatars/u1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET directory = %v, want 404", res.Status)
+	}
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// The test runs against the S3 compatible service at `S3_TEST_ENDPOINT`, typically a local MinIO:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	S3_TEST_ENDPOINT=localhost:9000 S3_TEST_ACCESS_KEY=minioadmin S3_TEST_SECRET_KEY=minioadmin go test ./storage
+//
+// It creates a bucket of its own and removes it afterwards.
+func newTestS3Store(t *testing.T) *S3Store {
+	t.Helper()
+
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+	useSSL, _ := strconv.ParseBool(os.Getenv("S3_TEST_USE_SSL"))
+
+	ctx := context.Background()
+	bucket := "http-crud-test-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	store, err := NewS3Store(ctx, S3Config{
+		Endpoint:  endpoint,
+		AccessKey: os.Getenv("S3_TEST_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_TEST_SECRET_KEY"),
+		Bucket:    bucket,
+		UseSSL:    useSSL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		store.DeletePrefix(ctx, "")
+		store.client.RemoveBucket(ctx, bucket)
+	})
+	return store
+}
+
+func s3Keys(t *testing.T, store *S3Store) []string {
+	t.Helper()
+
+	var keys []string
+	for object := range store.client.ListObjects(context.Background(), store.bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if object.Err != nil {
+			t.Fatal(object.Err)
+		}
+		keys = append(keys, object.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestS3Store(t *testing.T) {
+	store := newTestS3Store(t)
+	ctx := context.Background()
+
+	put(t, store, "avatars/u1/a1/64.jpg", "first")
+	put(t, store, "avatars/u1/a1/64.jpg", "second")
+	put(t, store, "avatars/u1/a1/128.jpg", "x")
+	put(t, store, "avatars/u1/a2/64.jpg", "x")
+	put(t, store, "avatars/u10/a1/64.jpg", "x")
+
+	info, err := store.client.StatObject(ctx, store.bucket, "avatars/u1/a1/64.jpg", minio.StatObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len("second")) || info.ContentType != "text/plain" {
+		t.Fatalf("stored object = %d bytes of %q", info.Size, info.ContentType)
+	}
+
+	if url := store.URL("avatars/u1/a1/64.jpg"); !strings.HasSuffix(url, "/"+store.bucket+"/avatars/u1/a1/64.jpg") {
+		t.Fatalf("URL = %q", url)
+	}
+
+	if err := store.DeletePrefix(ctx, "avatars/u1/a1/"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(s3Keys(t, store), ","); got != "avatars/u1/a2/64.jpg,avatars/u10/a1/64.jpg" {
+		t.Fatalf("keys = %v", got)
+	}
+
+	if err := store.DeletePrefix(ctx, "avatars/missing/"); err != nil {
+		t.Fatalf("deleting nothing: %v", err)
+	}
+}
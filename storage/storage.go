@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// `BlobStore` stores files such as avatars under slash separated keys. Implementations must be safe
+// for concurrent use.
+type BlobStore interface {
+	// Put stores the `size` bytes read from `r` under `key`, replacing any blob with that key.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// DeletePrefix deletes every blob whose key starts with `prefix`. Deleting nothing is not an error.
+	DeletePrefix(ctx context.Context, prefix string) error
+	// URL returns the URL clients download the blob with `key` from.
+	URL(key string) string
+}
+
+var (
+	defaultOnce  sync.Once
+	defaultStore BlobStore
+	defaultErr   error
+)
+
+// The function returns the blob store configured with `BLOB_STORE`:
+//   - "s3" stores blobs in the S3 compatible bucket `S3_BUCKET` at `S3_ENDPOINT` (host:port) with
+//     `S3_ACCESS_KEY` and `S3_SECRET_KEY`. `S3_USE_SSL` (default true) and `S3_REGION` are optional,
+//     and `S3_PUBLIC_URL` is the base of the blob URLs when they aren't served from the endpoint, e.g.
+//     a CDN. A local MinIO server works as a stand-in for development.
+//   - anything else stores blobs in the directory `BLOB_LOCAL_DIR` (default "uploads"), served by the
+//     app under `BLOB_PUBLIC_URL` (default "/blobs").
+func Default() (BlobStore, error) {
+	defaultOnce.Do(func() {
+		switch os.Getenv("BLOB_STORE") {
+		case "s3":
+			useSSL, err := strconv.ParseBool(os.Getenv("S3_USE_SSL"))
+			if err != nil {
+				useSSL = true
+			}
+			defaultStore, defaultErr = NewS3Store(context.Background(), S3Config{
+				Endpoint:  os.Getenv("S3_ENDPOINT"),
+				AccessKey: os.Getenv("S3_ACCESS_KEY"),
+				SecretKey: os.Getenv("S3_SECRET_KEY"),
+				Bucket:    os.Getenv("S3_BUCKET"),
+				Region:    os.Getenv("S3_REGION"),
+				UseSSL:    useSSL,
+				PublicURL: os.Getenv("S3_PUBLIC_URL"),
+			})
+		default:
+			dir := os.Getenv("BLOB_LOCAL_DIR")
+			if dir == "" {
+				dir = "uploads"
+			}
+			publicURL := strings.TrimSuffix(os.Getenv("BLOB_PUBLIC_URL"), "/")
+			if publicURL == "" {
+				publicURL = "/blobs"
+			}
+			defaultStore, defaultErr = NewLocalStore(dir, publicURL)
+		}
+	})
+	return defaultStore, defaultErr
+}
+
+// The function replaces the blob store returned by `Default`, e.g. by one in a temporary directory
+// in tests.
+func SetDefault(s BlobStore) {
+	defaultOnce.Do(func() {})
+	defaultStore, defaultErr = s, nil
+}
@@ -0,0 +1,92 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	error_handler "github.com/http-crud/api/utils"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/http-crud/api"
+
+// `Tracer` is used by the services and the database package to start their spans. It is resolved
+// through the global provider, so spans started before `InitTracer` runs are still exported once a
+// provider is installed.
+var Tracer = otel.Tracer(instrumentationName)
+
+// The function installs the global tracer provider and the W3C `traceparent`/`baggage` propagators.
+// The exporter is chosen with `TRACES_EXPORTER`:
+//   - "stdout" writes every span as JSON to standard output
+//   - "file" appends every span as JSON to the file in `TRACES_FILE`
+//   - anything else disables exporting, but incoming trace context is still propagated
+//
+// The returned function flushes and shuts the provider down.
+func InitTracer() (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var out io.Writer
+	switch os.Getenv("TRACES_EXPORTER") {
+	case "stdout":
+		out = os.Stdout
+	case "file":
+		f, err := os.OpenFile(os.Getenv("TRACES_FILE"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("error occured while opening traces file %w", err)
+		}
+		out = f
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(out), stdouttrace.WithPrettyPrint())
+	if err != nil {
+		return nil, fmt.Errorf("error occured while creating trace exporter %w", err)
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "http-crud-api"
+	}
+
+	// The exporters are meant for local testing, so spans are written synchronously instead of being
+	// batched. Nothing is lost when the process exits through `log.Fatal`.
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// The function wraps a handler so every incoming request gets a server span named after `route`. The
+// parent span is taken from the W3C `traceparent` header when the caller sends one.
+func Middleware(route string, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, route)
+}
+
+// The function starts a child span of the span stored in `ctx`.
+func StartSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return Tracer.Start(ctx, name)
+}
+
+// The function ends `span` and marks it as failed when the service returned an error.
+func EndSpan(span trace.Span, e *error_handler.NewError) {
+	if e != nil {
+		span.SetStatus(codes.Error, e.Error)
+		span.RecordError(fmt.Errorf("%s", e.Error), trace.WithAttributes(semconv.HTTPResponseStatusCode(e.StatusCode)))
+	}
+	span.End()
+}
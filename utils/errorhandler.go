@@ -1,8 +1,15 @@
 package error_handler
 
+import (
+	"encoding/json"
+	"net/http"
+)
+
 type NewError struct {
 	Error      string
 	StatusCode int
+	// `Field` names the input the error is about when it comes from validating a single field.
+	Field string `json:",omitempty"`
 }
 
 // The function returns a pointer to a new error object with the same error message and status code as
@@ -13,3 +20,16 @@ func HandleError(e NewError) *NewError {
 		StatusCode: e.StatusCode,
 	}
 }
+
+// The function writes `e` as a JSON response with its status code as the HTTP status, so clients,
+// metrics and the audit log see the same status as the body. A few older errors carry a status below
+// 400 in the body; those are sent as 400 Bad Request.
+func WriteError(w http.ResponseWriter, e *NewError) {
+	status := e.StatusCode
+	if status < http.StatusBadRequest {
+		status = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
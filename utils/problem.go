@@ -0,0 +1,30 @@
+package error_handler
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// `Problem` is an RFC 7807 problem details response. `RequestID` is an extension member so clients
+// can quote it when reporting an issue.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// The function writes `p` as an `application/problem+json` response with the status set in `p`.
+func WriteProblem(w http.ResponseWriter, p Problem) {
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}